@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -14,8 +15,14 @@ import (
 	"github.com/google/uuid"
 
 	"dating-svelte/internal/database"
+	"dating-svelte/internal/dates"
+	"dating-svelte/internal/expiry"
 	"dating-svelte/internal/handlers"
 	"dating-svelte/internal/middleware"
+	"dating-svelte/internal/notify"
+	"dating-svelte/internal/pubsub"
+	"dating-svelte/internal/screening"
+	"dating-svelte/internal/storage"
 	wshandler "dating-svelte/internal/websocket"
 )
 
@@ -34,17 +41,62 @@ func main() {
 	}
 	defer db.Close()
 
-	// Initialize WebSocket hub
-	wsHub = wshandler.NewHub(db)
+	// Initialize realtime pub/sub so every replica can reach every user
+	broker, err := newBroker(db, dbURL)
+	if err != nil {
+		log.Fatal("Failed to start realtime broker:", err)
+	}
+	defer broker.Close()
+
+	// Initialize WebSocket hub with per-connection frame rate limits
+	wsLimits, err := wshandler.ParseRateLimits(os.Getenv("WS_RATE_LIMITS"))
+	if err != nil {
+		log.Fatal("Invalid WS_RATE_LIMITS:", err)
+	}
+
+	// Content screening rules are reloaded whenever the file changes
+	screener, err := screening.NewScreener(os.Getenv("SCREENING_RULES"))
+	if err != nil {
+		log.Fatal("Failed to load screening rules:", err)
+	}
+	go screener.Watch(30 * time.Second)
+
+	wsHub = wshandler.NewHub(db, broker, wsLimits, screener)
 	go wsHub.Run()
 
-	// Initialize handlers with database
-	handlers.InitializeHandlers(db)
+	// Initialize file storage for uploads
+	uploadDir := os.Getenv("UPLOAD_DIR")
+	if uploadDir == "" {
+		uploadDir = "./uploads"
+	}
+
+	files, err := storage.NewLocal(uploadDir)
+	if err != nil {
+		log.Fatal("Failed to initialize storage:", err)
+	}
+
+	// Matches nobody messages within MATCH_EXPIRY (e.g. "24h") expire
+	matchExpiry, err := expiry.ParsePolicy(os.Getenv("MATCH_EXPIRY"), os.Getenv("MATCH_EXPIRY_WARNING"))
+	if err != nil {
+		log.Fatal("Invalid MATCH_EXPIRY:", err)
+	}
+	go expiry.NewSweeper(db, wsHub, matchExpiry).Run(time.Minute)
+
+	// Remind both members ahead of accepted dates
+	go dates.NewReminder(db, wsHub).Run(time.Minute)
+
+	// Safety check-ins alert a user's trusted contact if they don't check in
+	checkIns := dates.NewCheckIns(db, wsHub, newNotifier())
+	go checkIns.Run(time.Minute)
+
+	// Initialize handlers with database, hub, storage, expiry policy and check-ins
+	handlers.InitializeHandlers(db, wsHub, files, matchExpiry, checkIns)
 
 	app := fiber.New(fiber.Config{
 		Prefork:     false, // Disable for development
 		JSONEncoder: json.Marshal,
 		JSONDecoder: json.Unmarshal,
+		BodyLimit:   20 * 1024 * 1024, // Matches client_max_body_size in nginx.conf
 	})
 
 	// Middleware
@@ -82,7 +134,7 @@ func main() {
 	})
 
 	// Routes
-	setupRoutes(app)
+	setupRoutes(app, db)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -93,7 +145,54 @@ func main() {
 	log.Fatal(app.Listen(":" + port))
 }
 
-func setupRoutes(app *fiber.App) {
+// newBroker picks the realtime backend from REALTIME_BACKEND. "postgres"
+// relays events through LISTEN/NOTIFY for multi-replica deployments; the
+// default keeps everything in process.
+func newBroker(db *database.DB, dbURL string) (pubsub.Broker, error) {
+	switch os.Getenv("REALTIME_BACKEND") {
+	case "postgres":
+		return pubsub.NewPostgresBroker(db, dbURL)
+	case "", "memory":
+		return pubsub.NewMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("unknown REALTIME_BACKEND %q", os.Getenv("REALTIME_BACKEND"))
+	}
+}
+
+// newNotifier picks how trusted contacts are reached: by email when
+// SMTP_HOST is set and by SMS when SMS_WEBHOOK_URL is set. With neither,
+// messages are only logged.
+func newNotifier() notify.Notifier {
+	var notifiers notify.Multi
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		from := os.Getenv("SMTP_FROM")
+		if from == "" {
+			from = os.Getenv("SMTP_USER")
+		}
+		notifiers = append(notifiers, &notify.Email{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USER"),
+			Password: os.Getenv("SMTP_PASS"),
+			From:     from,
+		})
+	}
+	if url := os.Getenv("SMS_WEBHOOK_URL"); url != "" {
+		notifiers = append(notifiers, notify.NewSMS(url, os.Getenv("SMS_WEBHOOK_TOKEN")))
+	}
+
+	if len(notifiers) == 0 {
+		log.Printf("No SMTP_HOST or SMS_WEBHOOK_URL set; safety alerts will only be logged")
+		return notify.Log{}
+	}
+	return notifiers
+}
+
+func setupRoutes(app *fiber.App, db *database.DB) {
 	api := app.Group("/api/v1")
 
 	// Auth routes
@@ -101,33 +200,81 @@ func setupRoutes(app *fiber.App) {
 	api.Post("/login", handlers.Login)
 	api.Post("/refresh", handlers.RefreshToken)
 
+	// Attachments are authorized by a signed URL rather than a header
+	api.Get("/attachments/:attachmentId", handlers.GetAttachment)
+
 	// Protected routes
 	protected := api.Use(middleware.AuthRequired())
 	protected.Get("/me", handlers.GetCurrentUser)
+	protected.Post("/ws/ticket", handlers.CreateWebSocketTicket)
 	protected.Get("/profile", handlers.GetProfile)
 	protected.Put("/profile", handlers.UpdateProfile)
 	protected.Get("/matches", handlers.GetMatches)
 	protected.Get("/potential-matches", handlers.GetPotentialMatches)
 	protected.Post("/swipe", handlers.Swipe)
+	protected.Get("/presence", handlers.GetPresence)
+	protected.Put("/presence/settings", handlers.UpdatePresenceSettings)
 
 	// Message routes
+	protected.Get("/messages/search", handlers.SearchMessages)
 	protected.Get("/matches/:matchId/messages", handlers.GetMessages)
+	protected.Post("/matches/:matchId/messages", handlers.SendMessage)
+	protected.Put("/matches/:matchId/messages/:messageId", handlers.EditMessage)
+	protected.Delete("/matches/:matchId/messages/:messageId", handlers.DeleteMessage)
+	protected.Post("/matches/:matchId/messages/:messageId/reactions", handlers.AddReaction)
+	protected.Delete("/matches/:matchId/messages/:messageId/reactions", handlers.RemoveReaction)
+	protected.Post("/matches/:matchId/attachments", handlers.UploadAttachment)
 	protected.Get("/matches/:matchId", handlers.GetMatchDetails)
+	protected.Get("/matches/:matchId/icebreakers", handlers.GetIcebreakers)
+	protected.Post("/matches/:matchId/extend", handlers.ExtendMatch)
+	protected.Get("/matches/:matchId/notes", handlers.GetNotes)
+	protected.Post("/matches/:matchId/notes", handlers.CreateNote)
+	protected.Put("/matches/:matchId/notes/:noteId", handlers.UpdateNote)
+	protected.Delete("/matches/:matchId/notes/:noteId", handlers.DeleteNote)
+	protected.Get("/matches/:matchId/transcript", handlers.GetTranscript)
+	protected.Get("/matches/:matchId/dates", handlers.GetMatchDates)
+	protected.Post("/matches/:matchId/dates", handlers.ProposeDate)
+	protected.Post("/matches/:matchId/dates/:planId/accept", handlers.RespondToDate(true))
+	protected.Post("/matches/:matchId/dates/:planId/decline", handlers.RespondToDate(false))
+	protected.Post("/matches/:matchId/dates/:planId/counter", handlers.CounterDate)
+	protected.Get("/dates", handlers.GetDates)
+	protected.Post("/dates/:planId/checkin", handlers.ScheduleCheckIn)
+	protected.Get("/checkins", handlers.GetCheckIns)
+	protected.Post("/checkins/:checkinId/confirm", handlers.ConfirmCheckIn)
+	protected.Delete("/checkins/:checkinId", handlers.CancelCheckIn)
+	protected.Post("/reports", handlers.CreateReport)
+	protected.Put("/matches/:matchId/mute", handlers.SetMatchFlag("muted", true))
+	protected.Delete("/matches/:matchId/mute", handlers.SetMatchFlag("muted", false))
+	protected.Put("/matches/:matchId/archive", handlers.SetMatchFlag("archived", true))
+	protected.Delete("/matches/:matchId/archive", handlers.SetMatchFlag("archived", false))
+	protected.Put("/matches/:matchId/pin", handlers.SetMatchFlag("pinned", true))
+	protected.Delete("/matches/:matchId/pin", handlers.SetMatchFlag("pinned", false))
 
 	// Development/Testing routes
 	protected.Post("/seed", handlers.SeedData)
 
 	// WebSocket for real-time messaging (with auth)
 	app.Use("/ws", func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			return c.Next()
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
+		// Negotiate the protocol version before a ticket is spent
+		version, err := wshandler.NegotiateVersion(c.Query("v"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error":     err.Error(),
+				"supported": wshandler.SupportedVersions,
+			})
 		}
-		return fiber.ErrUpgradeRequired
+		c.Locals("protocol_version", version)
+		return c.Next()
 	})
 
-	app.Get("/ws", middleware.AuthRequired(), func(c *fiber.Ctx) error {
+	app.Get("/ws", middleware.WebSocketAuth(db.RedeemWebSocketTicket), func(c *fiber.Ctx) error {
 		userID := c.Locals("user_id").(uuid.UUID)
-		return websocket.New(wshandler.HandleWebSocket(wsHub, userID))(c)
+		tokenExpiresAt, _ := c.Locals("token_expires_at").(time.Time)
+		version := c.Locals("protocol_version").(int)
+		return websocket.New(wshandler.HandleWebSocket(wsHub, userID, tokenExpiresAt, version))(c)
 	})
 
 	// Payment routes
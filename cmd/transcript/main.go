@@ -0,0 +1,52 @@
+// Command transcript checks the signature of conversation transcripts, in
+// either export format, for moderators reviewing a report. Run it with the
+// server's JWT_SECRET set:
+//
+//	go run ./cmd/transcript transcript.txt report.json
+//
+// With no files it reads one transcript from standard input. It exits
+// non-zero if any transcript does not verify.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"dating-svelte/internal/transcript"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal("Failed to read transcript:", err)
+		}
+		if !check("stdin", data) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ok := true
+	for _, path := range os.Args[1:] {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal("Failed to read transcript:", err)
+		}
+		ok = check(path, data) && ok
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func check(name string, data []byte) bool {
+	if err := transcript.Verify(data); err != nil {
+		fmt.Printf("%s: %v\n", name, err)
+		return false
+	}
+	fmt.Printf("%s: signature OK\n", name)
+	return true
+}
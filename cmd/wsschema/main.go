@@ -0,0 +1,19 @@
+// Command wsschema prints the JSON Schema of the realtime protocol, for
+// generating client types. Run it with go generate ./internal/websocket.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	wshandler "dating-svelte/internal/websocket"
+)
+
+func main() {
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	if err := out.Encode(wshandler.Schema()); err != nil {
+		log.Fatal("Failed to write schema:", err)
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/lib/pq v1.10.9
 	golang.org/x/crypto v0.14.0
+	golang.org/x/image v0.13.0
 )
 
 require (
@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"os"
 	"time"
@@ -125,3 +129,33 @@ func RefreshAccessToken(refreshTokenString string) (*TokenPair, error) {
 	// Generate new token pair
 	return GenerateTokenPair(claims.UserID, claims.Email, claims.IsPremium)
 }
+
+// SignValue returns an HMAC-SHA256 signature of value, used for URLs that
+// must work without an Authorization header (e.g. <img src>).
+func SignValue(value string) string {
+	mac := hmac.New(sha256.New, getJWTSecret())
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignedValue checks a signature produced by SignValue.
+func VerifySignedValue(value, signature string) bool {
+	return hmac.Equal([]byte(SignValue(value)), []byte(signature))
+}
+
+// GenerateTicket returns a random single-use ticket and the hash to store
+// for it. Only the hash is kept, so a leaked table cannot be replayed.
+func GenerateTicket() (ticket string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	ticket = hex.EncodeToString(b)
+	return ticket, HashTicket(ticket), nil
+}
+
+// HashTicket returns the stored form of a ticket from GenerateTicket.
+func HashTicket(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,11 +1,17 @@
 package database
 
 import (
+    "database/sql"
+    "encoding/base64"
+    "errors"
     "fmt"
+    "strconv"
+    "strings"
+    "time"
     
     "github.com/jmoiron/sqlx"
     "github.com/google/uuid"
-    _ "github.com/lib/pq"
+    "github.com/lib/pq"
     
     "dating-svelte/internal/models"
 )
@@ -14,6 +20,15 @@ type DB struct {
     *sqlx.DB
 }
 
+// messageColumns are the messages columns scanned into models.Message. The
+// search_vector column is left out; it is only used inside queries.
+const messageColumns = `id, match_id, sender_id, client_id, message, message_type, attachment_id, call_id, icebreaker_id,
+    date_plan_id, status, is_read, delivered_at, read_at, recipient_seq, edited_at, deleted_at, created_at`
+
+// ErrDuplicateMessage is returned by CreateMessage when the sender already
+// stored a message with the same client ID.
+var ErrDuplicateMessage = errors.New("duplicate client message id")
+
 func New(dsn string) (*DB, error) {
     db, err := sqlx.Connect("postgres", dsn)
     if err != nil {
@@ -68,6 +83,159 @@ func (db *DB) UpdateUser(user *models.User) error {
     return err
 }
 
+// Presence methods
+
+// ConnectUser records that replicaID holds a connection for the user and
+// marks them online. It reports whether they were offline before, counting
+// a user whose last heartbeat is older than timeout as offline.
+func (db *DB) ConnectUser(userID, replicaID uuid.UUID, timeout time.Duration) (bool, error) {
+    tx, err := db.Beginx()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    // Locking the user serializes this with disconnects on other replicas.
+    var wasOnline bool
+    query := `
+        SELECT is_online AND last_active > NOW() - $2 * INTERVAL '1 second'
+        FROM users WHERE id = $1
+        FOR UPDATE
+    `
+    if err := tx.Get(&wasOnline, query, userID, timeout.Seconds()); err != nil {
+        return false, err
+    }
+
+    _, err = tx.Exec(`
+        INSERT INTO user_connections (user_id, replica_id) VALUES ($1, $2)
+        ON CONFLICT (user_id, replica_id) DO UPDATE SET last_seen = NOW()
+    `, userID, replicaID)
+    if err != nil {
+        return false, err
+    }
+    if _, err := tx.Exec(`UPDATE users SET is_online = TRUE, last_active = NOW() WHERE id = $1`, userID); err != nil {
+        return false, err
+    }
+
+    return !wasOnline, tx.Commit()
+}
+
+// DisconnectUser records that replicaID no longer holds a connection for
+// the user. If no other replica has heartbeated a connection for them
+// within timeout, they are marked offline and it reports true.
+func (db *DB) DisconnectUser(userID, replicaID uuid.UUID, timeout time.Duration) (bool, error) {
+    tx, err := db.Beginx()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec(`SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+        return false, err
+    }
+    _, err = tx.Exec(`DELETE FROM user_connections WHERE user_id = $1 AND replica_id = $2`, userID, replicaID)
+    if err != nil {
+        return false, err
+    }
+
+    var connected bool
+    query := `
+        SELECT EXISTS (
+            SELECT 1 FROM user_connections
+            WHERE user_id = $1 AND last_seen > NOW() - $2 * INTERVAL '1 second'
+        )
+    `
+    if err := tx.Get(&connected, query, userID, timeout.Seconds()); err != nil {
+        return false, err
+    }
+    if connected {
+        return false, tx.Commit()
+    }
+
+    if _, err := tx.Exec(`UPDATE users SET is_online = FALSE, last_active = NOW() WHERE id = $1`, userID); err != nil {
+        return false, err
+    }
+    return true, tx.Commit()
+}
+
+// TouchConnectedUsers refreshes replicaID's connections for userIDs and
+// their users' last_active, and returns the users it turned from offline
+// to online. Connections that were closed meanwhile are not brought back.
+// Rows no replica has refreshed within timeout are deleted.
+func (db *DB) TouchConnectedUsers(replicaID uuid.UUID, userIDs []uuid.UUID, timeout time.Duration) ([]uuid.UUID, error) {
+    _, err := db.Exec(`DELETE FROM user_connections WHERE last_seen < NOW() - $1 * INTERVAL '1 second'`, timeout.Seconds())
+    if err != nil {
+        return nil, err
+    }
+
+    // Users are locked first, in ID order, like ConnectUser and
+    // DisconnectUser lock them, so replicas cannot deadlock.
+    var cameOnline []uuid.UUID
+    query := `
+        WITH before AS (
+            SELECT id, is_online AND last_active > NOW() - $3 * INTERVAL '1 second' AS was_online
+            FROM users
+            WHERE id = ANY($2)
+              AND id IN (SELECT user_id FROM user_connections WHERE replica_id = $1)
+            ORDER BY id
+            FOR UPDATE
+        ), touched AS (
+            UPDATE user_connections SET last_seen = NOW()
+            WHERE replica_id = $1 AND user_id IN (SELECT id FROM before)
+            RETURNING user_id
+        ), updated AS (
+            UPDATE users u SET is_online = TRUE, last_active = NOW()
+            FROM before b
+            WHERE u.id = b.id AND u.id IN (SELECT user_id FROM touched)
+            RETURNING u.id, b.was_online
+        )
+        SELECT id FROM updated WHERE NOT was_online
+    `
+    err = db.Select(&cameOnline, query, replicaID, pq.Array(userIDs), timeout.Seconds())
+    return cameOnline, err
+}
+
+func (db *DB) SetHideOnlineStatus(userID uuid.UUID, hide bool) error {
+    query := `UPDATE users SET hide_online_status = $2, updated_at = NOW() WHERE id = $1`
+    _, err := db.Exec(query, userID, hide)
+    return err
+}
+
+// GetMatchPresence returns the presence of viewerID's active matches, or
+// only of those in userIDs when it is not nil. A user counts as online
+// while their last heartbeat is younger than timeout.
+func (db *DB) GetMatchPresence(viewerID uuid.UUID, userIDs []uuid.UUID, timeout time.Duration) ([]models.Presence, error) {
+    var presence []models.Presence
+    query := `
+        SELECT u.id AS user_id,
+               (u.is_online AND u.last_active > NOW() - $3 * INTERVAL '1 second' AND NOT u.hide_online_status) AS online,
+               CASE WHEN u.hide_online_status THEN NULL ELSE u.last_active END AS last_seen
+        FROM matches m
+        JOIN users u ON u.id = CASE WHEN m.user1_id = $1 THEN m.user2_id ELSE m.user1_id END
+        WHERE (m.user1_id = $1 OR m.user2_id = $1) AND m.is_active = true
+          AND ($2::uuid[] IS NULL OR u.id = ANY($2))
+    `
+    var ids interface{}
+    if userIDs != nil {
+        ids = pq.Array(userIDs)
+    }
+    err := db.Select(&presence, query, viewerID, ids, timeout.Seconds())
+    return presence, err
+}
+
+// GetMatchPartnerIDs returns the other member of each of the user's active
+// matches.
+func (db *DB) GetMatchPartnerIDs(userID uuid.UUID) ([]uuid.UUID, error) {
+    var ids []uuid.UUID
+    query := `
+        SELECT CASE WHEN user1_id = $1 THEN user2_id ELSE user1_id END
+        FROM matches
+        WHERE (user1_id = $1 OR user2_id = $1) AND is_active = true
+    `
+    err := db.Select(&ids, query, userID)
+    return ids, err
+}
+
 // Profile methods
 func (db *DB) GetProfile(userID uuid.UUID) (*models.Profile, error) {
     var profile models.Profile
@@ -157,51 +325,1233 @@ func (db *DB) CreateMatch(match *models.Match) error {
     }
     
     query := `
-        INSERT INTO matches (id, user1_id, user2_id, matched_at)
-        VALUES (:id, :user1_id, :user2_id, :matched_at)
+        INSERT INTO matches (id, user1_id, user2_id, matched_at, expires_at)
+        VALUES (:id, :user1_id, :user2_id, :matched_at, :expires_at)
     `
     _, err := db.NamedExec(query, match)
     return err
 }
 
 // Match methods
-func (db *DB) GetUserMatches(userID uuid.UUID) ([]models.Match, error) {
+
+// matchSummaryQuery selects the active matches of user $1 as rows of the
+// matches screen: the other member's profile, the latest message, the
+// unread count and the user's conversation settings, in one query.
+const matchSummaryQuery = `
+    SELECT m.id, m.matched_at, m.is_active,
+           p.user_id AS "other_user.user_id", p.display_name AS "other_user.display_name",
+           p.bio AS "other_user.bio", p.age AS "other_user.age", p.gender AS "other_user.gender",
+           p.interested_in AS "other_user.interested_in",
+           p.location_city AS "other_user.location_city", p.location_country AS "other_user.location_country",
+           p.latitude AS "other_user.latitude", p.longitude AS "other_user.longitude",
+           p.avatar_url AS "other_user.avatar_url", p.is_verified AS "other_user.is_verified",
+           p.is_premium AS "other_user.is_premium",
+           p.created_at AS "other_user.created_at", p.updated_at AS "other_user.updated_at",
+           COALESCE(lm.message, '') AS last_message,
+           lm.message_type AS last_message_type,
+           lm.sender_id AS last_message_sender_id,
+           lm.created_at AS last_message_at,
+           unread.count AS unread_count,
+           COALESCE(s.muted, FALSE) AS muted,
+           s.pinned_at IS NOT NULL AS pinned,
+           COALESCE(s.archived_at >= COALESCE(lm.created_at, m.matched_at), FALSE) AS archived,
+           COALESCE(lm.created_at, m.matched_at) AS last_activity_at,
+           CASE WHEN lm.created_at IS NULL THEN m.expires_at END AS expires_at,
+           m.extended_at IS NOT NULL AS extended
+    FROM matches m
+    JOIN profiles p ON p.user_id = CASE WHEN m.user1_id = $1 THEN m.user2_id ELSE m.user1_id END
+    LEFT JOIN match_settings s ON s.match_id = m.id AND s.user_id = $1
+    LEFT JOIN LATERAL (
+        SELECT message, message_type, sender_id, created_at FROM messages
+        WHERE match_id = m.id
+        ORDER BY created_at DESC
+        LIMIT 1
+    ) lm ON TRUE
+    CROSS JOIN LATERAL (
+        SELECT COUNT(*) AS count FROM messages
+        WHERE match_id = m.id AND sender_id != $1 AND is_read = FALSE AND deleted_at IS NULL
+    ) unread
+    WHERE (m.user1_id = $1 OR m.user2_id = $1) AND m.is_active = true
+`
+
+// Match list filters for MatchFilter.Filter.
+const (
+    MatchFilterNew      = "new"       // no messages yet
+    MatchFilterYourTurn = "your_turn" // the latest message is from the other member
+    MatchFilterUnread   = "unread"    // has unread messages
+)
+
+var (
+    ErrInvalidMatchFilter = errors.New("filter must be new, your_turn or unread")
+    ErrInvalidCursor      = errors.New("invalid cursor")
+)
+
+// MatchFilter selects and pages the matches listed by GetUserMatches.
+// Query is matched against the other member's display name, and After is
+// the NextCursor of the previous page.
+type MatchFilter struct {
+    Archived bool
+    Filter   string
+    Query    string
+    After    *MatchCursor
+    Limit    int
+}
+
+// MatchCursor is the position of a match in the list order: pinned first,
+// then latest activity, then ID. A match that gets a new message moves to
+// the top, so it may be skipped by pages already past it.
+type MatchCursor struct {
+    Pinned         bool
+    LastActivityAt time.Time
+    ID             uuid.UUID
+}
+
+// String encodes the cursor as an opaque token for clients.
+func (c MatchCursor) String() string {
+    pinned := "0"
+    if c.Pinned {
+        pinned = "1"
+    }
+    raw := pinned + "|" + strconv.FormatInt(c.LastActivityAt.UnixMicro(), 10) + "|" + c.ID.String()
+    return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseMatchCursor decodes a token produced by MatchCursor.String.
+func ParseMatchCursor(token string) (*MatchCursor, error) {
+    raw, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    parts := strings.Split(string(raw), "|")
+    if len(parts) != 3 || (parts[0] != "0" && parts[0] != "1") {
+        return nil, ErrInvalidCursor
+    }
+    micros, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    id, err := uuid.Parse(parts[2])
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    return &MatchCursor{Pinned: parts[0] == "1", LastActivityAt: time.UnixMicro(micros).UTC(), ID: id}, nil
+}
+
+// GetUserMatches returns a page of the user's active matches, pinned first
+// and then by latest activity, and the cursor of the next page if there is
+// one. Archived matches are listed when filter.Archived is set and left
+// out otherwise.
+func (db *DB) GetUserMatches(userID uuid.UUID, filter MatchFilter) ([]models.MatchSummary, *MatchCursor, error) {
+    conditions := []string{"archived = $2"}
+    args := []interface{}{userID, filter.Archived}
+
+    switch filter.Filter {
+    case "":
+    case MatchFilterNew:
+        conditions = append(conditions, "last_message_at IS NULL")
+    case MatchFilterYourTurn:
+        conditions = append(conditions, "last_message_sender_id != $1")
+    case MatchFilterUnread:
+        conditions = append(conditions, "unread_count > 0")
+    default:
+        return nil, nil, ErrInvalidMatchFilter
+    }
+
+    if filter.Query != "" {
+        args = append(args, "%"+escapeLike(filter.Query)+"%")
+        conditions = append(conditions, fmt.Sprintf(`"other_user.display_name" ILIKE $%d`, len(args)))
+    }
+
+    if after := filter.After; after != nil {
+        args = append(args, after.Pinned, after.LastActivityAt, after.ID)
+        n := len(args)
+        conditions = append(conditions, fmt.Sprintf(
+            `(pinned < $%d OR (pinned = $%d AND (last_activity_at < $%d OR (last_activity_at = $%d AND id > $%d))))`,
+            n-2, n-2, n-1, n-1, n))
+    }
+
+    // One extra row tells whether there is a next page.
+    args = append(args, filter.Limit+1)
+    query := `
+        SELECT * FROM (` + matchSummaryQuery + `) matches
+        WHERE ` + strings.Join(conditions, " AND ") + `
+        ORDER BY pinned DESC, last_activity_at DESC, id
+        LIMIT $` + strconv.Itoa(len(args))
+
+    var matches []models.MatchSummary
+    if err := db.Select(&matches, query, args...); err != nil {
+        return nil, nil, err
+    }
+
+    var next *MatchCursor
+    if len(matches) > filter.Limit {
+        matches = matches[:filter.Limit]
+        last := matches[len(matches)-1]
+        next = &MatchCursor{Pinned: last.Pinned, LastActivityAt: last.LastActivityAt, ID: last.ID}
+    }
+
+    return matches, next, db.loadOtherUserPhotos(matches)
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// GetMatchSummary returns one of the user's active matches as listed by
+// GetUserMatches.
+func (db *DB) GetMatchSummary(matchID, userID uuid.UUID) (*models.MatchSummary, error) {
+    var match models.MatchSummary
+    query := `SELECT * FROM (` + matchSummaryQuery + `) matches WHERE id = $2`
+    if err := db.Get(&match, query, userID, matchID); err != nil {
+        return nil, err
+    }
+    matches := []models.MatchSummary{match}
+    if err := db.loadOtherUserPhotos(matches); err != nil {
+        return nil, err
+    }
+    return &matches[0], nil
+}
+
+// loadOtherUserPhotos sets OtherUser.Photos on every match with one query.
+func (db *DB) loadOtherUserPhotos(matches []models.MatchSummary) error {
+    if len(matches) == 0 {
+        return nil
+    }
+
+    userIDs := make([]uuid.UUID, len(matches))
+    for i, match := range matches {
+        userIDs[i] = match.OtherUser.UserID
+    }
+
+    var photos []models.Photo
+    query := `SELECT * FROM photos WHERE user_id = ANY($1) ORDER BY display_order`
+    if err := db.Select(&photos, query, pq.Array(userIDs)); err != nil {
+        return err
+    }
+
+    byUser := make(map[uuid.UUID][]models.Photo)
+    for _, photo := range photos {
+        byUser[photo.UserID] = append(byUser[photo.UserID], photo)
+    }
+    for i := range matches {
+        matches[i].OtherUser.Photos = byUser[matches[i].OtherUser.UserID]
+    }
+    return nil
+}
+
+// IsMatchMuted reports whether the user muted notifications for the match.
+func (db *DB) IsMatchMuted(matchID, userID uuid.UUID) (bool, error) {
+    var muted bool
+    query := `SELECT EXISTS (SELECT 1 FROM match_settings WHERE match_id = $1 AND user_id = $2 AND muted)`
+    err := db.Get(&muted, query, matchID, userID)
+    return muted, err
+}
+
+// SetMatchFlag turns one of the user's conversation flags for a match,
+// "muted", "archived" or "pinned", on or off.
+func (db *DB) SetMatchFlag(matchID, userID uuid.UUID, flag string, on bool) error {
+    var column, value string
+    switch flag {
+    case "muted":
+        column, value = "muted", "$3"
+    case "archived":
+        column, value = "archived_at", "CASE WHEN $3 THEN NOW() END"
+    case "pinned":
+        column, value = "pinned_at", "CASE WHEN $3 THEN NOW() END"
+    default:
+        return fmt.Errorf("unknown match flag %q", flag)
+    }
+
+    query := fmt.Sprintf(`
+        INSERT INTO match_settings (match_id, user_id, %[1]s)
+        VALUES ($1, $2, %[2]s)
+        ON CONFLICT (match_id, user_id) DO UPDATE SET %[1]s = EXCLUDED.%[1]s, updated_at = NOW()
+    `, column, value)
+    _, err := db.Exec(query, matchID, userID, on)
+    return err
+}
+
+// GetUserMatch returns the active match with the given ID if userID is one
+// of its members.
+func (db *DB) GetUserMatch(matchID, userID uuid.UUID) (*models.Match, error) {
+    var match models.Match
+    query := `
+        SELECT * FROM matches
+        WHERE id = $1 AND (user1_id = $2 OR user2_id = $2) AND is_active = true
+    `
+    err := db.Get(&match, query, matchID, userID)
+    if err != nil {
+        return nil, err
+    }
+    return &match, nil
+}
+
+// Match expiry methods
+
+var ErrNotExtendable = errors.New("match cannot be extended")
+
+// unmessaged restricts an UPDATE of matches m to matches nobody has sent a
+// message in yet.
+const unmessaged = `NOT EXISTS (SELECT 1 FROM messages WHERE match_id = m.id)`
+
+// WarnExpiringMatches returns the active, unmessaged matches that expire
+// within warning and marks them as warned, so each is returned once even
+// with several replicas sweeping.
+func (db *DB) WarnExpiringMatches(warning time.Duration) ([]models.Match, error) {
     var matches []models.Match
     query := `
-        SELECT m.*, 
-               p1.display_name as user1_display_name, p1.avatar_url as user1_avatar,
-               p2.display_name as user2_display_name, p2.avatar_url as user2_avatar
-        FROM matches m
-        JOIN profiles p1 ON m.user1_id = p1.user_id
-        JOIN profiles p2 ON m.user2_id = p2.user_id
-        WHERE (m.user1_id = $1 OR m.user2_id = $1) AND m.is_active = true
-        ORDER BY m.matched_at DESC
+        UPDATE matches m SET expiry_warned_at = NOW()
+        WHERE m.is_active = true AND m.expiry_warned_at IS NULL
+          AND m.expires_at <= NOW() + $1 * INTERVAL '1 second'
+          AND ` + unmessaged + `
+        RETURNING m.*
+    `
+    err := db.Select(&matches, query, warning.Seconds())
+    return matches, err
+}
+
+// ExpireMatches deactivates the active, unmessaged matches past their
+// expiry, deletes their members' notes on them and returns them.
+func (db *DB) ExpireMatches() ([]models.Match, error) {
+    var matches []models.Match
+    query := `
+        WITH expired AS (
+            UPDATE matches m SET is_active = FALSE
+            WHERE m.is_active = true AND m.expires_at <= NOW()
+              AND ` + unmessaged + `
+            RETURNING m.*
+        ), notes AS (
+            DELETE FROM match_notes WHERE match_id IN (SELECT id FROM expired)
+        )
+        SELECT * FROM expired
     `
-    err := db.Select(&matches, query, userID)
+    err := db.Select(&matches, query)
     return matches, err
 }
 
+// ExtendMatch gives an active, unmessaged match its expiry window again,
+// counted from its current expiry. A match can only be extended once;
+// ErrNotExtendable is returned if it has been already, has no expiry or
+// already has a message.
+func (db *DB) ExtendMatch(matchID uuid.UUID) (*models.Match, error) {
+    var match models.Match
+    query := `
+        UPDATE matches m
+        SET expires_at = m.expires_at + (m.expires_at - m.matched_at), extended_at = NOW(), expiry_warned_at = NULL
+        WHERE m.id = $1 AND m.is_active = true AND m.extended_at IS NULL
+          AND m.expires_at > NOW()
+          AND ` + unmessaged + `
+        RETURNING m.*
+    `
+    err := db.Get(&match, query, matchID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrNotExtendable
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &match, nil
+}
+
 // Message methods
 func (db *DB) GetMatchMessages(matchID uuid.UUID) ([]models.Message, error) {
     var messages []models.Message
     query := `
-        SELECT * FROM messages 
-        WHERE match_id = $1 
+        SELECT ` + messageColumns + ` FROM messages
+        WHERE match_id = $1
         ORDER BY created_at ASC
     `
     err := db.Select(&messages, query, matchID)
+    if err != nil {
+        return messages, err
+    }
+    
+    err = db.LoadMessageReactions(messages)
     return messages, err
 }
 
-func (db *DB) CreateMessage(message *models.Message) error {
+// GetMatchMessageEdits returns the previous versions of every edited or
+// unsent message in a match, oldest first.
+func (db *DB) GetMatchMessageEdits(matchID uuid.UUID) ([]models.MessageEdit, error) {
+    var edits []models.MessageEdit
+    query := `
+        SELECT e.id, e.message_id, e.action, e.previous_message, e.attachment_id, e.created_at
+        FROM message_edits e
+        JOIN messages m ON m.id = e.message_id
+        WHERE m.match_id = $1
+        ORDER BY e.created_at ASC
+    `
+    err := db.Select(&edits, query, matchID)
+    return edits, err
+}
+
+// TxStep is a write that has to commit or fail together with a message,
+// such as the date plan change the message records.
+type TxStep func(tx *sqlx.Tx) error
+
+// CreateMessage stores a message with recipientID's next event sequence
+// number as its RecipientSeq. Both happen in one transaction, so a retry
+// rejected as a duplicate does not use up a sequence number. steps run
+// first in the same transaction; if one fails, nothing is stored.
+func (db *DB) CreateMessage(message *models.Message, recipientID uuid.UUID, steps ...TxStep) error {
+    tx, err := db.Beginx()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, step := range steps {
+        if err := step(tx); err != nil {
+            return err
+        }
+    }
+
+    var seq int64
+    if err := tx.Get(&seq, nextEventSeqQuery, recipientID); err != nil {
+        return err
+    }
+    message.RecipientSeq = &seq
+
+    query := `
+        INSERT INTO messages (id, match_id, sender_id, message, message_type, attachment_id, call_id, icebreaker_id, date_plan_id, recipient_seq, client_id)
+        VALUES (:id, :match_id, :sender_id, :message, :message_type, :attachment_id, :call_id, :icebreaker_id, :date_plan_id, :recipient_seq, :client_id)
+        ON CONFLICT (sender_id, client_id) WHERE client_id IS NOT NULL DO NOTHING
+    `
+    result, err := tx.NamedExec(query, message)
+    if err != nil {
+        message.RecipientSeq = nil
+        return err
+    }
+
+    rows, err := result.RowsAffected()
+    if err != nil {
+        message.RecipientSeq = nil
+        return err
+    }
+    if rows == 0 {
+        message.RecipientSeq = nil
+        return ErrDuplicateMessage
+    }
+    if err := tx.Commit(); err != nil {
+        message.RecipientSeq = nil
+        return err
+    }
+    return nil
+}
+
+func (db *DB) GetMessage(id uuid.UUID) (*models.Message, error) {
+    var message models.Message
+    query := `SELECT ` + messageColumns + ` FROM messages WHERE id = $1`
+    err := db.Get(&message, query, id)
+    if err != nil {
+        return nil, err
+    }
+    return &message, nil
+}
+
+// EditMessage records the current text in the edit history and replaces
+// it, updating message in place.
+func (db *DB) EditMessage(message *models.Message, text string) error {
+    tx, err := db.Beginx()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    _, err = tx.Exec(`
+        INSERT INTO message_edits (message_id, action, previous_message, attachment_id)
+        VALUES ($1, 'edit', $2, $3)
+    `, message.ID, message.Message, message.AttachmentID)
+    if err != nil {
+        return err
+    }
+    
+    var editedAt time.Time
+    err = tx.Get(&editedAt, `
+        UPDATE messages SET message = $2, edited_at = NOW()
+        WHERE id = $1 AND deleted_at IS NULL
+        RETURNING edited_at
+    `, message.ID, text)
+    if err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    message.Message = text
+    message.EditedAt = &editedAt
+    return nil
+}
+
+// DeleteMessage turns a message into a tombstone: its content moves to the
+// edit history and the row keeps only its metadata. message is updated in
+// place.
+func (db *DB) DeleteMessage(message *models.Message) error {
+    tx, err := db.Beginx()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    _, err = tx.Exec(`
+        INSERT INTO message_edits (message_id, action, previous_message, attachment_id)
+        VALUES ($1, 'delete', $2, $3)
+    `, message.ID, message.Message, message.AttachmentID)
+    if err != nil {
+        return err
+    }
+    
+    var deletedAt time.Time
+    err = tx.Get(&deletedAt, `
+        UPDATE messages SET message = '', attachment_id = NULL, deleted_at = NOW()
+        WHERE id = $1 AND deleted_at IS NULL
+        RETURNING deleted_at
+    `, message.ID)
+    if err != nil {
+        return err
+    }
+    
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    message.Message = ""
+    message.AttachmentID = nil
+    message.Attachment = nil
+    message.DeletedAt = &deletedAt
+    return nil
+}
+
+// GetMessageByClientID returns the message senderID sent in a match under
+// a client ID.
+func (db *DB) GetMessageByClientID(matchID, senderID uuid.UUID, clientID string) (*models.Message, error) {
+    var message models.Message
+    query := `SELECT ` + messageColumns + ` FROM messages WHERE match_id = $1 AND sender_id = $2 AND client_id = $3`
+    err := db.Get(&message, query, matchID, senderID, clientID)
+    if err != nil {
+        return nil, err
+    }
+    return &message, nil
+}
+
+// MarkMessagesDelivered moves every message the partner sent in the match,
+// up to and including upToID, from sent to delivered. It returns the IDs
+// that changed.
+func (db *DB) MarkMessagesDelivered(matchID, recipientID, upToID uuid.UUID) ([]uuid.UUID, error) {
+    var ids []uuid.UUID
+    query := `
+        UPDATE messages SET status = 'delivered', delivered_at = NOW()
+        WHERE match_id = $1 AND sender_id != $2 AND status = 'sent'
+        AND created_at <= (SELECT created_at FROM messages WHERE id = $3 AND match_id = $1)
+        RETURNING id
+    `
+    err := db.Select(&ids, query, matchID, recipientID, upToID)
+    return ids, err
+}
+
+// MarkMessagesRead marks every message the partner sent in the match, up to
+// and including upToID, as read. It returns the IDs that changed.
+func (db *DB) MarkMessagesRead(matchID, recipientID, upToID uuid.UUID) ([]uuid.UUID, error) {
+    var ids []uuid.UUID
+    query := `
+        UPDATE messages SET status = 'read', is_read = TRUE,
+               delivered_at = COALESCE(delivered_at, NOW()), read_at = NOW()
+        WHERE match_id = $1 AND sender_id != $2 AND status IN ('sent', 'delivered')
+        AND created_at <= (SELECT created_at FROM messages WHERE id = $3 AND match_id = $1)
+        RETURNING id
+    `
+    err := db.Select(&ids, query, matchID, recipientID, upToID)
+    return ids, err
+}
+
+// GetMessagesForRecipientSince returns messages sent to userID whose
+// realtime sequence number is greater than afterSeq, oldest first.
+func (db *DB) GetMessagesForRecipientSince(userID uuid.UUID, afterSeq int64, limit int) ([]models.Message, error) {
+    var messages []models.Message
+    query := `
+        SELECT ` + messageColumns + ` FROM messages
+        WHERE match_id IN (SELECT id FROM matches WHERE user1_id = $1 OR user2_id = $1)
+        AND sender_id != $1
+        AND recipient_seq > $2
+        ORDER BY recipient_seq ASC
+        LIMIT $3
+    `
+    err := db.Select(&messages, query, userID, afterSeq, limit)
+    return messages, err
+}
+
+// SearchMessages finds messages matching query, in web search syntax, in
+// the user's active matches. The best matches come first.
+func (db *DB) SearchMessages(userID uuid.UUID, query string, limit, offset int) ([]models.MessageSearchResult, error) {
+    var results []models.MessageSearchResult
+    // The message is HTML escaped before ts_headline adds <mark> tags, so
+    // the snippet is safe to render as HTML.
+    sqlQuery := `
+        SELECT m.id AS message_id, m.match_id, m.sender_id, m.created_at,
+               ts_headline('english',
+                   replace(replace(replace(m.message, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+                   q, 'StartSel=<mark>, StopSel=</mark>, MaxWords=20, MinWords=5, MaxFragments=2') AS snippet
+        FROM messages m
+        JOIN matches ma ON ma.id = m.match_id,
+             websearch_to_tsquery('english', $2) q
+        WHERE (ma.user1_id = $1 OR ma.user2_id = $1)
+          AND ma.is_active = TRUE
+          AND m.deleted_at IS NULL
+          AND m.search_vector @@ q
+        ORDER BY ts_rank(m.search_vector, q) DESC, m.created_at DESC
+        LIMIT $3 OFFSET $4
+    `
+    err := db.Select(&results, sqlQuery, userID, query, limit, offset)
+    return results, err
+}
+
+// Note methods
+
+func (db *DB) CreateMatchNote(note *models.MatchNote) error {
+    query := `
+        INSERT INTO match_notes (id, match_id, user_id, body)
+        VALUES ($1, $2, $3, $4)
+        RETURNING created_at, updated_at
+    `
+    return db.QueryRow(query, note.ID, note.MatchID, note.UserID, note.Body).Scan(&note.CreatedAt, &note.UpdatedAt)
+}
+
+// GetMatchNotes returns userID's notes on a match, oldest first.
+func (db *DB) GetMatchNotes(matchID, userID uuid.UUID) ([]models.MatchNote, error) {
+    notes := []models.MatchNote{}
+    query := `
+        SELECT * FROM match_notes
+        WHERE match_id = $1 AND user_id = $2
+        ORDER BY created_at
+    `
+    err := db.Select(&notes, query, matchID, userID)
+    return notes, err
+}
+
+// CountMatchNotes returns how many notes userID keeps on a match.
+func (db *DB) CountMatchNotes(matchID, userID uuid.UUID) (int, error) {
+    var count int
+    query := `SELECT COUNT(*) FROM match_notes WHERE match_id = $1 AND user_id = $2`
+    err := db.Get(&count, query, matchID, userID)
+    return count, err
+}
+
+// UpdateMatchNote replaces the body of one of userID's notes on a match.
+// It returns sql.ErrNoRows if there is no such note.
+func (db *DB) UpdateMatchNote(noteID, matchID, userID uuid.UUID, body string) (*models.MatchNote, error) {
+    var note models.MatchNote
+    query := `
+        UPDATE match_notes SET body = $4
+        WHERE id = $1 AND match_id = $2 AND user_id = $3
+        RETURNING *
+    `
+    if err := db.Get(&note, query, noteID, matchID, userID, body); err != nil {
+        return nil, err
+    }
+    return &note, nil
+}
+
+// DeleteMatchNote deletes one of userID's notes on a match. It returns
+// sql.ErrNoRows if there is no such note.
+func (db *DB) DeleteMatchNote(noteID, matchID, userID uuid.UUID) error {
+    query := `DELETE FROM match_notes WHERE id = $1 AND match_id = $2 AND user_id = $3`
+    result, err := db.Exec(query, noteID, matchID, userID)
+    if err != nil {
+        return err
+    }
+    
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rows == 0 {
+        return sql.ErrNoRows
+    }
+    return nil
+}
+
+// GetUserNotes returns every note userID keeps, on any match, for export.
+func (db *DB) GetUserNotes(userID uuid.UUID) ([]models.MatchNote, error) {
+    notes := []models.MatchNote{}
+    query := `SELECT * FROM match_notes WHERE user_id = $1 ORDER BY created_at`
+    err := db.Select(&notes, query, userID)
+    return notes, err
+}
+
+// Icebreaker methods
+
+// SetMatchIcebreakers stores the prompts suggested for a match, in order.
+// Prompts already stored for the match are kept.
+func (db *DB) SetMatchIcebreakers(matchID uuid.UUID, promptIDs []string) error {
+    query := `
+        INSERT INTO match_icebreakers (match_id, prompt_id, position)
+        SELECT $1, prompt_id, position
+        FROM unnest($2::varchar[]) WITH ORDINALITY AS p(prompt_id, position)
+        ON CONFLICT DO NOTHING
+    `
+    _, err := db.Exec(query, matchID, pq.Array(promptIDs))
+    return err
+}
+
+func (db *DB) GetMatchIcebreakers(matchID uuid.UUID) ([]string, error) {
+    var promptIDs []string
+    query := `SELECT prompt_id FROM match_icebreakers WHERE match_id = $1 ORDER BY position`
+    err := db.Select(&promptIDs, query, matchID)
+    return promptIDs, err
+}
+
+// Reaction methods
+func (db *DB) AddReaction(messageID, userID uuid.UUID, emoji string) error {
+    query := `
+        INSERT INTO message_reactions (message_id, user_id, emoji)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (message_id, user_id, emoji) DO NOTHING
+    `
+    _, err := db.Exec(query, messageID, userID, emoji)
+    return err
+}
+
+func (db *DB) RemoveReaction(messageID, userID uuid.UUID, emoji string) error {
+    query := `DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3`
+    _, err := db.Exec(query, messageID, userID, emoji)
+    return err
+}
+
+// GetReactions returns the aggregated reactions on each of the given
+// messages, in the order each emoji was first used.
+func (db *DB) GetReactions(messageIDs []uuid.UUID) ([]models.Reaction, error) {
+    var reactions []models.Reaction
+    query := `
+        SELECT message_id, emoji, COUNT(*) AS count, array_agg(user_id::text ORDER BY created_at) AS user_ids
+        FROM message_reactions
+        WHERE message_id = ANY($1)
+        GROUP BY message_id, emoji
+        ORDER BY message_id, MIN(created_at)
+    `
+    err := db.Select(&reactions, query, pq.Array(messageIDs))
+    return reactions, err
+}
+
+// LoadMessageReactions sets Reactions on every message that has any.
+func (db *DB) LoadMessageReactions(messages []models.Message) error {
+    if len(messages) == 0 {
+        return nil
+    }
+    
+    ids := make([]uuid.UUID, len(messages))
+    byID := make(map[uuid.UUID]*models.Message, len(messages))
+    for i := range messages {
+        ids[i] = messages[i].ID
+        byID[messages[i].ID] = &messages[i]
+    }
+    
+    reactions, err := db.GetReactions(ids)
+    if err != nil {
+        return err
+    }
+    for _, reaction := range reactions {
+        message := byID[reaction.MessageID]
+        message.Reactions = append(message.Reactions, reaction)
+    }
+    return nil
+}
+
+// Moderation methods
+func (db *DB) CreateMessageFlag(flag *models.MessageFlag) error {
+    query := `
+        INSERT INTO message_flags (id, message_id, sender_id, rules, original_message)
+        VALUES ($1, $2, $3, $4, $5)
+    `
+    _, err := db.Exec(query, flag.ID, flag.MessageID, flag.SenderID, flag.Rules, flag.OriginalMessage)
+    return err
+}
+
+// CreateReport stores a report. report's Status and CreatedAt are set from
+// the stored row.
+func (db *DB) CreateReport(report *models.Report) error {
+    // pq would send raw bytes as bytea; the column takes the JSON as text.
+    var transcript *string
+    if report.Transcript != nil {
+        text := string(*report.Transcript)
+        transcript = &text
+    }
+
+    query := `
+        INSERT INTO reports (id, reporter_id, reported_id, match_id, reason, description, transcript)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING status, created_at
+    `
+    return db.QueryRow(query, report.ID, report.ReporterID, report.ReportedID, report.MatchID,
+        report.Reason, report.Description, transcript).Scan(&report.Status, &report.CreatedAt)
+}
+
+// Date plan methods
+//
+// The methods that change a plan take the transaction of the message
+// recording the change; see CreateMessage.
+
+func (db *DB) CreateDatePlan(tx *sqlx.Tx, plan *models.DatePlan) error {
+    query := `
+        INSERT INTO date_plans (id, match_id, proposer_id, scheduled_at, place_name, latitude, longitude, counter_of)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING status, created_at
+    `
+    return tx.QueryRow(query, plan.ID, plan.MatchID, plan.ProposerID, plan.ScheduledAt, plan.PlaceName,
+        plan.Latitude, plan.Longitude, plan.CounterOf).Scan(&plan.Status, &plan.CreatedAt)
+}
+
+// RespondToDatePlan moves a proposed plan in a match to status on behalf of
+// responderID, who must not be its proposer. It returns sql.ErrNoRows if
+// there is no such plan waiting for responderID.
+func (db *DB) RespondToDatePlan(tx *sqlx.Tx, planID, matchID, responderID uuid.UUID, status string) (*models.DatePlan, error) {
+    var plan models.DatePlan
+    query := `
+        UPDATE date_plans SET status = $4, responded_at = NOW()
+        WHERE id = $1 AND match_id = $2 AND proposer_id != $3 AND status = 'proposed'
+        RETURNING *
+    `
+    if err := tx.Get(&plan, query, planID, matchID, responderID, status); err != nil {
+        return nil, err
+    }
+    return &plan, nil
+}
+
+// CounterDatePlan marks the plan counter answers as countered and stores
+// counter. It returns sql.ErrNoRows if that plan is not waiting for
+// counter's proposer.
+func (db *DB) CounterDatePlan(tx *sqlx.Tx, counter *models.DatePlan) error {
+    var countered uuid.UUID
+    err := tx.Get(&countered, `
+        UPDATE date_plans SET status = 'countered', responded_at = NOW()
+        WHERE id = $1 AND match_id = $2 AND proposer_id != $3 AND status = 'proposed'
+        RETURNING id
+    `, counter.CounterOf, counter.MatchID, counter.ProposerID)
+    if err != nil {
+        return err
+    }
+    
+    return db.CreateDatePlan(tx, counter)
+}
+
+// GetMatchDatePlans returns every plan made in a match, newest first.
+func (db *DB) GetMatchDatePlans(matchID uuid.UUID) ([]models.DatePlan, error) {
+    plans := []models.DatePlan{}
+    query := `SELECT * FROM date_plans WHERE match_id = $1 ORDER BY created_at DESC`
+    err := db.Select(&plans, query, matchID)
+    return plans, err
+}
+
+// GetUpcomingDates returns userID's accepted dates that have not happened
+// yet, in active matches, soonest first.
+func (db *DB) GetUpcomingDates(userID uuid.UUID) ([]models.UpcomingDate, error) {
+    dates := []models.UpcomingDate{}
+    query := `
+        SELECT d.*, p.user_id AS other_user_id, p.display_name AS other_user_name,
+               p.avatar_url AS other_user_avatar_url
+        FROM date_plans d
+        JOIN matches m ON m.id = d.match_id
+        JOIN profiles p ON p.user_id = CASE WHEN m.user1_id = $1 THEN m.user2_id ELSE m.user1_id END
+        WHERE (m.user1_id = $1 OR m.user2_id = $1) AND m.is_active = true
+          AND d.status = 'accepted' AND d.scheduled_at >= NOW()
+        ORDER BY d.scheduled_at
+    `
+    err := db.Select(&dates, query, userID)
+    return dates, err
+}
+
+// DueDateReminders returns the accepted plans in active matches starting
+// within lead that have not been reminded of yet, and marks them, so each
+// is returned once even with several replicas running reminders.
+func (db *DB) DueDateReminders(lead time.Duration) ([]models.DatePlan, error) {
+    var plans []models.DatePlan
+    query := `
+        UPDATE date_plans d SET reminded_at = NOW()
+        FROM matches m
+        WHERE m.id = d.match_id AND m.is_active = true
+          AND d.status = 'accepted' AND d.reminded_at IS NULL
+          AND d.scheduled_at > NOW() AND d.scheduled_at <= NOW() + $1 * INTERVAL '1 second'
+        RETURNING d.*
+    `
+    err := db.Select(&plans, query, lead.Seconds())
+    return plans, err
+}
+
+// Safety check-in methods
+
+func (db *DB) GetDatePlan(id uuid.UUID) (*models.DatePlan, error) {
+    var plan models.DatePlan
+    query := `SELECT * FROM date_plans WHERE id = $1`
+    if err := db.Get(&plan, query, id); err != nil {
+        return nil, err
+    }
+    return &plan, nil
+}
+
+// ScheduleCheckIn stores a check-in, replacing the one the user already
+// had for the same date. checkIn's ID, Status and CreatedAt are set from
+// the stored row.
+func (db *DB) ScheduleCheckIn(checkIn *models.SafetyCheckIn) error {
+    query := `
+        INSERT INTO safety_checkins (id, date_plan_id, user_id, contact_name, contact_email, contact_phone, share_details, check_in_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (date_plan_id, user_id) DO UPDATE SET
+            contact_name = EXCLUDED.contact_name, contact_email = EXCLUDED.contact_email,
+            contact_phone = EXCLUDED.contact_phone, share_details = EXCLUDED.share_details,
+            check_in_at = EXCLUDED.check_in_at, status = 'scheduled',
+            prompted_at = NULL, confirmed_at = NULL, alerted_at = NULL
+        RETURNING id, status, created_at
+    `
+    return db.QueryRow(query, checkIn.ID, checkIn.DatePlanID, checkIn.UserID, checkIn.ContactName,
+        checkIn.ContactEmail, checkIn.ContactPhone, checkIn.ShareDetails, checkIn.CheckInAt,
+    ).Scan(&checkIn.ID, &checkIn.Status, &checkIn.CreatedAt)
+}
+
+// GetUserCheckIns returns userID's scheduled check-ins, soonest first.
+func (db *DB) GetUserCheckIns(userID uuid.UUID) ([]models.SafetyCheckIn, error) {
+    checkIns := []models.SafetyCheckIn{}
+    query := `
+        SELECT * FROM safety_checkins
+        WHERE user_id = $1 AND status = 'scheduled'
+        ORDER BY check_in_at
+    `
+    err := db.Select(&checkIns, query, userID)
+    return checkIns, err
+}
+
+// ConfirmCheckIn records that userID is OK. A check-in whose contact has
+// already been alerted can still be confirmed; its AlertedAt stays set. It
+// returns sql.ErrNoRows if there is no such open check-in.
+func (db *DB) ConfirmCheckIn(id, userID uuid.UUID) (*models.SafetyCheckIn, error) {
+    var checkIn models.SafetyCheckIn
+    query := `
+        UPDATE safety_checkins SET status = 'confirmed', confirmed_at = NOW()
+        WHERE id = $1 AND user_id = $2 AND status IN ('scheduled', 'alerted')
+        RETURNING *
+    `
+    if err := db.Get(&checkIn, query, id, userID); err != nil {
+        return nil, err
+    }
+    return &checkIn, nil
+}
+
+// CancelCheckIn cancels a scheduled check-in. It returns sql.ErrNoRows if
+// there is no such scheduled check-in.
+func (db *DB) CancelCheckIn(id, userID uuid.UUID) error {
+    query := `
+        UPDATE safety_checkins SET status = 'cancelled'
+        WHERE id = $1 AND user_id = $2 AND status = 'scheduled'
+    `
+    result, err := db.Exec(query, id, userID)
+    if err != nil {
+        return err
+    }
+    
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rows == 0 {
+        return sql.ErrNoRows
+    }
+    return nil
+}
+
+// DueCheckInPrompts returns the scheduled check-ins whose time has come
+// and marks them as prompted, so each is returned once.
+func (db *DB) DueCheckInPrompts() ([]models.SafetyCheckIn, error) {
+    var checkIns []models.SafetyCheckIn
+    query := `
+        UPDATE safety_checkins SET prompted_at = NOW()
+        WHERE status = 'scheduled' AND prompted_at IS NULL AND check_in_at <= NOW()
+        RETURNING *
+    `
+    err := db.Select(&checkIns, query)
+    return checkIns, err
+}
+
+// ClaimOverdueCheckIns marks the scheduled check-ins not confirmed within
+// grace of their time as alerted and returns them, so each contact is
+// alerted once even with several replicas sweeping.
+func (db *DB) ClaimOverdueCheckIns(grace time.Duration) ([]models.SafetyCheckIn, error) {
+    var checkIns []models.SafetyCheckIn
+    query := `
+        UPDATE safety_checkins SET status = 'alerted', alerted_at = NOW()
+        WHERE status = 'scheduled' AND check_in_at <= NOW() - $1 * INTERVAL '1 second'
+        RETURNING *
+    `
+    err := db.Select(&checkIns, query, grace.Seconds())
+    return checkIns, err
+}
+
+// ReleaseCheckInAlert puts a claimed check-in back to scheduled after its
+// alert could not be sent, so the next sweep retries it.
+func (db *DB) ReleaseCheckInAlert(id uuid.UUID) error {
+    query := `
+        UPDATE safety_checkins SET status = 'scheduled', alerted_at = NULL
+        WHERE id = $1 AND status = 'alerted'
+    `
+    _, err := db.Exec(query, id)
+    return err
+}
+
+var ErrShareLimitReached = errors.New("too many check-in shares")
+
+// ClaimCheckInShare records that userID is sharing a date's details with
+// the contact given by email and phone. It reports false, recording
+// nothing, if they have already been shared with that contact for the
+// date, and returns ErrShareLimitReached if userID has shared limit times
+// within window.
+func (db *DB) ClaimCheckInShare(id, planID, userID uuid.UUID, email, phone *string, limit int, window time.Duration) (bool, error) {
+    tx, err := db.Beginx()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    // Serialises a user's claims so the limit holds for concurrent requests.
+    if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtextextended('checkin-share:' || $1::text, 0))`, userID); err != nil {
+        return false, err
+    }
+
+    var shared bool
     query := `
-        INSERT INTO messages (id, match_id, sender_id, message, message_type)
-        VALUES (:id, :match_id, :sender_id, :message, :message_type)
+        SELECT EXISTS (
+            SELECT 1 FROM checkin_shares
+            WHERE date_plan_id = $1 AND user_id = $2
+              AND contact_email IS NOT DISTINCT FROM $3 AND contact_phone IS NOT DISTINCT FROM $4
+        )
+    `
+    if err := tx.Get(&shared, query, planID, userID, email, phone); err != nil {
+        return false, err
+    }
+    if shared {
+        return false, nil
+    }
+
+    var recent int
+    query = `SELECT COUNT(*) FROM checkin_shares WHERE user_id = $1 AND shared_at > NOW() - $2 * INTERVAL '1 second'`
+    if err := tx.Get(&recent, query, userID, window.Seconds()); err != nil {
+        return false, err
+    }
+    if recent >= limit {
+        return false, ErrShareLimitReached
+    }
+
+    query = `
+        INSERT INTO checkin_shares (id, date_plan_id, user_id, contact_email, contact_phone)
+        VALUES ($1, $2, $3, $4, $5)
     `
-    _, err := db.NamedExec(query, message)
+    if _, err := tx.Exec(query, id, planID, userID, email, phone); err != nil {
+        return false, err
+    }
+    return true, tx.Commit()
+}
+
+// ReleaseCheckInShare forgets a claimed share that could not be sent, so
+// scheduling the check-in again retries it.
+func (db *DB) ReleaseCheckInShare(id uuid.UUID) error {
+    _, err := db.Exec(`DELETE FROM checkin_shares WHERE id = $1`, id)
     return err
 }
 
+// Call methods
+
+// StartCall stores a ringing call unless either member is already on a
+// live call: one that has rung for less than ringTimeout, or was answered
+// less than maxDuration ago. A call that cannot ring is stored as busy
+// instead, and StartCall reports false.
+//
+// The check and the insert run under both members' call locks, so two
+// calls placed at the same moment cannot both ring.
+func (db *DB) StartCall(call *models.Call, ringTimeout, maxDuration time.Duration) (bool, error) {
+    tx, err := db.Beginx()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    // Take the locks in a fixed order so crossing calls cannot deadlock.
+    members := []uuid.UUID{call.CallerID, call.CalleeID}
+    if members[1].String() < members[0].String() {
+        members[0], members[1] = members[1], members[0]
+    }
+    for _, id := range members {
+        if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtextextended('call:' || $1::text, 0))`, id); err != nil {
+            return false, err
+        }
+    }
+
+    var busy bool
+    query := `
+        SELECT EXISTS (
+            SELECT 1 FROM calls
+            WHERE (caller_id IN ($1, $2) OR callee_id IN ($1, $2))
+              AND ((status = 'ringing' AND started_at > NOW() - $3 * INTERVAL '1 second')
+                OR (status = 'active' AND answered_at > NOW() - $4 * INTERVAL '1 second'))
+        )
+    `
+    if err := tx.Get(&busy, query, call.CallerID, call.CalleeID, ringTimeout.Seconds(), maxDuration.Seconds()); err != nil {
+        return false, err
+    }
+
+    status := "ringing"
+    if busy {
+        status = "busy"
+    }
+    query = `
+        INSERT INTO calls (id, match_id, caller_id, callee_id, video, caller_connection, status, ended_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, CASE WHEN $8 THEN NOW() END)
+        RETURNING *
+    `
+    err = tx.Get(call, query, call.ID, call.MatchID, call.CallerID, call.CalleeID, call.Video, call.CallerConnection, status, busy)
+    if err != nil {
+        return false, err
+    }
+    return !busy, tx.Commit()
+}
+
+func (db *DB) GetCall(id uuid.UUID) (*models.Call, error) {
+    var call models.Call
+    query := `SELECT * FROM calls WHERE id = $1`
+    err := db.Get(&call, query, id)
+    if err != nil {
+        return nil, err
+    }
+    return &call, nil
+}
+
+// AnswerCall moves a ringing call to active if calleeID is its callee and
+// the call's match is still active, and records the connection that
+// answered.
+func (db *DB) AnswerCall(id, calleeID, connectionID uuid.UUID) (*models.Call, error) {
+    var call models.Call
+    query := `
+        UPDATE calls c SET status = 'active', answered_at = NOW(), callee_connection = $3
+        WHERE c.id = $1 AND c.callee_id = $2 AND c.status = 'ringing'
+          AND EXISTS (SELECT 1 FROM matches WHERE id = c.match_id AND is_active = true)
+        RETURNING c.*
+    `
+    err := db.Get(&call, query, id, calleeID, connectionID)
+    if err != nil {
+        return nil, err
+    }
+    return &call, nil
+}
+
+// callEndStatus is the status a live call ends with when it is hung up:
+// an answered call has ended, a ringing one was cancelled if byCaller holds
+// and declined otherwise.
+func callEndStatus(byCaller string) string {
+    return `CASE WHEN status = 'active' THEN 'ended' WHEN ` + byCaller + ` THEN 'cancelled' ELSE 'declined' END`
+}
+
+// EndCall hangs up a ringing or active call on behalf of one of its members.
+func (db *DB) EndCall(id, userID uuid.UUID) (*models.Call, error) {
+    var call models.Call
+    query := `
+        UPDATE calls SET status = ` + callEndStatus("caller_id = $2") + `, ended_at = NOW()
+        WHERE id = $1 AND (caller_id = $2 OR callee_id = $2) AND status IN ('ringing', 'active')
+        RETURNING *
+    `
+    err := db.Get(&call, query, id, userID)
+    if err != nil {
+        return nil, err
+    }
+    return &call, nil
+}
+
+// MissCall ends a call that is still ringing as missed.
+func (db *DB) MissCall(id uuid.UUID) (*models.Call, error) {
+    var call models.Call
+    query := `
+        UPDATE calls SET status = 'missed', ended_at = NOW()
+        WHERE id = $1 AND status = 'ringing'
+        RETURNING *
+    `
+    err := db.Get(&call, query, id)
+    if err != nil {
+        return nil, err
+    }
+    return &call, nil
+}
+
+// EndConnectionCalls hangs up the live calls a websocket connection placed
+// or answered, once that connection has closed.
+func (db *DB) EndConnectionCalls(connectionID uuid.UUID) ([]models.Call, error) {
+    var calls []models.Call
+    query := `
+        UPDATE calls SET status = ` + callEndStatus("caller_connection = $1") + `, ended_at = NOW()
+        WHERE (caller_connection = $1 AND status IN ('ringing', 'active'))
+           OR (callee_connection = $1 AND status = 'active')
+        RETURNING *
+    `
+    err := db.Select(&calls, query, connectionID)
+    return calls, err
+}
+
+// Attachment methods
+func (db *DB) CreateAttachment(attachment *models.Attachment) error {
+    query := `
+        INSERT INTO attachments (id, match_id, uploader_id, storage_key, content_type, width, height, duration_ms, size_bytes)
+        VALUES (:id, :match_id, :uploader_id, :storage_key, :content_type, :width, :height, :duration_ms, :size_bytes)
+    `
+    _, err := db.NamedExec(query, attachment)
+    return err
+}
+
+func (db *DB) GetAttachment(id uuid.UUID) (*models.Attachment, error) {
+    var attachment models.Attachment
+    query := `SELECT * FROM attachments WHERE id = $1`
+    err := db.Get(&attachment, query, id)
+    if err != nil {
+        return nil, err
+    }
+    return &attachment, nil
+}
+
+// IsAttachmentSent reports whether a message references, or used to
+// reference, the attachment.
+func (db *DB) IsAttachmentSent(id uuid.UUID) (bool, error) {
+    var sent bool
+    query := `
+        SELECT EXISTS(SELECT 1 FROM messages WHERE attachment_id = $1)
+            OR EXISTS(SELECT 1 FROM message_edits WHERE attachment_id = $1)
+    `
+    err := db.Get(&sent, query, id)
+    return sent, err
+}
+
+// LoadMessageAttachments sets Attachment on every message that has one.
+func (db *DB) LoadMessageAttachments(messages []models.Message) error {
+    var ids []uuid.UUID
+    for _, message := range messages {
+        if message.AttachmentID != nil {
+            ids = append(ids, *message.AttachmentID)
+        }
+    }
+    if len(ids) == 0 {
+        return nil
+    }
+    
+    var attachments []models.Attachment
+    query := `SELECT * FROM attachments WHERE id = ANY($1)`
+    if err := db.Select(&attachments, query, pq.Array(ids)); err != nil {
+        return err
+    }
+    
+    byID := make(map[uuid.UUID]*models.Attachment, len(attachments))
+    for i := range attachments {
+        byID[attachments[i].ID] = &attachments[i]
+    }
+    for i := range messages {
+        if messages[i].AttachmentID != nil {
+            messages[i].Attachment = byID[*messages[i].AttachmentID]
+        }
+    }
+    return nil
+}
+
 // Discovery methods
 func (db *DB) GetPotentialMatches(userID uuid.UUID, limit int) ([]models.Profile, error) {
     var profiles []models.Profile
@@ -224,4 +1574,78 @@ func (db *DB) GetPotentialMatches(userID uuid.UUID, limit int) ([]models.Profile
     `
     err := db.Select(&profiles, query, userID, limit)
     return profiles, err
+}
+
+// Realtime event methods
+
+// nextEventSeqQuery takes the next event sequence number of user $1.
+const nextEventSeqQuery = `
+    INSERT INTO user_event_seqs (user_id, seq) VALUES ($1, 1)
+    ON CONFLICT (user_id) DO UPDATE SET seq = user_event_seqs.seq + 1
+    RETURNING seq
+`
+
+// NextEventSeq allocates the next realtime sequence number for a user.
+func (db *DB) NextEventSeq(userID uuid.UUID) (int64, error) {
+    var seq int64
+    err := db.Get(&seq, nextEventSeqQuery, userID)
+    return seq, err
+}
+
+func (db *DB) Notify(channel, payload string) error {
+    _, err := db.Exec(`SELECT pg_notify($1, $2)`, channel, payload)
+    return err
+}
+
+func (db *DB) CreateRealtimeEvent(payload []byte) (int64, error) {
+    var id int64
+    query := `INSERT INTO realtime_events (payload) VALUES ($1) RETURNING id`
+    err := db.Get(&id, query, string(payload))
+    return id, err
+}
+
+func (db *DB) GetRealtimeEvent(id int64) ([]byte, error) {
+    var payload string
+    query := `SELECT payload FROM realtime_events WHERE id = $1`
+    err := db.Get(&payload, query, id)
+    return []byte(payload), err
+}
+
+// CreateWebSocketTicket stores the hash of a websocket ticket for userID
+// and clears out tickets that expired unused.
+func (db *DB) CreateWebSocketTicket(ticketHash string, userID uuid.UUID, tokenExpiresAt, expiresAt time.Time) error {
+    if _, err := db.Exec(`DELETE FROM ws_tickets WHERE expires_at < NOW()`); err != nil {
+        return err
+    }
+
+    query := `
+        INSERT INTO ws_tickets (ticket_hash, user_id, token_expires_at, expires_at)
+        VALUES ($1, $2, $3, $4)
+    `
+    // The columns are TIMESTAMP holding UTC, and the JWT expiry and
+    // time.Now() are in local time.
+    _, err := db.Exec(query, ticketHash, userID, tokenExpiresAt.UTC(), expiresAt.UTC())
+    return err
+}
+
+// RedeemWebSocketTicket deletes an unexpired ticket and returns its user
+// and the expiry of the access token it was issued for. A ticket can only
+// be redeemed once; sql.ErrNoRows means it is unknown, used or expired.
+func (db *DB) RedeemWebSocketTicket(ticketHash string) (uuid.UUID, time.Time, error) {
+    var ticket struct {
+        UserID         uuid.UUID `db:"user_id"`
+        TokenExpiresAt time.Time `db:"token_expires_at"`
+    }
+    query := `
+        DELETE FROM ws_tickets
+        WHERE ticket_hash = $1 AND expires_at > NOW()
+        RETURNING user_id, token_expires_at
+    `
+    err := db.Get(&ticket, query, ticketHash)
+    return ticket.UserID, ticket.TokenExpiresAt, err
+}
+
+func (db *DB) DeleteRealtimeEventsBefore(cutoff time.Time) error {
+    _, err := db.Exec(`DELETE FROM realtime_events WHERE created_at < $1`, cutoff)
+    return err
 }
\ No newline at end of file
@@ -0,0 +1,348 @@
+package dates
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/database"
+	"dating-svelte/internal/models"
+	"dating-svelte/internal/notify"
+	wshandler "dating-svelte/internal/websocket"
+)
+
+const (
+	// CheckInGrace is how long after its check-in time a user can still
+	// confirm before their trusted contact is alerted.
+	CheckInGrace = 30 * time.Minute
+
+	// maxCheckInDelay is how long after the start of a date its check-in
+	// can be.
+	maxCheckInDelay = 24 * time.Hour
+
+	maxContactNameLength = 100
+
+	// maxSharesPerDay is how many times a day a user can have date details
+	// sent to a contact, so share_details cannot be used to message people.
+	maxSharesPerDay = 5
+)
+
+var (
+	ErrDateNotAccepted    = errors.New("check-ins can only be scheduled for accepted dates")
+	ErrInvalidContact     = errors.New("a trusted contact needs a name and a valid email address or phone number")
+	ErrInvalidCheckInTime = errors.New("check_in_at must be after the date starts and at most 24 hours later")
+	ErrCheckInNotFound    = errors.New("check-in not found or already closed")
+	ErrTooManyShares      = errors.New("date details have been shared too often today, try again later or turn off share_details")
+)
+
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// CheckInInput is a check-in a user schedules for a date. ShareDetails
+// sends the contact the date's time and place straight away; otherwise
+// they only hear about it if the user does not check in.
+type CheckInInput struct {
+	ContactName  string
+	ContactEmail string
+	ContactPhone string
+	ShareDetails bool
+	CheckInAt    time.Time
+}
+
+// validate checks in against the date it is for and normalises it for
+// storage. check_in_at is a TIMESTAMP holding UTC, so the client's offset
+// is applied here rather than dropped by the database.
+func (in *CheckInInput) validate(plan *models.DatePlan) error {
+	in.CheckInAt = in.CheckInAt.UTC()
+	in.ContactName = strings.TrimSpace(in.ContactName)
+	in.ContactEmail = strings.TrimSpace(in.ContactEmail)
+	in.ContactPhone = strings.ReplaceAll(strings.TrimSpace(in.ContactPhone), " ", "")
+
+	if in.ContactName == "" || utf8.RuneCountInString(in.ContactName) > maxContactNameLength {
+		return ErrInvalidContact
+	}
+	if in.ContactEmail == "" && in.ContactPhone == "" {
+		return ErrInvalidContact
+	}
+	if in.ContactEmail != "" {
+		if addr, err := mail.ParseAddress(in.ContactEmail); err != nil || addr.Address != in.ContactEmail {
+			return ErrInvalidContact
+		}
+	}
+	if in.ContactPhone != "" && !phonePattern.MatchString(in.ContactPhone) {
+		return ErrInvalidContact
+	}
+
+	if !in.CheckInAt.After(plan.ScheduledAt) || in.CheckInAt.Sub(plan.ScheduledAt) > maxCheckInDelay ||
+		!in.CheckInAt.After(time.Now()) {
+		return ErrInvalidCheckInTime
+	}
+	return nil
+}
+
+// CheckIns runs safety check-ins: it asks users to check in when the time
+// comes and alerts their trusted contact through the notifier if they have
+// not within CheckInGrace. Every replica can run one.
+type CheckIns struct {
+	db       checkInStore
+	hub      eventSender
+	notifier notify.Notifier
+}
+
+// checkInStore is the part of *database.DB that CheckIns uses, so it can
+// be tested without Postgres.
+type checkInStore interface {
+	GetProfile(userID uuid.UUID) (*models.Profile, error)
+	GetUserMatch(matchID, userID uuid.UUID) (*models.Match, error)
+	GetDatePlan(id uuid.UUID) (*models.DatePlan, error)
+	ScheduleCheckIn(checkIn *models.SafetyCheckIn) error
+	ConfirmCheckIn(id, userID uuid.UUID) (*models.SafetyCheckIn, error)
+	CancelCheckIn(id, userID uuid.UUID) error
+	DueCheckInPrompts() ([]models.SafetyCheckIn, error)
+	ClaimOverdueCheckIns(grace time.Duration) ([]models.SafetyCheckIn, error)
+	ReleaseCheckInAlert(id uuid.UUID) error
+	ClaimCheckInShare(id, planID, userID uuid.UUID, email, phone *string, limit int, window time.Duration) (bool, error)
+	ReleaseCheckInShare(id uuid.UUID) error
+}
+
+// eventSender is the part of *wshandler.Hub that CheckIns uses.
+type eventSender interface {
+	SendToUser(userID uuid.UUID, msg wshandler.Message)
+}
+
+func NewCheckIns(db *database.DB, hub *wshandler.Hub, notifier notify.Notifier) *CheckIns {
+	return &CheckIns{db: db, hub: hub, notifier: notifier}
+}
+
+// Schedule sets up userID's check-in for an accepted date they are part
+// of, replacing any check-in they already had for it. With ShareDetails the
+// contact is sent the date's details, unless they already have been for
+// this date; rescheduling does not send them again.
+func (c *CheckIns) Schedule(userID, planID uuid.UUID, in CheckInInput) (*models.SafetyCheckIn, error) {
+	plan, err := c.db.GetDatePlan(planID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, wshandler.ErrNotInMatch
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.db.GetUserMatch(plan.MatchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, wshandler.ErrNotInMatch
+		}
+		return nil, err
+	}
+	if plan.Status != "accepted" {
+		return nil, ErrDateNotAccepted
+	}
+	if err := in.validate(plan); err != nil {
+		return nil, err
+	}
+
+	checkIn := &models.SafetyCheckIn{
+		ID:           uuid.New(),
+		DatePlanID:   plan.ID,
+		UserID:       userID,
+		ContactName:  in.ContactName,
+		ShareDetails: in.ShareDetails,
+		CheckInAt:    in.CheckInAt,
+	}
+	if in.ContactEmail != "" {
+		checkIn.ContactEmail = &in.ContactEmail
+	}
+	if in.ContactPhone != "" {
+		checkIn.ContactPhone = &in.ContactPhone
+	}
+	// The share is claimed first so a user over the limit gets an error
+	// before anything changes.
+	var shareID uuid.UUID
+	if checkIn.ShareDetails {
+		shareID = uuid.New()
+		claimed, err := c.db.ClaimCheckInShare(shareID, plan.ID, userID, checkIn.ContactEmail, checkIn.ContactPhone,
+			maxSharesPerDay, 24*time.Hour)
+		if errors.Is(err, database.ErrShareLimitReached) {
+			return nil, ErrTooManyShares
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			shareID = uuid.Nil
+		}
+	}
+
+	if err := c.db.ScheduleCheckIn(checkIn); err != nil {
+		if shareID != uuid.Nil {
+			c.releaseShare(shareID)
+		}
+		return nil, err
+	}
+
+	if shareID != uuid.Nil {
+		if err := c.shareDetails(checkIn, plan); err != nil {
+			// The check-in itself still works, so this is not fatal.
+			log.Printf("dates: failed to share check-in %s with its contact: %v", checkIn.ID, err)
+			c.releaseShare(shareID)
+		}
+	}
+
+	return checkIn, nil
+}
+
+// shareDetails sends a check-in's contact the date's time and place.
+func (c *CheckIns) shareDetails(checkIn *models.SafetyCheckIn, plan *models.DatePlan) error {
+	name := c.displayName(checkIn.UserID)
+	body := fmt.Sprintf("%s has a date %s and asked us to let you know. "+
+		"They will check in by %s; if they don't, we'll message you again.",
+		name, describeDate(plan), formatTime(checkIn.CheckInAt))
+	msg := notify.Message{Subject: name + " shared their date plans with you", Body: body}
+	return c.notifier.Notify(contactOf(checkIn), msg)
+}
+
+// releaseShare forgets a share that was not sent, so it is tried again the
+// next time the check-in is scheduled.
+func (c *CheckIns) releaseShare(id uuid.UUID) {
+	if err := c.db.ReleaseCheckInShare(id); err != nil {
+		log.Printf("dates: failed to release check-in share %s: %v", id, err)
+	}
+}
+
+// Confirm records that userID is OK. If their contact has already been
+// alerted, the contact is told the user has checked in after all.
+func (c *CheckIns) Confirm(userID, checkInID uuid.UUID) (*models.SafetyCheckIn, error) {
+	checkIn, err := c.db.ConfirmCheckIn(checkInID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCheckInNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if checkIn.AlertedAt != nil {
+		name := c.displayName(userID)
+		msg := notify.Message{
+			Subject: name + " has checked in",
+			Body:    name + " has checked in and confirmed they are OK. Thank you for looking out for them.",
+		}
+		if err := c.notifier.Notify(contactOf(checkIn), msg); err != nil {
+			log.Printf("dates: failed to tell the contact of check-in %s it was confirmed: %v", checkIn.ID, err)
+		}
+	}
+
+	return checkIn, nil
+}
+
+// Cancel cancels userID's scheduled check-in.
+func (c *CheckIns) Cancel(userID, checkInID uuid.UUID) error {
+	err := c.db.CancelCheckIn(checkInID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCheckInNotFound
+	}
+	return err
+}
+
+// Run sweeps every interval. It never returns.
+func (c *CheckIns) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.Sweep()
+	}
+}
+
+// Sweep sends "checkin_due" to users whose check-in time has come and
+// alerts the contacts of users who are CheckInGrace past it. Alerts that
+// cannot be sent are retried by the next sweep.
+func (c *CheckIns) Sweep() {
+	due, err := c.db.DueCheckInPrompts()
+	if err != nil {
+		log.Printf("dates: failed to load due check-ins: %v", err)
+	}
+	for i := range due {
+		checkIn := &due[i]
+		c.hub.SendToUser(checkIn.UserID, wshandler.Message{
+			Type:      "checkin_due",
+			Timestamp: time.Now(),
+			Data:      checkIn,
+		})
+	}
+
+	overdue, err := c.db.ClaimOverdueCheckIns(CheckInGrace)
+	if err != nil {
+		log.Printf("dates: failed to load overdue check-ins: %v", err)
+		return
+	}
+	for i := range overdue {
+		checkIn := &overdue[i]
+		if err := c.alert(checkIn); err != nil {
+			log.Printf("dates: failed to alert the contact of check-in %s: %v", checkIn.ID, err)
+			if err := c.db.ReleaseCheckInAlert(checkIn.ID); err != nil {
+				log.Printf("dates: failed to release check-in %s for retry: %v", checkIn.ID, err)
+			}
+			continue
+		}
+
+		c.hub.SendToUser(checkIn.UserID, wshandler.Message{
+			Type:      "checkin_alerted",
+			Timestamp: time.Now(),
+			Data:      checkIn,
+		})
+	}
+}
+
+// alert tells a check-in's contact that the user has not checked in. The
+// date's time and place are included whether or not they were shared up
+// front, since the contact needs them to help.
+func (c *CheckIns) alert(checkIn *models.SafetyCheckIn) error {
+	plan, err := c.db.GetDatePlan(checkIn.DatePlanID)
+	if err != nil {
+		return err
+	}
+
+	name := c.displayName(checkIn.UserID)
+	body := fmt.Sprintf("%s had a date %s and was due to check in by %s, but hasn't. "+
+		"Please try to reach them. If you think they are in danger, contact the emergency services.",
+		name, describeDate(plan), formatTime(checkIn.CheckInAt))
+	return c.notifier.Notify(contactOf(checkIn), notify.Message{
+		Subject: name + " hasn't checked in after their date",
+		Body:    body,
+	})
+}
+
+// displayName returns the user's profile name, or a neutral fallback.
+func (c *CheckIns) displayName(userID uuid.UUID) string {
+	profile, err := c.db.GetProfile(userID)
+	if err != nil || profile.DisplayName == "" {
+		return "Your contact"
+	}
+	return profile.DisplayName
+}
+
+func contactOf(checkIn *models.SafetyCheckIn) notify.Contact {
+	contact := notify.Contact{Name: checkIn.ContactName}
+	if checkIn.ContactEmail != nil {
+		contact.Email = *checkIn.ContactEmail
+	}
+	if checkIn.ContactPhone != nil {
+		contact.Phone = *checkIn.ContactPhone
+	}
+	return contact
+}
+
+// describeDate reads as "on Fri 14 Jun 2024 at 19:30 UTC at Café Luna".
+func describeDate(plan *models.DatePlan) string {
+	description := fmt.Sprintf("on %s at %s", formatTime(plan.ScheduledAt), plan.PlaceName)
+	if plan.Latitude != nil && plan.Longitude != nil {
+		description += fmt.Sprintf(" (https://www.openstreetmap.org/?mlat=%f&mlon=%f)", *plan.Latitude, *plan.Longitude)
+	}
+	return description
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("Mon 2 Jan 2006 at 15:04 UTC")
+}
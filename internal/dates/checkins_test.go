@@ -0,0 +1,271 @@
+package dates
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+	"dating-svelte/internal/notify"
+	wshandler "dating-svelte/internal/websocket"
+)
+
+func TestCheckInStoredInUTC(t *testing.T) {
+	start := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	plan := &models.DatePlan{ScheduledAt: start}
+
+	// Three hours after the date starts, sent as local time in India.
+	kolkata := time.FixedZone("IST", 5*60*60+30*60)
+	local := start.Add(3 * time.Hour).In(kolkata)
+
+	in := CheckInInput{ContactName: "Sam", ContactEmail: "sam@example.com", CheckInAt: local}
+	if err := in.validate(plan); err != nil {
+		t.Fatalf("valid check-in rejected: %v", err)
+	}
+	if in.CheckInAt.Location() != time.UTC {
+		t.Errorf("check_in_at kept zone %s, want UTC", in.CheckInAt.Location())
+	}
+	if !in.CheckInAt.Equal(local) {
+		t.Errorf("check_in_at moved from %s to %s", local, in.CheckInAt)
+	}
+	if got := in.CheckInAt.Sub(plan.ScheduledAt); got != 3*time.Hour {
+		t.Errorf("check-in is %s after the date, want 3h", got)
+	}
+}
+
+func TestCheckInTimeComparedAcrossZones(t *testing.T) {
+	start := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	plan := &models.DatePlan{ScheduledAt: start}
+
+	// An hour before the date, though its wall-clock time reads later.
+	tokyo := time.FixedZone("JST", 9*60*60)
+	in := CheckInInput{ContactName: "Sam", ContactEmail: "sam@example.com", CheckInAt: start.Add(-time.Hour).In(tokyo)}
+	if err := in.validate(plan); err != ErrInvalidCheckInTime {
+		t.Errorf("got %v, want ErrInvalidCheckInTime", err)
+	}
+}
+
+// fakeCheckInStore keeps check-ins in memory and follows the database's
+// status changes, with now standing in for NOW(). Methods Sweep and Confirm
+// do not use are left to the nil embedded interface.
+type fakeCheckInStore struct {
+	checkInStore
+	now      time.Time
+	plan     models.DatePlan
+	checkIns map[uuid.UUID]*models.SafetyCheckIn
+}
+
+func (s *fakeCheckInStore) GetProfile(userID uuid.UUID) (*models.Profile, error) {
+	return &models.Profile{UserID: userID, DisplayName: "Alex"}, nil
+}
+
+func (s *fakeCheckInStore) GetDatePlan(id uuid.UUID) (*models.DatePlan, error) {
+	if id != s.plan.ID {
+		return nil, sql.ErrNoRows
+	}
+	plan := s.plan
+	return &plan, nil
+}
+
+func (s *fakeCheckInStore) ConfirmCheckIn(id, userID uuid.UUID) (*models.SafetyCheckIn, error) {
+	checkIn, ok := s.checkIns[id]
+	if !ok || checkIn.UserID != userID || (checkIn.Status != "scheduled" && checkIn.Status != "alerted") {
+		return nil, sql.ErrNoRows
+	}
+	now := s.now
+	checkIn.Status, checkIn.ConfirmedAt = "confirmed", &now
+	confirmed := *checkIn
+	return &confirmed, nil
+}
+
+func (s *fakeCheckInStore) DueCheckInPrompts() ([]models.SafetyCheckIn, error) {
+	var due []models.SafetyCheckIn
+	for _, checkIn := range s.checkIns {
+		if checkIn.Status == "scheduled" && checkIn.PromptedAt == nil && !checkIn.CheckInAt.After(s.now) {
+			now := s.now
+			checkIn.PromptedAt = &now
+			due = append(due, *checkIn)
+		}
+	}
+	return due, nil
+}
+
+func (s *fakeCheckInStore) ClaimOverdueCheckIns(grace time.Duration) ([]models.SafetyCheckIn, error) {
+	var overdue []models.SafetyCheckIn
+	for _, checkIn := range s.checkIns {
+		if checkIn.Status == "scheduled" && !checkIn.CheckInAt.After(s.now.Add(-grace)) {
+			now := s.now
+			checkIn.Status, checkIn.AlertedAt = "alerted", &now
+			overdue = append(overdue, *checkIn)
+		}
+	}
+	return overdue, nil
+}
+
+func (s *fakeCheckInStore) ReleaseCheckInAlert(id uuid.UUID) error {
+	if checkIn, ok := s.checkIns[id]; ok && checkIn.Status == "alerted" {
+		checkIn.Status, checkIn.AlertedAt = "scheduled", nil
+	}
+	return nil
+}
+
+// recordingHub collects the types of the events sent to each user.
+type recordingHub struct {
+	mu     sync.Mutex
+	events map[uuid.UUID][]string
+}
+
+func (h *recordingHub) SendToUser(userID uuid.UUID, msg wshandler.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events[userID] = append(h.events[userID], msg.Type)
+}
+
+func (h *recordingHub) sent(userID uuid.UUID) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.events[userID]...)
+}
+
+type notifierFunc func(to notify.Contact, msg notify.Message) error
+
+func (f notifierFunc) Notify(to notify.Contact, msg notify.Message) error {
+	return f(to, msg)
+}
+
+// newTestCheckIns returns CheckIns with one check-in due at the store's
+// current time.
+func newTestCheckIns(notifier notify.Notifier) (*CheckIns, *fakeCheckInStore, *recordingHub, *models.SafetyCheckIn) {
+	now := time.Now().UTC()
+	email := "sam@example.com"
+	plan := models.DatePlan{ID: uuid.New(), ScheduledAt: now.Add(-2 * time.Hour), PlaceName: "Café Luna"}
+	checkIn := &models.SafetyCheckIn{
+		ID:           uuid.New(),
+		DatePlanID:   plan.ID,
+		UserID:       uuid.New(),
+		ContactName:  "Sam",
+		ContactEmail: &email,
+		CheckInAt:    now,
+		Status:       "scheduled",
+	}
+	store := &fakeCheckInStore{
+		now:      now,
+		plan:     plan,
+		checkIns: map[uuid.UUID]*models.SafetyCheckIn{checkIn.ID: checkIn},
+	}
+	hub := &recordingHub{events: make(map[uuid.UUID][]string)}
+	return &CheckIns{db: store, hub: hub, notifier: notifier}, store, hub, checkIn
+}
+
+func equalEvents(got, want []string) bool {
+	return strings.Join(got, ",") == strings.Join(want, ",")
+}
+
+func TestSweepPromptsThenAlertsAfterGrace(t *testing.T) {
+	stub := notify.NewStub()
+	checkIns, store, hub, checkIn := newTestCheckIns(stub)
+
+	checkIns.Sweep()
+	checkIns.Sweep()
+	if got := hub.sent(checkIn.UserID); !equalEvents(got, []string{"checkin_due"}) {
+		t.Fatalf("after the check-in time, sent %v, want one checkin_due", got)
+	}
+
+	store.now = store.now.Add(CheckInGrace - time.Minute)
+	checkIns.Sweep()
+	if n := len(stub.Messages()); n != 0 {
+		t.Fatalf("contact alerted %d times within the grace period", n)
+	}
+
+	store.now = store.now.Add(time.Minute)
+	checkIns.Sweep()
+	checkIns.Sweep()
+	sent := stub.Messages()
+	if len(sent) != 1 {
+		t.Fatalf("contact alerted %d times after the grace period, want once", len(sent))
+	}
+	if sent[0].To.Email != "sam@example.com" || !strings.Contains(sent[0].Message.Body, "Café Luna") {
+		t.Errorf("alert sent to %+v with body %q", sent[0].To, sent[0].Message.Body)
+	}
+	if got := hub.sent(checkIn.UserID); !equalEvents(got, []string{"checkin_due", "checkin_alerted"}) {
+		t.Errorf("sent %v, want checkin_due then checkin_alerted", got)
+	}
+}
+
+func TestSweepRetriesFailedAlerts(t *testing.T) {
+	failures := 0
+	failing := notifierFunc(func(notify.Contact, notify.Message) error {
+		failures++
+		return errors.New("smtp: connection refused")
+	})
+	checkIns, store, hub, checkIn := newTestCheckIns(failing)
+	store.now = store.now.Add(CheckInGrace)
+
+	checkIns.Sweep()
+	if failures != 1 {
+		t.Fatalf("alert tried %d times, want once", failures)
+	}
+	if checkIn.Status != "scheduled" || checkIn.AlertedAt != nil {
+		t.Fatalf("failed alert left the check-in %s with alerted_at %v", checkIn.Status, checkIn.AlertedAt)
+	}
+	if got := hub.sent(checkIn.UserID); !equalEvents(got, []string{"checkin_due"}) {
+		t.Errorf("sent %v after a failed alert, want only checkin_due", got)
+	}
+
+	stub := notify.NewStub()
+	checkIns.notifier = stub
+	checkIns.Sweep()
+	if n := len(stub.Messages()); n != 1 {
+		t.Fatalf("retried alert sent %d times, want once", n)
+	}
+	if checkIn.Status != "alerted" {
+		t.Errorf("retried check-in is %s, want alerted", checkIn.Status)
+	}
+	if got := hub.sent(checkIn.UserID); !equalEvents(got, []string{"checkin_due", "checkin_alerted"}) {
+		t.Errorf("sent %v, want checkin_due then checkin_alerted", got)
+	}
+}
+
+func TestConfirmTellsAlertedContact(t *testing.T) {
+	stub := notify.NewStub()
+	checkIns, store, _, checkIn := newTestCheckIns(stub)
+	store.now = store.now.Add(CheckInGrace)
+	checkIns.Sweep()
+
+	confirmed, err := checkIns.Confirm(checkIn.UserID, checkIn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed.Status != "confirmed" || confirmed.AlertedAt == nil {
+		t.Errorf("confirmed check-in is %s with alerted_at %v", confirmed.Status, confirmed.AlertedAt)
+	}
+
+	sent := stub.Messages()
+	if len(sent) != 2 {
+		t.Fatalf("contact sent %d messages, want the alert and the all-clear", len(sent))
+	}
+	if !strings.Contains(sent[1].Message.Subject, "has checked in") {
+		t.Errorf("second message %q is not the all-clear", sent[1].Message.Subject)
+	}
+
+	if _, err := checkIns.Confirm(checkIn.UserID, checkIn.ID); err != ErrCheckInNotFound {
+		t.Errorf("confirming twice got %v, want ErrCheckInNotFound", err)
+	}
+}
+
+func TestConfirmBeforeAlertSendsNothing(t *testing.T) {
+	stub := notify.NewStub()
+	checkIns, _, _, checkIn := newTestCheckIns(stub)
+
+	if _, err := checkIns.Confirm(checkIn.UserID, checkIn.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.Messages()); n != 0 {
+		t.Errorf("contact sent %d messages for an on-time check-in", n)
+	}
+}
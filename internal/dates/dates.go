@@ -0,0 +1,64 @@
+// Package dates runs the background work for dates planned inside
+// conversations.
+package dates
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/database"
+	wshandler "dating-svelte/internal/websocket"
+)
+
+// ReminderLead is how long before an accepted date both members are
+// reminded of it.
+const ReminderLead = 2 * time.Hour
+
+// Reminder sends "date_reminder" events before accepted dates. Every
+// replica can run one: the database hands each date to a single reminder.
+type Reminder struct {
+	db  *database.DB
+	hub *wshandler.Hub
+}
+
+func NewReminder(db *database.DB, hub *wshandler.Hub) *Reminder {
+	return &Reminder{db: db, hub: hub}
+}
+
+// Run sends due reminders every interval. It never returns.
+func (r *Reminder) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.Remind()
+	}
+}
+
+// Remind sends a reminder to both members of every accepted date starting
+// within ReminderLead that has not had one yet.
+func (r *Reminder) Remind() {
+	plans, err := r.db.DueDateReminders(ReminderLead)
+	if err != nil {
+		log.Printf("dates: failed to load due reminders: %v", err)
+		return
+	}
+
+	for i := range plans {
+		plan := &plans[i]
+		match, err := r.db.GetUserMatch(plan.MatchID, plan.ProposerID)
+		if err != nil {
+			log.Printf("dates: failed to load match %s to remind of date %s: %v", plan.MatchID, plan.ID, err)
+			continue
+		}
+
+		msg := wshandler.Message{
+			Type:      "date_reminder",
+			MatchID:   &plan.MatchID,
+			Timestamp: time.Now(),
+			Data:      plan,
+		}
+		for _, userID := range []uuid.UUID{match.User1ID, match.User2ID} {
+			r.hub.SendToUser(userID, msg)
+		}
+	}
+}
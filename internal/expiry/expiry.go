@@ -0,0 +1,129 @@
+// Package expiry implements the optional "first move" rule: a match nobody
+// sends a message in within a window is deactivated, after both members
+// have been warned.
+package expiry
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/database"
+	"dating-svelte/internal/models"
+	wshandler "dating-svelte/internal/websocket"
+)
+
+// DefaultWarning is how long before a match expires its members are warned
+// when no warning is configured.
+const DefaultWarning = 4 * time.Hour
+
+// Policy configures match expiry. New matches expire Window after they are
+// made; a zero Window disables expiry for them. Premium members can extend
+// a match once, by another Window.
+type Policy struct {
+	Window  time.Duration
+	Warning time.Duration
+}
+
+// ParsePolicy reads a window and warning written as Go durations, such as
+// "24h" and "4h". An empty window disables expiry and an empty warning
+// means DefaultWarning.
+func ParsePolicy(window, warning string) (Policy, error) {
+	policy := Policy{Warning: DefaultWarning}
+
+	if window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d < 0 {
+			return policy, fmt.Errorf("invalid match expiry window %q", window)
+		}
+		policy.Window = d
+	}
+	if warning != "" {
+		d, err := time.ParseDuration(warning)
+		if err != nil || d <= 0 {
+			return policy, fmt.Errorf("invalid match expiry warning %q", warning)
+		}
+		policy.Warning = d
+	}
+
+	return policy, nil
+}
+
+// Enabled reports whether new matches expire.
+func (p Policy) Enabled() bool {
+	return p.Window > 0
+}
+
+// ExpiresAt returns when a match made at matchedAt expires, in UTC like
+// the expires_at column, or nil if expiry is disabled.
+func (p Policy) ExpiresAt(matchedAt time.Time) *time.Time {
+	if !p.Enabled() {
+		return nil
+	}
+	expiresAt := matchedAt.UTC().Add(p.Window)
+	return &expiresAt
+}
+
+// Sweeper warns about and deactivates expiring matches. Every replica can
+// run one: the database hands each match to a single sweeper.
+type Sweeper struct {
+	db     *database.DB
+	hub    *wshandler.Hub
+	policy Policy
+}
+
+func NewSweeper(db *database.DB, hub *wshandler.Hub, policy Policy) *Sweeper {
+	return &Sweeper{db: db, hub: hub, policy: policy}
+}
+
+// Run sweeps every interval. It keeps running with expiry disabled, so
+// matches made while it was enabled still expire. It never returns.
+func (s *Sweeper) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.Sweep()
+	}
+}
+
+// Sweep sends "match_expiring" to both members of every match entering its
+// warning period and "match_expired" to both members of every match it
+// deactivates.
+func (s *Sweeper) Sweep() {
+	warned, err := s.db.WarnExpiringMatches(s.policy.Warning)
+	if err != nil {
+		log.Printf("expiry: failed to warn expiring matches: %v", err)
+	}
+	for _, match := range warned {
+		s.notify(match, wshandler.Message{
+			Type:      "match_expiring",
+			MatchID:   &match.ID,
+			Timestamp: time.Now(),
+			Data: wshandler.MatchExpiryData{
+				ExpiresAt: *match.ExpiresAt,
+				Extended:  match.ExtendedAt != nil,
+			},
+		})
+	}
+
+	expired, err := s.db.ExpireMatches()
+	if err != nil {
+		log.Printf("expiry: failed to expire matches: %v", err)
+	}
+	for _, match := range expired {
+		s.notify(match, wshandler.Message{
+			Type:      "match_expired",
+			MatchID:   &match.ID,
+			Timestamp: time.Now(),
+		})
+	}
+	if len(expired) > 0 {
+		log.Printf("expiry: %d matches expired", len(expired))
+	}
+}
+
+func (s *Sweeper) notify(match models.Match, msg wshandler.Message) {
+	for _, userID := range []uuid.UUID{match.User1ID, match.User2ID} {
+		s.hub.SendToUser(userID, msg)
+	}
+}
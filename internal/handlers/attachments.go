@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/media"
+	"dating-svelte/internal/models"
+)
+
+// UploadAttachment stores an image or voice note for a conversation. The
+// returned attachment ID is then sent in a send_message frame (or the REST
+// equivalent) with message_type "image", "gif" or "audio".
+func UploadAttachment(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "Access denied to this match"})
+	}
+
+	data, err := readUpload(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	attachment := &models.Attachment{
+		ID:         uuid.New(),
+		MatchID:    matchID,
+		UploaderID: userID,
+		CreatedAt:  time.Now(),
+	}
+
+	var extension string
+	if media.IsAudio(data) {
+		audio, err := media.ProcessAudio(data)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		durationMs := int(audio.Duration.Milliseconds())
+		attachment.ContentType = audio.ContentType
+		attachment.DurationMs = &durationMs
+		data, extension = audio.Data, audio.Extension
+	} else {
+		img, err := media.ProcessImage(data)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		attachment.ContentType = img.ContentType
+		attachment.Width = img.Width
+		attachment.Height = img.Height
+		data, extension = img.Data, img.Extension
+	}
+
+	attachment.SizeBytes = int64(len(data))
+	attachment.StorageKey = "chat/" + matchID.String() + "/" + attachment.ID.String() + extension
+
+	if err := files.Put(attachment.StorageKey, bytes.NewReader(data)); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store attachment"})
+	}
+
+	if err := db.CreateAttachment(attachment); err != nil {
+		files.Delete(attachment.StorageKey)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store attachment"})
+	}
+
+	attachment.URL = media.AttachmentURL(attachment.ID)
+	return c.Status(201).JSON(attachment)
+}
+
+// GetAttachment serves an attachment through the signed URL handed to the
+// match members. It is not behind AuthRequired so it can be used in <img>
+// and <audio>.
+func GetAttachment(c *fiber.Ctx) error {
+	attachmentID, err := uuid.Parse(c.Params("attachmentId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid attachment ID"})
+	}
+
+	if !media.VerifyAttachmentURL(attachmentID, c.Query("expires"), c.Query("sig")) {
+		return c.Status(403).JSON(fiber.Map{"error": "Invalid or expired link"})
+	}
+
+	attachment, err := db.GetAttachment(attachmentID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Attachment not found"})
+	}
+
+	file, err := files.Open(attachment.StorageKey)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Attachment not found"})
+	}
+
+	c.Set(fiber.HeaderContentType, attachment.ContentType)
+	c.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+	return c.SendStream(file, int(attachment.SizeBytes))
+}
+
+// readUpload reads the "file" form field. Voice notes are held to
+// media.MaxAudioBytes and everything else to media.MaxImageBytes; the
+// limit is picked from the first bytes of the file, before the rest of it
+// is read.
+func readUpload(c *fiber.Ctx) ([]byte, error) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		return nil, errors.New("A file is required")
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, errors.New("Failed to read upload")
+	}
+	defer file.Close()
+
+	head := make([]byte, media.AudioSniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.New("Failed to read upload")
+	}
+	head = head[:n]
+
+	limit := int64(media.MaxImageBytes)
+	if media.IsAudio(head) {
+		limit = media.MaxAudioBytes
+	}
+	if header.Size > limit {
+		return nil, media.ErrFileTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(head), file), limit+1))
+	if err != nil {
+		return nil, errors.New("Failed to read upload")
+	}
+	if int64(len(data)) > limit {
+		return nil, media.ErrFileTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/dates"
+	wshandler "dating-svelte/internal/websocket"
+)
+
+// CheckInRequest schedules a safety check-in for a date. The contact needs
+// an email address, a phone number in international format, or both.
+type CheckInRequest struct {
+	ContactName  string    `json:"contact_name"`
+	ContactEmail string    `json:"contact_email"`
+	ContactPhone string    `json:"contact_phone"`
+	ShareDetails bool      `json:"share_details"`
+	CheckInAt    time.Time `json:"check_in_at"`
+}
+
+// ScheduleCheckIn sets up a safety check-in for one of the caller's
+// accepted dates. If the caller has not confirmed they are OK shortly after
+// check_in_at, their trusted contact is alerted.
+func ScheduleCheckIn(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	planID, err := uuid.Parse(c.Params("planId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid date ID"})
+	}
+
+	var req CheckInRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	checkIn, err := checkIns.Schedule(userID, planID, dates.CheckInInput{
+		ContactName:  req.ContactName,
+		ContactEmail: req.ContactEmail,
+		ContactPhone: req.ContactPhone,
+		ShareDetails: req.ShareDetails,
+		CheckInAt:    req.CheckInAt,
+	})
+	if err != nil {
+		return checkInError(c, err, "Failed to schedule check-in")
+	}
+
+	return c.Status(201).JSON(checkIn)
+}
+
+// GetCheckIns lists the caller's scheduled check-ins, soonest first.
+func GetCheckIns(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	scheduled, err := db.GetUserCheckIns(userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get check-ins"})
+	}
+
+	return c.JSON(fiber.Map{"checkins": scheduled})
+}
+
+// ConfirmCheckIn records that the caller is OK. It still works after the
+// contact has been alerted, in which case the contact is told.
+func ConfirmCheckIn(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	checkInID, err := uuid.Parse(c.Params("checkinId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid check-in ID"})
+	}
+
+	checkIn, err := checkIns.Confirm(userID, checkInID)
+	if err != nil {
+		return checkInError(c, err, "Failed to confirm check-in")
+	}
+
+	return c.JSON(checkIn)
+}
+
+// CancelCheckIn cancels one of the caller's scheduled check-ins.
+func CancelCheckIn(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	checkInID, err := uuid.Parse(c.Params("checkinId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid check-in ID"})
+	}
+
+	if err := checkIns.Cancel(userID, checkInID); err != nil {
+		return checkInError(c, err, "Failed to cancel check-in")
+	}
+
+	return c.SendStatus(204)
+}
+
+// checkInError maps errors from dates.CheckIns to responses.
+func checkInError(c *fiber.Ctx, err error, fallback string) error {
+	switch {
+	case errors.Is(err, wshandler.ErrNotInMatch), errors.Is(err, dates.ErrCheckInNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Check-in or date not found"})
+	case errors.Is(err, dates.ErrTooManyShares):
+		return c.Status(429).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, dates.ErrDateNotAccepted):
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, dates.ErrInvalidContact), errors.Is(err, dates.ErrInvalidCheckInTime):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": fallback})
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	wshandler "dating-svelte/internal/websocket"
+)
+
+// DatePlanRequest is a proposed or counter-proposed date. Latitude and
+// Longitude are optional but must be sent together.
+type DatePlanRequest struct {
+	ScheduledAt time.Time `json:"scheduled_at"`
+	PlaceName   string    `json:"place_name"`
+	Latitude    *float64  `json:"latitude"`
+	Longitude   *float64  `json:"longitude"`
+}
+
+func (r DatePlanRequest) input() wshandler.DateInput {
+	return wshandler.DateInput{
+		ScheduledAt: r.ScheduledAt,
+		PlaceName:   r.PlaceName,
+		Latitude:    r.Latitude,
+		Longitude:   r.Longitude,
+	}
+}
+
+// GetDates lists the caller's upcoming accepted dates, soonest first.
+func GetDates(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	dates, err := db.GetUpcomingDates(userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get dates"})
+	}
+
+	return c.JSON(fiber.Map{"dates": dates})
+}
+
+// GetMatchDates returns every date plan made in a match, newest first, so
+// the client can show the plan behind each date message.
+func GetMatchDates(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+
+	plans, err := db.GetMatchDatePlans(matchID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get dates"})
+	}
+
+	return c.JSON(fiber.Map{"dates": plans})
+}
+
+// ProposeDate proposes a date to the other member of a match, as a
+// "date_proposal" message in the conversation.
+func ProposeDate(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+
+	var req DatePlanRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	plan, message, err := wsHub.ProposeDate(matchID, userID, req.input())
+	if err != nil {
+		return messageError(c, err, "Failed to propose date")
+	}
+
+	return c.Status(201).JSON(fiber.Map{"date": plan, "message": message})
+}
+
+// RespondToDate returns a handler that accepts or declines a date the
+// other member of the match proposed.
+func RespondToDate(accept bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(uuid.UUID)
+
+		matchID, planID, err := parseDatePath(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		plan, message, err := wsHub.RespondToDate(matchID, planID, userID, accept)
+		if err != nil {
+			return messageError(c, err, "Failed to answer date")
+		}
+
+		return c.JSON(fiber.Map{"date": plan, "message": message})
+	}
+}
+
+// CounterDate answers a date the other member of the match proposed with
+// a different time or place.
+func CounterDate(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, planID, err := parseDatePath(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req DatePlanRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	plan, message, err := wsHub.CounterDate(matchID, planID, userID, req.input())
+	if err != nil {
+		return messageError(c, err, "Failed to counter date")
+	}
+
+	return c.Status(201).JSON(fiber.Map{"date": plan, "message": message})
+}
+
+func parseDatePath(c *fiber.Ctx) (uuid.UUID, uuid.UUID, error) {
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, errors.New("Invalid match ID")
+	}
+	planID, err := uuid.Parse(c.Params("planId"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, errors.New("Invalid date ID")
+	}
+	return matchID, planID, nil
+}
@@ -1,6 +1,10 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -9,14 +13,29 @@ import (
 
 	"dating-svelte/internal/auth"
 	"dating-svelte/internal/database"
+	"dating-svelte/internal/dates"
+	"dating-svelte/internal/expiry"
+	"dating-svelte/internal/media"
 	"dating-svelte/internal/models"
+	"dating-svelte/internal/storage"
+	wshandler "dating-svelte/internal/websocket"
 )
 
-var db *database.DB
+var (
+	db          *database.DB
+	wsHub       *wshandler.Hub
+	files       storage.Storage
+	matchExpiry expiry.Policy
+	checkIns    *dates.CheckIns
+)
 
-// InitializeHandlers sets up the database connection for handlers
-func InitializeHandlers(database *database.DB) {
+// InitializeHandlers sets up the database connection, realtime hub, file storage, match expiry policy and safety check-ins for handlers
+func InitializeHandlers(database *database.DB, hub *wshandler.Hub, store storage.Storage, expiryPolicy expiry.Policy, safety *dates.CheckIns) {
 	db = database
+	wsHub = hub
+	files = store
+	matchExpiry = expiryPolicy
+	checkIns = safety
 }
 
 // Auth handlers
@@ -174,6 +193,34 @@ func RefreshToken(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"tokens": tokens})
 }
 
+// wsTicketTTL is how long a websocket ticket can wait before being used.
+const wsTicketTTL = 30 * time.Second
+
+// CreateWebSocketTicket issues a short-lived, single-use ticket for opening
+// the websocket as /ws?ticket=..., since browsers cannot send the
+// Authorization header on the handshake.
+func CreateWebSocketTicket(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+	tokenExpiresAt, ok := c.Locals("token_expires_at").(time.Time)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+
+	ticket, hash, err := auth.GenerateTicket()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create ticket"})
+	}
+
+	if err := db.CreateWebSocketTicket(hash, userID, tokenExpiresAt, time.Now().UTC().Add(wsTicketTTL)); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create ticket"})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"ticket":     ticket,
+		"expires_in": int(wsTicketTTL.Seconds()),
+	})
+}
+
 // Profile handlers
 func GetProfile(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uuid.UUID)
@@ -204,54 +251,198 @@ func UpdateProfile(c *fiber.Ctx) error {
 	return c.JSON(profile)
 }
 
+// Presence handlers
+
+// maxPresenceUsers caps how many users one presence request can ask about.
+const maxPresenceUsers = 100
+
+// GetPresence returns the online status and last-seen time of the users in
+// the comma separated user_ids query parameter. Users who are not one of
+// the caller's matches are left out of the response.
+func GetPresence(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	var userIDs []uuid.UUID
+	for _, raw := range strings.Split(c.Query("user_ids"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid user ID"})
+		}
+		userIDs = append(userIDs, id)
+	}
+	if len(userIDs) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "user_ids is required"})
+	}
+	if len(userIDs) > maxPresenceUsers {
+		return c.Status(400).JSON(fiber.Map{"error": "Too many user IDs"})
+	}
+
+	presence, err := wsHub.Presence(userID, userIDs)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get presence"})
+	}
+	if presence == nil {
+		presence = []models.Presence{}
+	}
+
+	return c.JSON(fiber.Map{"presence": presence})
+}
+
+// UpdatePresenceSettings turns "hide my online status" on or off.
+func UpdatePresenceSettings(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	var req struct {
+		HideOnlineStatus *bool `json:"hide_online_status"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.HideOnlineStatus == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "hide_online_status is required"})
+	}
+
+	if err := wsHub.SetPresenceHidden(userID, *req.HideOnlineStatus); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update presence settings"})
+	}
+
+	return c.JSON(fiber.Map{"hide_online_status": *req.HideOnlineStatus})
+}
+
 // Match handlers
+
+// maxMatchesPage is the most matches GetMatches returns at once.
+const maxMatchesPage = 100
+
+// GetMatches lists a page of the user's matches, pinned first and then by
+// latest activity, with the other member's profile, the latest message and
+// the unread count. Archived matches are left out unless archived=true,
+// which lists only them. filter=new|your_turn|unread and q (a display name
+// search) narrow the list; limit (default 50) sets the page size, and the
+// returned next_cursor is passed back as cursor for the next page.
 func GetMatches(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uuid.UUID)
 
-	// Get actual matches for this user
-	matches, err := db.GetUserMatches(userID)
+	filter := database.MatchFilter{
+		Archived: c.QueryBool("archived", false),
+		Filter:   c.Query("filter"),
+		Query:    strings.TrimSpace(c.Query("q")),
+		Limit:    c.QueryInt("limit", 50),
+	}
+	if filter.Limit < 1 || filter.Limit > maxMatchesPage {
+		filter.Limit = maxMatchesPage
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, err := database.ParseMatchCursor(cursor)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid cursor"})
+		}
+		filter.After = after
+	}
+
+	matches, next, err := db.GetUserMatches(userID, filter)
+	if errors.Is(err, database.ErrInvalidMatchFilter) {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to get matches"})
 	}
+	if matches == nil {
+		matches = []models.MatchSummary{}
+	}
+
+	var nextCursor *string
+	if next != nil {
+		token := next.String()
+		nextCursor = &token
+	}
+
+	return c.JSON(fiber.Map{
+		"matches":     matches,
+		"next_cursor": nextCursor,
+	})
+}
+
+// SetMatchFlag returns a handler that turns one of the caller's
+// conversation flags for a match ("muted", "archived" or "pinned") on or
+// off. The caller's other devices are told through a "match_updated" event.
+func SetMatchFlag(flag string, on bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("user_id").(uuid.UUID)
+
+		matchID, err := uuid.Parse(c.Params("matchId"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+		}
 
-	// Populate each match with user profiles
-	var enrichedMatches []fiber.Map
-	for _, match := range matches {
-		// Get profiles for both users
-		user1Profile, _ := db.GetProfile(match.User1ID)
-		user2Profile, _ := db.GetProfile(match.User2ID)
+		if _, err := db.GetUserMatch(matchID, userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+		}
 
-		// Determine which is the other user
-		var otherUser *models.Profile
-		if match.User1ID == userID {
-			otherUser = user2Profile
-		} else {
-			otherUser = user1Profile
+		if err := db.SetMatchFlag(matchID, userID, flag, on); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update match"})
 		}
 
-		// Get last message for this match
-		messages, _ := db.GetMatchMessages(match.ID)
-		var lastMessage string
-		var lastMessageTime *time.Time
-		if len(messages) > 0 {
-			lastMessage = messages[len(messages)-1].Message
-			lastMessageTime = &messages[len(messages)-1].CreatedAt
+		wsHub.SendToUser(userID, wshandler.Message{
+			Type:      "match_updated",
+			MatchID:   &matchID,
+			Timestamp: time.Now(),
+			Data:      wshandler.MatchUpdatedData{flag: on},
+		})
+
+		return c.JSON(fiber.Map{"match_id": matchID, flag: on})
+	}
+}
+
+// ExtendMatch uses the one-time premium extension on a match nobody has
+// messaged yet, giving it another expiry window. Both members are told
+// through a "match_extended" event.
+func ExtendMatch(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
 		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+
+	profile, err := db.GetProfile(userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get profile"})
+	}
+	if profile == nil || !profile.IsPremium {
+		return c.Status(403).JSON(fiber.Map{"error": "Extending a match requires premium"})
+	}
 
-		enrichedMatch := fiber.Map{
-			"id":              match.ID,
-			"matched_at":      match.MatchedAt,
-			"is_active":       match.IsActive,
-			"other_user":      otherUser,
-			"last_message":    lastMessage,
-			"last_message_at": lastMessageTime,
-			"unread_count":    0, // TODO: Implement unread count
+	match, err := db.ExtendMatch(matchID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotExtendable) {
+			return c.Status(409).JSON(fiber.Map{"error": "This match can no longer be extended"})
 		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to extend match"})
+	}
 
-		enrichedMatches = append(enrichedMatches, enrichedMatch)
+	event := wshandler.Message{
+		Type:      "match_extended",
+		MatchID:   &matchID,
+		UserID:    &userID,
+		Timestamp: time.Now(),
+		Data:      wshandler.MatchExpiryData{ExpiresAt: *match.ExpiresAt, Extended: true},
 	}
+	wsHub.SendToUser(match.User1ID, event)
+	wsHub.SendToUser(match.User2ID, event)
 
-	return c.JSON(enrichedMatches)
+	return c.JSON(fiber.Map{"match_id": matchID, "expires_at": match.ExpiresAt})
 }
 
 func GetPotentialMatches(c *fiber.Ctx) error {
@@ -299,18 +490,28 @@ func Swipe(c *fiber.Ctx) error {
 		isMatch, err := db.CheckForMatch(userID, req.TargetUserID)
 		if err == nil && isMatch {
 			// Create match record
+			matchedAt := time.Now().UTC()
 			match := &models.Match{
 				ID:        uuid.New(),
 				User1ID:   userID,
 				User2ID:   req.TargetUserID,
-				MatchedAt: time.Now(),
+				MatchedAt: matchedAt,
 				IsActive:  true,
-				CreatedAt: time.Now(),
+				CreatedAt: matchedAt,
+				ExpiresAt: matchExpiry.ExpiresAt(matchedAt),
 			}
 
 			if err := db.CreateMatch(match); err == nil {
 				response["matched"] = true
 				response["match_id"] = match.ID
+				if match.ExpiresAt != nil {
+					response["expires_at"] = match.ExpiresAt
+				}
+
+				// GetIcebreakers retries if this fails.
+				if _, err := assignIcebreakers(match); err != nil {
+					log.Printf("Failed to assign icebreakers to match %s: %v", match.ID, err)
+				}
 			}
 		}
 	}
@@ -349,21 +550,11 @@ func GetMessages(c *fiber.Ctx) error {
 	}
 
 	// Verify user is part of this match
-	matches, err := db.GetUserMatches(userID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to get matches"})
-	}
-
-	validMatch := false
-	for _, match := range matches {
-		if match.ID == matchID {
-			validMatch = true
-			break
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(403).JSON(fiber.Map{"error": "Access denied to this match"})
 		}
-	}
-
-	if !validMatch {
-		return c.Status(403).JSON(fiber.Map{"error": "Access denied to this match"})
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get matches"})
 	}
 
 	// Get messages for this match
@@ -372,13 +563,65 @@ func GetMessages(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to get messages"})
 	}
 
+	if err := db.LoadMessageAttachments(messages); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get messages"})
+	}
+	media.SignAttachments(messages)
+
 	return c.JSON(fiber.Map{
 		"messages": messages,
 		"match_id": matchID,
 	})
 }
 
-func GetMatchDetails(c *fiber.Ctx) error {
+// SearchMessages searches the text of every message in the caller's active
+// matches. Results are paged with limit and offset.
+func SearchMessages(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Search query is required"})
+	}
+	if len(query) > 200 {
+		return c.Status(400).JSON(fiber.Map{"error": "Search query is too long"})
+	}
+
+	limit := c.QueryInt("limit", 20)
+	if limit < 1 || limit > 50 {
+		limit = 20
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	results, err := db.SearchMessages(userID, query, limit, offset)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+	}
+	if results == nil {
+		results = []models.MessageSearchResult{}
+	}
+
+	return c.JSON(fiber.Map{
+		"results": results,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+type SendMessageRequest struct {
+	Message      string     `json:"message"`
+	MessageType  string     `json:"message_type"`
+	AttachmentID *uuid.UUID `json:"attachment_id"`
+	IcebreakerID string     `json:"icebreaker_id"`
+	ClientID     string     `json:"client_id"`
+}
+
+// SendMessage is the REST equivalent of the websocket send_message frame and
+// goes through the same hub path, so both produce identical events.
+func SendMessage(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uuid.UUID)
 	matchIDStr := c.Params("matchId")
 
@@ -387,40 +630,162 @@ func GetMatchDetails(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
 	}
 
-	// Get match details
-	matches, err := db.GetUserMatches(userID)
+	var req SendMessageRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	message, err := wsHub.SendMessageToMatch(wshandler.MessageInput{
+		MatchID:      matchID,
+		SenderID:     userID,
+		Message:      req.Message,
+		MessageType:  req.MessageType,
+		AttachmentID: req.AttachmentID,
+		IcebreakerID: req.IcebreakerID,
+		ClientID:     req.ClientID,
+	})
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to get matches"})
+		return messageError(c, err, "Failed to send message")
 	}
 
-	var targetMatch *models.Match
-	for _, match := range matches {
-		if match.ID == matchID {
-			targetMatch = &match
-			break
-		}
+	return c.Status(201).JSON(message)
+}
+
+// EditMessage is the REST equivalent of the websocket edit_message frame.
+func EditMessage(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, messageID, err := parseMessagePath(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	message, err := wsHub.EditMessage(matchID, messageID, userID, req.Message)
+	if err != nil {
+		return messageError(c, err, "Failed to edit message")
 	}
 
-	if targetMatch == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+	return c.JSON(message)
+}
+
+// DeleteMessage is the REST equivalent of the websocket delete_message frame.
+func DeleteMessage(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, messageID, err := parseMessagePath(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Get the other user's profile
-	var otherUserID uuid.UUID
-	if targetMatch.User1ID == userID {
-		otherUserID = targetMatch.User2ID
-	} else {
-		otherUserID = targetMatch.User1ID
+	message, err := wsHub.DeleteMessage(matchID, messageID, userID)
+	if err != nil {
+		return messageError(c, err, "Failed to delete message")
 	}
 
-	otherProfile, err := db.GetProfile(otherUserID)
+	return c.JSON(message)
+}
+
+// AddReaction is the REST equivalent of the websocket add_reaction frame.
+func AddReaction(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, messageID, err := parseMessagePath(c)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to get other user's profile"})
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	reactions, err := wsHub.AddReaction(matchID, messageID, userID, req.Emoji)
+	if err != nil {
+		return messageError(c, err, "Failed to add reaction")
+	}
+
+	return c.JSON(fiber.Map{"reactions": reactions})
+}
+
+// RemoveReaction is the REST equivalent of the websocket remove_reaction
+// frame. The emoji is passed as the "emoji" query parameter.
+func RemoveReaction(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, messageID, err := parseMessagePath(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	reactions, err := wsHub.RemoveReaction(matchID, messageID, userID, c.Query("emoji"))
+	if err != nil {
+		return messageError(c, err, "Failed to remove reaction")
+	}
+
+	return c.JSON(fiber.Map{"reactions": reactions})
+}
+
+func parseMessagePath(c *fiber.Ctx) (uuid.UUID, uuid.UUID, error) {
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, errors.New("Invalid match ID")
+	}
+	messageID, err := uuid.Parse(c.Params("messageId"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, errors.New("Invalid message ID")
+	}
+	return matchID, messageID, nil
+}
+
+// messageError maps errors from the hub's message operations to responses.
+func messageError(c *fiber.Ctx, err error, fallback string) error {
+	switch {
+	case errors.Is(err, wshandler.ErrNotInMatch):
+		return c.Status(403).JSON(fiber.Map{"error": "Access denied to this match"})
+	case errors.Is(err, wshandler.ErrNotSender):
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, wshandler.ErrMessageNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, wshandler.ErrWindowExpired), errors.Is(err, wshandler.ErrMessageDeleted),
+		errors.Is(err, wshandler.ErrNotEditable), errors.Is(err, wshandler.ErrDateNotPending),
+		errors.Is(err, wshandler.ErrClientIDInUse):
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	case wshandler.IsValidationError(err):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": fallback})
+	}
+}
+
+func GetMatchDetails(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+	matchIDStr := c.Params("matchId")
+
+	matchID, err := uuid.Parse(matchIDStr)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+
+	match, err := db.GetMatchSummary(matchID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
 	}
 
 	return c.JSON(fiber.Map{
-		"match":      targetMatch,
-		"other_user": otherProfile,
+		"match":      match,
+		"other_user": match.OtherUser,
 	})
 }
 
@@ -442,9 +807,15 @@ func ExportData(c *fiber.Ctx) error {
 	// TODO: Implement data export functionality
 	// Collect all user data: profile, photos, matches, messages, etc.
 
+	notes, err := db.GetUserNotes(userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to export data"})
+	}
+
 	return c.JSON(fiber.Map{
-		"message": "Data export initiated",
-		"user_id": userID,
+		"message":     "Data export initiated",
+		"user_id":     userID,
+		"match_notes": notes,
 	})
 }
 
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/icebreakers"
+	"dating-svelte/internal/models"
+)
+
+// icebreakersPerMatch is how many prompts each match is offered.
+const icebreakersPerMatch = 3
+
+// GetIcebreakers returns the conversation starters suggested for a match.
+// Either member can send one as a message with message_type "icebreaker"
+// and its ID as icebreaker_id.
+func GetIcebreakers(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+
+	match, err := db.GetUserMatch(matchID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+
+	promptIDs, err := db.GetMatchIcebreakers(matchID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get icebreakers"})
+	}
+	// Matches made before icebreakers existed, or whose prompts could not
+	// be stored at the time, get theirs now.
+	if len(promptIDs) == 0 {
+		if promptIDs, err = assignIcebreakers(match); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get icebreakers"})
+		}
+	}
+
+	prompts := make([]icebreakers.Prompt, 0, len(promptIDs))
+	for _, id := range promptIDs {
+		// Prompts removed from the library are no longer offered.
+		if prompt, ok := icebreakers.Get(id); ok {
+			prompts = append(prompts, prompt)
+		}
+	}
+
+	return c.JSON(fiber.Map{"icebreakers": prompts})
+}
+
+// assignIcebreakers picks prompts for a match from both members' profiles
+// and stores them, returning the IDs of the prompts stored. A member
+// without a profile just gets general prompts.
+func assignIcebreakers(match *models.Match) ([]string, error) {
+	var profiles [2]*models.Profile
+	for i, memberID := range []uuid.UUID{match.User1ID, match.User2ID} {
+		profile, err := db.GetProfile(memberID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		profiles[i] = profile
+	}
+
+	prompts := icebreakers.Pick(profiles[0], profiles[1], icebreakersPerMatch)
+	promptIDs := make([]string, len(prompts))
+	for i, prompt := range prompts {
+		promptIDs[i] = prompt.ID
+	}
+
+	if err := db.SetMatchIcebreakers(match.ID, promptIDs); err != nil {
+		return nil, err
+	}
+	// Another request may have stored a different set first.
+	return db.GetMatchIcebreakers(match.ID)
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+)
+
+const (
+	maxNoteLength    = 2000
+	maxNotesPerMatch = 100
+)
+
+// NoteRequest is the body of a note being created or edited.
+type NoteRequest struct {
+	Body string `json:"body"`
+}
+
+// GetNotes returns the caller's private notes on a match, oldest first.
+func GetNotes(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+
+	notes, err := db.GetMatchNotes(matchID, userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get notes"})
+	}
+
+	return c.JSON(fiber.Map{"notes": notes})
+}
+
+// CreateNote adds a private note to a match. Notes are only ever returned
+// to their author.
+func CreateNote(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+
+	body, err := parseNoteBody(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	count, err := db.CountMatchNotes(matchID, userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create note"})
+	}
+	if count >= maxNotesPerMatch {
+		return c.Status(409).JSON(fiber.Map{"error": "Too many notes on this match"})
+	}
+
+	note := &models.MatchNote{
+		ID:      uuid.New(),
+		MatchID: matchID,
+		UserID:  userID,
+		Body:    body,
+	}
+	if err := db.CreateMatchNote(note); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create note"})
+	}
+
+	return c.Status(201).JSON(note)
+}
+
+// UpdateNote replaces the body of one of the caller's notes.
+func UpdateNote(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+	noteID, err := uuid.Parse(c.Params("noteId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid note ID"})
+	}
+
+	body, err := parseNoteBody(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	note, err := db.UpdateMatchNote(noteID, matchID, userID, body)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Note not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update note"})
+	}
+
+	return c.JSON(note)
+}
+
+// DeleteNote deletes one of the caller's notes.
+func DeleteNote(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+	if _, err := db.GetUserMatch(matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+	noteID, err := uuid.Parse(c.Params("noteId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid note ID"})
+	}
+
+	if err := db.DeleteMatchNote(noteID, matchID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Note not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete note"})
+	}
+
+	return c.SendStatus(204)
+}
+
+func parseNoteBody(c *fiber.Ctx) (string, error) {
+	var req NoteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return "", errors.New("Invalid request body")
+	}
+
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		return "", errors.New("Note cannot be empty")
+	}
+	if utf8.RuneCountInString(body) > maxNoteLength {
+		return "", errors.New("Note is too long")
+	}
+	return body, nil
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+	"dating-svelte/internal/transcript"
+)
+
+const (
+	maxReportReasonLength      = 100
+	maxReportDescriptionLength = 2000
+)
+
+// ReportRequest is the body of a report. A report made from a conversation
+// gives match_id, and the other member is the one reported; otherwise
+// reported_id names them. AttachTranscript snapshots the conversation.
+type ReportRequest struct {
+	ReportedID       *uuid.UUID `json:"reported_id"`
+	MatchID          *uuid.UUID `json:"match_id"`
+	Reason           string     `json:"reason"`
+	Description      string     `json:"description"`
+	AttachTranscript bool       `json:"attach_transcript"`
+}
+
+// GetTranscript exports the conversation in a match as a signed,
+// timestamped transcript. ?format=text returns it as a plain-text download
+// instead of JSON.
+func GetTranscript(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	matchID, err := uuid.Parse(c.Params("matchId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid match ID"})
+	}
+
+	format := c.Query("format", "json")
+	if format != "json" && format != "text" {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be json or text"})
+	}
+
+	match, err := db.GetUserMatch(matchID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+	}
+
+	t, err := transcript.Build(db, match, userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to export transcript"})
+	}
+
+	if format == "text" {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+		c.Set(fiber.HeaderContentDisposition,
+			`attachment; filename="transcript-`+matchID.String()+`-`+t.ExportedAt.Format("20060102T150405Z")+`.txt"`)
+		return c.SendString(t.Text())
+	}
+	return c.JSON(t)
+}
+
+// CreateReport reports another user to the moderators. With
+// attach_transcript, the report keeps a signed snapshot of the conversation
+// as it is now, so it survives the other user unsending messages.
+func CreateReport(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uuid.UUID)
+
+	var req ReportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	report := &models.Report{
+		ID:         uuid.New(),
+		ReporterID: userID,
+		MatchID:    req.MatchID,
+		Reason:     strings.TrimSpace(req.Reason),
+	}
+	if report.Reason == "" || utf8.RuneCountInString(report.Reason) > maxReportReasonLength {
+		return c.Status(400).JSON(fiber.Map{"error": "reason must be 1 to 100 characters"})
+	}
+	if description := strings.TrimSpace(req.Description); description != "" {
+		if utf8.RuneCountInString(description) > maxReportDescriptionLength {
+			return c.Status(400).JSON(fiber.Map{"error": "Description is too long"})
+		}
+		report.Description = &description
+	}
+
+	switch {
+	case req.MatchID != nil:
+		match, err := db.GetUserMatch(*req.MatchID, userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return c.Status(404).JSON(fiber.Map{"error": "Match not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get match"})
+		}
+		report.ReportedID = match.User1ID
+		if report.ReportedID == userID {
+			report.ReportedID = match.User2ID
+		}
+		if req.ReportedID != nil && *req.ReportedID != report.ReportedID {
+			return c.Status(400).JSON(fiber.Map{"error": "reported_id is not the other member of this match"})
+		}
+
+		if req.AttachTranscript {
+			t, err := transcript.Build(db, match, userID)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to attach transcript"})
+			}
+			snapshot, err := json.Marshal(t)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Failed to attach transcript"})
+			}
+			raw := json.RawMessage(snapshot)
+			report.Transcript = &raw
+		}
+
+	case req.ReportedID != nil:
+		if req.AttachTranscript {
+			return c.Status(400).JSON(fiber.Map{"error": "attach_transcript requires match_id"})
+		}
+		if *req.ReportedID == userID {
+			return c.Status(400).JSON(fiber.Map{"error": "You cannot report yourself"})
+		}
+		if _, err := db.GetUser(*req.ReportedID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to get user"})
+		}
+		report.ReportedID = *req.ReportedID
+
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "match_id or reported_id is required"})
+	}
+
+	if err := db.CreateReport(report); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create report"})
+	}
+
+	return c.Status(201).JSON(report)
+}
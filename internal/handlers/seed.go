@@ -189,9 +189,9 @@ func SeedData(c *fiber.Ctx) error {
 		}
 
 		for i, messageText := range messages {
-			senderID := testUserID
+			senderID, recipientID := testUserID, currentUserID
 			if i%2 == 1 { // Alternate between users
-				senderID = currentUserID
+				senderID, recipientID = currentUserID, testUserID
 			}
 
 			message := &models.Message{
@@ -203,7 +203,7 @@ func SeedData(c *fiber.Ctx) error {
 				CreatedAt: time.Now().Add(-time.Duration(matchesCreated+1)*time.Hour + time.Duration(i)*time.Minute*10),
 			}
 
-			db.CreateMessage(message)
+			db.CreateMessage(message, recipientID)
 		}
 
 		matchesCreated++
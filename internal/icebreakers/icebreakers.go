@@ -0,0 +1,200 @@
+// Package icebreakers suggests conversation starters for new matches from
+// a curated prompt library, preferring topics both members mention in
+// their bios.
+package icebreakers
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+
+	"dating-svelte/internal/models"
+)
+
+// Prompt is a conversation starter. ID is stable, so sent prompts can be
+// compared over time; Topic is empty for prompts that suit anyone.
+type Prompt struct {
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+	Topic string `json:"topic,omitempty"`
+}
+
+// topicKeywords lists the words in a bio that point to a topic, matched
+// as whole words ignoring case. A trailing * matches any ending.
+var topicKeywords = map[string][]string{
+	"travel":   {"travel*", "trip*", "backpack*", "abroad", "passport", "wanderlust", "explor*"},
+	"music":    {"music", "concert*", "gig", "gigs", "guitar*", "piano", "singing", "singer", "band", "bands", "festival*", "vinyl", "spotify"},
+	"food":     {"food", "foodie", "restaurant*", "brunch", "sushi", "pizza", "tacos", "ramen", "eating"},
+	"cooking":  {"cook*", "bak*", "chef", "recipe*", "kitchen"},
+	"fitness":  {"gym", "running", "runner", "marathon*", "yoga", "fitness", "workout*", "crossfit", "lifting", "cycling", "climb*"},
+	"outdoors": {"hik*", "camping", "outdoor*", "mountain*", "beach*", "surfing", "ski", "skiing", "snowboard*", "nature", "trail*"},
+	"pets":     {"dog", "dogs", "cat", "cats", "puppy", "kitten*", "pet", "pets"},
+	"books":    {"book", "books", "reading", "reader", "novels", "author*", "poetry", "library"},
+	"movies":   {"movie*", "film*", "cinema", "netflix", "series", "tv"},
+	"gaming":   {"game", "games", "gaming", "gamer", "playstation", "xbox", "nintendo", "switch", "steam", "boardgame*"},
+	"art":      {"art", "artist", "paint*", "draw*", "museum*", "gallery", "photograph*", "design*"},
+	"coffee":   {"coffee", "espresso", "latte", "cafe*", "tea"},
+}
+
+// library is the curated prompt set. Prompts are only ever added or
+// reworded, never renumbered, so stored IDs stay meaningful.
+var library = []Prompt{
+	{ID: "travel-1", Topic: "travel", Text: "Where's the last place you travelled to that completely surprised you?"},
+	{ID: "travel-2", Topic: "travel", Text: "If you could book a one-way ticket tomorrow, where would it be to?"},
+	{ID: "music-1", Topic: "music", Text: "What's the best live show you've ever been to?"},
+	{ID: "music-2", Topic: "music", Text: "What song have you had on repeat lately?"},
+	{ID: "food-1", Topic: "food", Text: "What's the one dish in town you'd take a first-timer to try?"},
+	{ID: "food-2", Topic: "food", Text: "Sweet or savoury breakfast? This decides everything."},
+	{ID: "cooking-1", Topic: "cooking", Text: "What's your signature dish when you're cooking for someone?"},
+	{ID: "cooking-2", Topic: "cooking", Text: "Biggest kitchen disaster you're willing to admit to?"},
+	{ID: "fitness-1", Topic: "fitness", Text: "Morning workout or evening workout, and how do you stay motivated?"},
+	{ID: "fitness-2", Topic: "fitness", Text: "What's a fitness goal you're working towards right now?"},
+	{ID: "outdoors-1", Topic: "outdoors", Text: "What's your favourite spot to get out into nature around here?"},
+	{ID: "outdoors-2", Topic: "outdoors", Text: "Mountains or beach for a weekend away?"},
+	{ID: "pets-1", Topic: "pets", Text: "Important question: tell me about your pet, or the pet you'd love to have."},
+	{ID: "pets-2", Topic: "pets", Text: "Dogs, cats, or are you brave enough to say neither?"},
+	{ID: "books-1", Topic: "books", Text: "What's the last book you couldn't put down?"},
+	{ID: "books-2", Topic: "books", Text: "Which book do you recommend to everyone?"},
+	{ID: "movies-1", Topic: "movies", Text: "What's a film you could rewatch forever?"},
+	{ID: "movies-2", Topic: "movies", Text: "What are you watching at the moment? I need a recommendation."},
+	{ID: "gaming-1", Topic: "gaming", Text: "What game have you sunk the most hours into?"},
+	{ID: "gaming-2", Topic: "gaming", Text: "Co-op or competitive? Choose wisely."},
+	{ID: "art-1", Topic: "art", Text: "What's a piece of art, or a place, that stuck with you?"},
+	{ID: "art-2", Topic: "art", Text: "What are you creating these days?"},
+	{ID: "coffee-1", Topic: "coffee", Text: "What's your go-to coffee order? I'm judging, but kindly."},
+	{ID: "coffee-2", Topic: "coffee", Text: "Best café in town: go."},
+	{ID: "local-1", Topic: "local", Text: "What's your favourite hidden gem in the city?"},
+	{ID: "local-2", Topic: "local", Text: "Where would you take a friend visiting for just one day?"},
+	{ID: "general-1", Text: "What's the best thing that happened to you this week?"},
+	{ID: "general-2", Text: "Two truths and a lie: you go first."},
+	{ID: "general-3", Text: "What's something you're looking forward to this month?"},
+	{ID: "general-4", Text: "What would your perfect Sunday look like?"},
+	{ID: "general-5", Text: "What's a small thing that always makes your day better?"},
+}
+
+var (
+	byID          = make(map[string]Prompt)
+	topicPatterns = make(map[string]*regexp.Regexp)
+)
+
+func init() {
+	for _, prompt := range library {
+		byID[prompt.ID] = prompt
+	}
+
+	for topic, words := range topicKeywords {
+		alternatives := make([]string, len(words))
+		for i, word := range words {
+			if stem, ok := strings.CutSuffix(word, "*"); ok {
+				alternatives[i] = regexp.QuoteMeta(stem) + `\w*`
+			} else {
+				alternatives[i] = regexp.QuoteMeta(word)
+			}
+		}
+		topicPatterns[topic] = regexp.MustCompile(`(?i)\b(?:` + strings.Join(alternatives, "|") + `)\b`)
+	}
+}
+
+// Get returns the prompt with the given ID.
+func Get(id string) (Prompt, bool) {
+	prompt, ok := byID[id]
+	return prompt, ok
+}
+
+// Pick chooses up to n prompts for two matched profiles, at most one per
+// topic: first topics both bios mention, then the members' city if they
+// share it, then topics either bio mentions, then general prompts. The
+// choice within each group is random but stable for the same two people.
+func Pick(a, b *models.Profile, n int) []Prompt {
+	topicsA, topicsB := topicsOf(a), topicsOf(b)
+
+	var shared, either []string
+	for topic := range topicsA {
+		if topicsB[topic] {
+			shared = append(shared, topic)
+		} else {
+			either = append(either, topic)
+		}
+	}
+	for topic := range topicsB {
+		if !topicsA[topic] {
+			either = append(either, topic)
+		}
+	}
+	sort.Strings(shared)
+	sort.Strings(either)
+
+	groups := [][]string{shared}
+	if sameCity(a, b) {
+		groups = append(groups, []string{"local"})
+	}
+	groups = append(groups, either, []string{""})
+
+	rng := rand.New(rand.NewSource(pairSeed(a, b)))
+	var picked []Prompt
+	for _, topics := range groups {
+		rng.Shuffle(len(topics), func(i, j int) { topics[i], topics[j] = topics[j], topics[i] })
+		for _, topic := range topics {
+			candidates := promptsFor(topic)
+			rng.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+
+			// General prompts fill whatever room is left.
+			take := 1
+			if topic == "" {
+				take = len(candidates)
+			}
+			for _, prompt := range candidates[:take] {
+				if len(picked) == n {
+					return picked
+				}
+				picked = append(picked, prompt)
+			}
+		}
+	}
+	return picked
+}
+
+func topicsOf(profile *models.Profile) map[string]bool {
+	topics := make(map[string]bool)
+	if profile == nil || profile.Bio == nil {
+		return topics
+	}
+	for topic, pattern := range topicPatterns {
+		if pattern.MatchString(*profile.Bio) {
+			topics[topic] = true
+		}
+	}
+	return topics
+}
+
+func sameCity(a, b *models.Profile) bool {
+	return a != nil && b != nil && a.LocationCity != nil && b.LocationCity != nil &&
+		*a.LocationCity != "" && strings.EqualFold(*a.LocationCity, *b.LocationCity)
+}
+
+func promptsFor(topic string) []Prompt {
+	var prompts []Prompt
+	for _, prompt := range library {
+		if prompt.Topic == topic {
+			prompts = append(prompts, prompt)
+		}
+	}
+	return prompts
+}
+
+// pairSeed is the same for a and b in either order.
+func pairSeed(a, b *models.Profile) int64 {
+	var ids []string
+	for _, profile := range []*models.Profile{a, b} {
+		if profile != nil {
+			ids = append(ids, profile.UserID.String())
+		}
+	}
+	sort.Strings(ids)
+
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(ids, "|")))
+	return int64(h.Sum64())
+}
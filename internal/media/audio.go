@@ -0,0 +1,417 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	MaxAudioBytes = 5 << 20
+
+	// MaxAudioDuration is the longest voice note that can be sent.
+	MaxAudioDuration = 2 * time.Minute
+	minAudioDuration = 500 * time.Millisecond
+)
+
+// AudioSniffLength is how much of the start of a file IsAudio needs.
+const AudioSniffLength = 64
+
+// mp4AudioBrands are the ftyp major brands of MP4 files browsers and
+// phones record audio in. Video-only and image brands such as HEIC's are
+// rejected outright; the tracks are checked as well.
+var mp4AudioBrands = map[string]bool{
+	"M4A ": true,
+	"mp41": true,
+	"mp42": true,
+	"isom": true,
+	"iso2": true,
+	"iso5": true,
+	"iso6": true,
+}
+
+var (
+	ErrUnsupportedAudio = errors.New("unsupported audio format, use Ogg, WebM or MP4")
+	ErrAudioTooLong     = errors.New("voice notes can be at most 2 minutes long")
+	ErrAudioTooShort    = errors.New("voice note is too short")
+)
+
+// Audio is a validated voice note. Unlike images it is stored as uploaded;
+// the container is only parsed to check it and to read its duration.
+type Audio struct {
+	Data        []byte
+	ContentType string
+	Extension   string
+	Duration    time.Duration
+}
+
+// IsAudio reports whether data looks like one of the audio containers that
+// browsers record voice notes in. Only the first AudioSniffLength bytes are
+// looked at, so uploads can be routed before they are read in full;
+// ProcessAudio checks the tracks inside.
+func IsAudio(data []byte) bool {
+	return audioFormat(data) != ""
+}
+
+func audioFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "ogg"
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "webm"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp" && mp4AudioBrands[string(data[8:12])]:
+		return "mp4"
+	default:
+		return ""
+	}
+}
+
+// ProcessAudio validates an uploaded voice note and reads its duration.
+func ProcessAudio(data []byte) (*Audio, error) {
+	if len(data) > MaxAudioBytes {
+		return nil, ErrFileTooLarge
+	}
+
+	out := &Audio{Data: data}
+	var err error
+	switch audioFormat(data) {
+	case "ogg":
+		out.ContentType, out.Extension = "audio/ogg", ".ogg"
+		out.Duration, err = oggDuration(data)
+	case "webm":
+		out.ContentType, out.Extension = "audio/webm", ".webm"
+		out.Duration, err = webmDuration(data)
+	case "mp4":
+		out.ContentType, out.Extension = "audio/mp4", ".m4a"
+		out.Duration, err = mp4Duration(data)
+	default:
+		return nil, ErrUnsupportedAudio
+	}
+	if err != nil {
+		return nil, ErrUnsupportedAudio
+	}
+
+	if out.Duration > MaxAudioDuration {
+		return nil, ErrAudioTooLong
+	}
+	if out.Duration < minAudioDuration {
+		return nil, ErrAudioTooShort
+	}
+	return out, nil
+}
+
+// oggDuration reads an Ogg Opus or Vorbis stream's duration from the
+// granule position of its last page. Files with any other stream, such as
+// Theora video, are rejected.
+func oggDuration(data []byte) (time.Duration, error) {
+	if !oggAudioOnly(data) {
+		return 0, ErrUnsupportedAudio
+	}
+
+	// The first page carries the codec's identification header.
+	segments := int(data[26])
+	body := 27 + segments
+	if len(data) < body+19 {
+		return 0, ErrUnsupportedAudio
+	}
+	head := data[body:]
+
+	var rate, preSkip int64
+	switch {
+	case bytes.HasPrefix(head, []byte("OpusHead")):
+		// Opus granule positions always count 48 kHz samples.
+		rate = 48000
+		preSkip = int64(binary.LittleEndian.Uint16(head[10:12]))
+	case bytes.HasPrefix(head, []byte("\x01vorbis")):
+		rate = int64(binary.LittleEndian.Uint32(head[12:16]))
+	default:
+		return 0, ErrUnsupportedAudio
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || len(data) < last+14 || data[last+4] != 0 || rate == 0 {
+		return 0, ErrUnsupportedAudio
+	}
+	granule := int64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+	if granule < preSkip {
+		return 0, ErrUnsupportedAudio
+	}
+
+	return seconds(float64(granule-preSkip) / float64(rate)), nil
+}
+
+// oggAudioOnly walks the pages of an Ogg file and reports whether the
+// first page of every stream in it starts an Opus or Vorbis stream.
+func oggAudioOnly(data []byte) bool {
+	streams := 0
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 27 || string(data[pos:pos+4]) != "OggS" {
+			return false
+		}
+		segments := int(data[pos+26])
+		if len(data)-pos < 27+segments {
+			return false
+		}
+		size := 0
+		for _, lacing := range data[pos+27 : pos+27+segments] {
+			size += int(lacing)
+		}
+		body := pos + 27 + segments
+		if len(data)-body < size {
+			return false
+		}
+
+		// Bit 2 of the header type marks the first page of a stream.
+		if data[pos+5]&0x02 != 0 {
+			payload := data[body : body+size]
+			if !bytes.HasPrefix(payload, []byte("OpusHead")) && !bytes.HasPrefix(payload, []byte("\x01vorbis")) {
+				return false
+			}
+			streams++
+		}
+		pos = body + size
+	}
+	return streams > 0
+}
+
+// WebM element IDs used to find the duration and check the tracks.
+const (
+	ebmlHeader        = 0x1A45DFA3
+	ebmlDocType       = 0x4282
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlTrackType     = 0x83
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlCluster       = 0x1F43B675
+	ebmlTimecode      = 0xE7
+	ebmlSimpleBlock   = 0xA3
+	ebmlBlockGroup    = 0xA0
+	ebmlBlock         = 0xA1
+)
+
+// webmTrackAudio is the TrackType of an audio track.
+const webmTrackAudio = 2
+
+// webmDuration reads a WebM file's duration and checks that every track in
+// it is audio. Browsers' MediaRecorder does not write the Duration
+// element, so when it is missing the duration is taken from the timestamp
+// of the last block instead.
+//
+// The elements are walked flat: the container elements on the path to the
+// blocks and track types are entered rather than skipped, which also copes
+// with the unknown sizes recorders write for Segment and Cluster.
+func webmDuration(data []byte) (time.Duration, error) {
+	scale := int64(time.Millisecond)
+	var declared float64
+	var cluster, latest int64
+	sawBlock := false
+	var docType string
+	audioTracks, otherTracks := 0, 0
+
+	pos := 0
+	for pos < len(data) {
+		id, n := readVint(data[pos:], true)
+		if n == 0 {
+			break
+		}
+		pos += n
+		size, n := readVint(data[pos:], false)
+		if n == 0 {
+			break
+		}
+		pos += n
+
+		switch id {
+		case ebmlHeader, ebmlSegment, ebmlInfo, ebmlTracks, ebmlTrackEntry, ebmlCluster, ebmlBlockGroup:
+			continue
+		}
+
+		// Other elements are skipped; unknown or truncated sizes end the walk.
+		if size < 0 || int64(len(data)-pos) < size {
+			break
+		}
+		payload := data[pos : pos+int(size)]
+		pos += int(size)
+
+		switch id {
+		case ebmlDocType:
+			docType = string(bytes.TrimRight(payload, "\x00"))
+		case ebmlTrackType:
+			if readUint(payload) == webmTrackAudio {
+				audioTracks++
+			} else {
+				otherTracks++
+			}
+		case ebmlTimecodeScale:
+			scale = int64(readUint(payload))
+		case ebmlDuration:
+			switch len(payload) {
+			case 4:
+				declared = float64(math.Float32frombits(binary.BigEndian.Uint32(payload)))
+			case 8:
+				declared = math.Float64frombits(binary.BigEndian.Uint64(payload))
+			}
+		case ebmlTimecode:
+			cluster = int64(readUint(payload))
+		case ebmlSimpleBlock, ebmlBlock:
+			_, n := readVint(payload, false)
+			if n == 0 || len(payload) < n+2 {
+				continue
+			}
+			t := cluster + int64(int16(binary.BigEndian.Uint16(payload[n:n+2])))
+			if !sawBlock || t > latest {
+				latest = t
+			}
+			sawBlock = true
+		}
+	}
+
+	if docType != "webm" || audioTracks == 0 || otherTracks > 0 || scale <= 0 {
+		return 0, ErrUnsupportedAudio
+	}
+	if declared > 0 {
+		return seconds(declared * float64(scale) / float64(time.Second)), nil
+	}
+	if !sawBlock {
+		return 0, ErrUnsupportedAudio
+	}
+	return seconds(float64(latest) * float64(scale) / float64(time.Second)), nil
+}
+
+// readVint reads an EBML variable length integer and returns it with its
+// length in bytes, or a length of 0 if data is malformed. IDs keep their
+// length marker; sizes drop it, and an all-ones size is returned as -1.
+func readVint(data []byte, keepMarker bool) (int64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(data) < length {
+		return 0, 0
+	}
+
+	first := data[0]
+	if !keepMarker {
+		first &= 0xFF >> length
+	}
+	value := int64(first)
+	allOnes := first == 0xFF>>length
+	for _, b := range data[1:length] {
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return -1, length
+	}
+	return value, length
+}
+
+func readUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// mp4Duration reads the duration from an MP4's movie header box. Every
+// track must be a sound track.
+func mp4Duration(data []byte) (time.Duration, error) {
+	moov := findBox(data, "moov")
+	if moov == nil {
+		return 0, ErrUnsupportedAudio
+	}
+	traks := findBoxes(moov, "trak")
+	if len(traks) == 0 {
+		return 0, ErrUnsupportedAudio
+	}
+	for _, trak := range traks {
+		hdlr := findBox(findBox(trak, "mdia"), "hdlr")
+		if len(hdlr) < 12 || string(hdlr[8:12]) != "soun" {
+			return 0, ErrUnsupportedAudio
+		}
+	}
+	mvhd := findBox(moov, "mvhd")
+	if len(mvhd) < 4 {
+		return 0, ErrUnsupportedAudio
+	}
+
+	var timescale, duration uint64
+	switch mvhd[0] {
+	case 0:
+		if len(mvhd) < 20 {
+			return 0, ErrUnsupportedAudio
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	case 1:
+		if len(mvhd) < 32 {
+			return 0, ErrUnsupportedAudio
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	default:
+		return 0, ErrUnsupportedAudio
+	}
+	if timescale == 0 {
+		return 0, ErrUnsupportedAudio
+	}
+
+	return seconds(float64(duration) / float64(timescale)), nil
+}
+
+// seconds converts s to a Duration, saturating instead of overflowing on
+// the absurd values a crafted file can declare.
+func seconds(s float64) time.Duration {
+	if s >= float64(math.MaxInt64)/float64(time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+// findBox returns the payload of the first box of type name among the
+// boxes in data.
+func findBox(data []byte, name string) []byte {
+	if boxes := findBoxes(data, name); len(boxes) > 0 {
+		return boxes[0]
+	}
+	return nil
+}
+
+// findBoxes returns the payloads of every box of type name among the boxes
+// in data, stopping at the first malformed box.
+func findBoxes(data []byte, name string) [][]byte {
+	var boxes [][]byte
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+
+		if string(data[4:8]) == name {
+			boxes = append(boxes, data[header:size])
+		}
+		data = data[size:]
+	}
+	return boxes
+}
@@ -0,0 +1,112 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// box builds an MP4 box of type name around the given children.
+func box(name string, children ...[]byte) []byte {
+	payload := bytes.Join(children, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(out, name...), payload...)
+}
+
+// encodeMP4 builds a 3 second MP4 with the given major brand and one track
+// per handler type.
+func encodeMP4(brand string, handlers ...string) []byte {
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:16], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:20], 3000)
+
+	moov := [][]byte{box("mvhd", mvhd)}
+	for _, handler := range handlers {
+		hdlr := append(make([]byte, 8), handler...)
+		moov = append(moov, box("trak", box("mdia", box("hdlr", hdlr))))
+	}
+	ftyp := append([]byte(brand), 0, 0, 0, 0)
+	return append(box("ftyp", ftyp), box("moov", moov...)...)
+}
+
+// element builds an EBML element; every ID used here is written with its
+// length marker, so it is stored as is.
+func element(id uint32, children ...[]byte) []byte {
+	payload := bytes.Join(children, nil)
+	idBytes := binary.BigEndian.AppendUint32(nil, id)
+	for len(idBytes) > 1 && idBytes[0] == 0 {
+		idBytes = idBytes[1:]
+	}
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(payload)))
+	size[0] = 0x01
+	return append(append(idBytes, size...), payload...)
+}
+
+// encodeWebM builds a 3 second WebM with one track per track type.
+func encodeWebM(docType string, trackTypes ...byte) []byte {
+	var tracks [][]byte
+	for _, trackType := range trackTypes {
+		tracks = append(tracks, element(ebmlTrackEntry, element(ebmlTrackType, []byte{trackType})))
+	}
+	duration := binary.BigEndian.AppendUint64(nil, 0x40A7700000000000) // 3000.0
+	return append(
+		element(ebmlHeader, element(ebmlDocType, []byte(docType))),
+		element(ebmlSegment,
+			element(ebmlInfo, element(ebmlDuration, duration)),
+			element(ebmlTracks, tracks...),
+		)...,
+	)
+}
+
+func TestProcessAudioMP4(t *testing.T) {
+	audio, err := ProcessAudio(encodeMP4("M4A ", "soun"))
+	if err != nil {
+		t.Fatalf("audio MP4 rejected: %v", err)
+	}
+	if audio.ContentType != "audio/mp4" || audio.Duration != 3*time.Second {
+		t.Errorf("got %s %v, want audio/mp4 3s", audio.ContentType, audio.Duration)
+	}
+}
+
+func TestProcessAudioRejectsMP4Video(t *testing.T) {
+	cases := map[string][]byte{
+		"video track":      encodeMP4("isom", "vide"),
+		"video and sound":  encodeMP4("mp42", "soun", "vide"),
+		"no tracks":        encodeMP4("M4A "),
+		"HEIC image brand": encodeMP4("heic", "pict"),
+	}
+	for name, data := range cases {
+		if _, err := ProcessAudio(data); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("%s: got %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+	if IsAudio(encodeMP4("heic", "pict")) {
+		t.Error("HEIC sniffed as audio")
+	}
+}
+
+func TestProcessAudioWebM(t *testing.T) {
+	audio, err := ProcessAudio(encodeWebM("webm", webmTrackAudio))
+	if err != nil {
+		t.Fatalf("audio WebM rejected: %v", err)
+	}
+	if audio.ContentType != "audio/webm" || audio.Duration != 3*time.Second {
+		t.Errorf("got %s %v, want audio/webm 3s", audio.ContentType, audio.Duration)
+	}
+}
+
+func TestProcessAudioRejectsWebMVideo(t *testing.T) {
+	cases := map[string][]byte{
+		"video track":     encodeWebM("webm", 1),
+		"video and audio": encodeWebM("webm", webmTrackAudio, 1),
+		"no tracks":       encodeWebM("webm"),
+		"matroska":        encodeWebM("matroska", webmTrackAudio),
+	}
+	for name, data := range cases {
+		if _, err := ProcessAudio(data); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("%s: got %v, want ErrUnsupportedAudio", name, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	MaxImageBytes = 10 << 20
+
+	// maxImagePixels guards against decompression bombs; it is checked
+	// from the header before the image is decoded.
+	maxImagePixels = 40_000_000
+
+	// maxImageDimension is the longest side of a stored still image.
+	maxImageDimension = 1600
+
+	// Animated GIFs are not resized, so they are limited instead. Decoding
+	// allocates a byte per pixel of every frame, so the frames' total area
+	// is capped as well as their number.
+	maxGIFDimension   = 1024
+	maxGIFFrames      = 300
+	maxGIFTotalPixels = 50_000_000
+
+	jpegQuality = 85
+)
+
+var (
+	ErrFileTooLarge     = errors.New("file is too large")
+	ErrUnsupportedImage = errors.New("unsupported image format, use JPEG, PNG or GIF")
+	ErrImageTooLarge    = errors.New("image dimensions are too large")
+)
+
+// Image is an upload that has been validated and re-encoded. Re-encoding
+// drops EXIF and any other metadata the original carried.
+type Image struct {
+	Data        []byte
+	ContentType string
+	Extension   string
+	Width       int
+	Height      int
+}
+
+// ProcessImage validates an uploaded chat image, applies its EXIF
+// orientation, scales it down to maxImageDimension and re-encodes it.
+func ProcessImage(data []byte) (*Image, error) {
+	if len(data) > MaxImageBytes {
+		return nil, ErrFileTooLarge
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+
+	switch format {
+	case "jpeg", "png":
+		return processStill(data, format)
+	case "gif":
+		return processGIF(data)
+	default:
+		return nil, ErrUnsupportedImage
+	}
+}
+
+func processStill(data []byte, format string) (*Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	img = fit(img, maxImageDimension)
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	var buf bytes.Buffer
+	out := &Image{Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	if format == "png" {
+		err = png.Encode(&buf, img)
+		out.ContentType, out.Extension = "image/png", ".png"
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		out.ContentType, out.Extension = "image/jpeg", ".jpg"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out.Data = buf.Bytes()
+	return out, nil
+}
+
+func processGIF(data []byte) (*Image, error) {
+	if err := checkGIF(data); err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+
+	return &Image{
+		Data:        buf.Bytes(),
+		ContentType: "image/gif",
+		Extension:   ".gif",
+		Width:       g.Config.Width,
+		Height:      g.Config.Height,
+	}, nil
+}
+
+// checkGIF walks a GIF's blocks without decompressing any image data and
+// rejects it before decoding if the canvas is too large, it has too many
+// frames, a frame lies outside the canvas, or the frames' total area is
+// over maxGIFTotalPixels.
+func checkGIF(data []byte) error {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return ErrUnsupportedImage
+	}
+	width, height := int(le16(data[6:])), int(le16(data[8:]))
+	if width > maxGIFDimension || height > maxGIFDimension {
+		return ErrImageTooLarge
+	}
+
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	frames, pixels := 0, 0
+	for {
+		if pos >= len(data) {
+			return ErrUnsupportedImage
+		}
+		block := data[pos]
+		pos++
+
+		switch block {
+		case 0x21: // extension: a label, then sub-blocks
+			if pos >= len(data) {
+				return ErrUnsupportedImage
+			}
+			var ok bool
+			if pos, ok = skipSubBlocks(data, pos+1); !ok {
+				return ErrUnsupportedImage
+			}
+
+		case 0x2C: // image descriptor
+			if pos+9 > len(data) {
+				return ErrUnsupportedImage
+			}
+			left, top := int(le16(data[pos:])), int(le16(data[pos+2:]))
+			w, h := int(le16(data[pos+4:])), int(le16(data[pos+6:]))
+			flags := data[pos+8]
+			pos += 9
+
+			if left+w > width || top+h > height {
+				return ErrImageTooLarge
+			}
+			frames++
+			pixels += w * h
+			if frames > maxGIFFrames || pixels > maxGIFTotalPixels {
+				return ErrImageTooLarge
+			}
+
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// Skip the LZW minimum code size, then the compressed data.
+			var ok bool
+			if pos, ok = skipSubBlocks(data, pos+1); !ok {
+				return ErrUnsupportedImage
+			}
+
+		case 0x3B: // trailer
+			if frames == 0 {
+				return ErrUnsupportedImage
+			}
+			return nil
+
+		default:
+			return ErrUnsupportedImage
+		}
+	}
+}
+
+// skipSubBlocks returns the position after the sub-blocks starting at pos,
+// which end with an empty one.
+func skipSubBlocks(data []byte, pos int) (int, bool) {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos, true
+		}
+		pos += size
+	}
+	return pos, false
+}
+
+func le16(b []byte) uint16 {
+	return uint16(b[0]) | uint16(b[1])<<8
+}
+
+// fit scales img down so neither side exceeds limit, keeping its aspect ratio.
+func fit(img image.Image, limit int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= limit && h <= limit {
+		return img
+	}
+
+	if w >= h {
+		h = h * limit / w
+		w = limit
+	} else {
+		w = w * limit / h
+		h = limit
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
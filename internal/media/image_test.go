@@ -0,0 +1,75 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// encodeGIF encodes frames copies of one uniform size×size frame. Uniform
+// frames compress to a few kilobytes however large they are.
+func encodeGIF(t *testing.T, size, frames int) []byte {
+	t.Helper()
+	frame := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.Black, color.White})
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessGIF(t *testing.T) {
+	img, err := ProcessImage(encodeGIF(t, 64, 10))
+	if err != nil {
+		t.Fatalf("valid GIF rejected: %v", err)
+	}
+	if img.ContentType != "image/gif" || img.Width != 64 || img.Height != 64 {
+		t.Errorf("got %s %dx%d, want image/gif 64x64", img.ContentType, img.Width, img.Height)
+	}
+}
+
+func TestProcessGIFRejectsBeforeDecoding(t *testing.T) {
+	// 60 full 1024×1024 frames are about 63M pixels to decode from a file
+	// of a few hundred kilobytes.
+	bomb := encodeGIF(t, maxGIFDimension, 60)
+	if len(bomb) > MaxImageBytes {
+		t.Fatalf("test GIF is %d bytes, over the upload limit", len(bomb))
+	}
+
+	tests := map[string][]byte{
+		"total frame area": bomb,
+		"frame count":      encodeGIF(t, 8, maxGIFFrames+1),
+		"canvas size":      encodeGIF(t, maxGIFDimension+1, 1),
+	}
+	for name, data := range tests {
+		if err := checkGIF(data); !errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("%s: checkGIF returned %v, want ErrImageTooLarge", name, err)
+		}
+	}
+}
+
+func TestCheckGIFFrameOutsideCanvas(t *testing.T) {
+	data := encodeGIF(t, 16, 1)
+	// Grow the first frame's width past the 16px canvas.
+	i := bytes.IndexByte(data[13:], 0x2C) + 13
+	data[i+5] = 32
+	if err := checkGIF(data); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("checkGIF returned %v, want ErrImageTooLarge", err)
+	}
+}
+
+func TestCheckGIFTruncated(t *testing.T) {
+	data := encodeGIF(t, 16, 2)
+	if err := checkGIF(data[:len(data)-10]); !errors.Is(err, ErrUnsupportedImage) {
+		t.Errorf("checkGIF returned %v, want ErrUnsupportedImage", err)
+	}
+}
@@ -0,0 +1,46 @@
+package media
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/auth"
+	"dating-svelte/internal/models"
+)
+
+// attachmentURLTTL is how long a signed attachment URL stays valid. URLs are
+// only ever handed to the two members of the attachment's match.
+const attachmentURLTTL = time.Hour
+
+// AttachmentURL returns a signed, expiring URL for an attachment that works
+// without an Authorization header, so it can be used directly in <img src>.
+func AttachmentURL(id uuid.UUID) string {
+	expires := strconv.FormatInt(time.Now().Add(attachmentURLTTL).Unix(), 10)
+	return fmt.Sprintf("/api/v1/attachments/%s?expires=%s&sig=%s", id, expires, auth.SignValue(signedValue(id, expires)))
+}
+
+// SignAttachments sets a fresh signed URL on every loaded attachment.
+func SignAttachments(messages []models.Message) {
+	for i := range messages {
+		if messages[i].Attachment != nil {
+			messages[i].Attachment.URL = AttachmentURL(messages[i].Attachment.ID)
+		}
+	}
+}
+
+// VerifyAttachmentURL checks the expires and sig query parameters of a URL
+// produced by AttachmentURL.
+func VerifyAttachmentURL(id uuid.UUID, expires, sig string) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return auth.VerifySignedValue(signedValue(id, expires), sig)
+}
+
+func signedValue(id uuid.UUID, expires string) string {
+	return "attachment:" + id.String() + ":" + expires
+}
@@ -2,8 +2,10 @@ package middleware
 
 import (
     "strings"
+    "time"
     
     "github.com/gofiber/fiber/v2"
+    "github.com/google/uuid"
     "dating-svelte/internal/auth"
 )
 
@@ -37,6 +39,37 @@ func AuthRequired() fiber.Handler {
         c.Locals("user_id", claims.UserID)
         c.Locals("user_email", claims.Email)
         c.Locals("is_premium", claims.IsPremium)
+        if claims.ExpiresAt != nil {
+            c.Locals("token_expires_at", claims.ExpiresAt.Time)
+        }
+        
+        return c.Next()
+    }
+}
+
+// TicketRedeemer consumes a websocket ticket, given its hash, and returns
+// the user it was issued to and when that user's access token expires.
+type TicketRedeemer func(ticketHash string) (uuid.UUID, time.Time, error)
+
+// WebSocketAuth authenticates a websocket handshake. Browsers cannot set
+// headers on one, so they pass a single-use ticket as the "ticket" query
+// parameter; other clients may keep sending an Authorization header.
+func WebSocketAuth(redeem TicketRedeemer) fiber.Handler {
+    return func(c *fiber.Ctx) error {
+        ticket := c.Query("ticket")
+        if ticket == "" {
+            return AuthRequired()(c)
+        }
+        
+        userID, tokenExpiresAt, err := redeem(auth.HashTicket(ticket))
+        if err != nil {
+            return c.Status(401).JSON(fiber.Map{
+                "error": "Invalid or expired ticket",
+            })
+        }
+        
+        c.Locals("user_id", userID)
+        c.Locals("token_expires_at", tokenExpiresAt)
         
         return c.Next()
     }
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,11 +17,21 @@ type User struct {
 	GDPRConsent   bool       `json:"gdpr_consent" db:"gdpr_consent"`
 	GDPRConsentAt *time.Time `json:"gdpr_consent_at" db:"gdpr_consent_at"`
 	LastActive    time.Time  `json:"last_active" db:"last_active"`
+	IsOnline      bool       `json:"-" db:"is_online"`
+	HideOnline    bool       `json:"hide_online_status" db:"hide_online_status"`
 	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
 	Profile       *Profile   `json:"profile,omitempty"`
 }
 
+// Presence is what a user may see of a match's online status. Users who
+// hide their status are always reported offline, without LastSeen.
+type Presence struct {
+	UserID   uuid.UUID  `json:"user_id" db:"user_id"`
+	Online   bool       `json:"online" db:"online"`
+	LastSeen *time.Time `json:"last_seen" db:"last_seen"`
+}
+
 type Profile struct {
 	UserID          uuid.UUID      `json:"user_id" db:"user_id"`
 	DisplayName     string         `json:"display_name" db:"display_name"`
@@ -57,25 +68,213 @@ type Swipe struct {
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
+// Match is a mutual like. A match with ExpiresAt set is deactivated at that
+// time unless a message has been sent in it by then.
 type Match struct {
+	ID             uuid.UUID  `json:"id" db:"id"`
+	User1ID        uuid.UUID  `json:"user1_id" db:"user1_id"`
+	User2ID        uuid.UUID  `json:"user2_id" db:"user2_id"`
+	MatchedAt      time.Time  `json:"matched_at" db:"matched_at"`
+	IsActive       bool       `json:"is_active" db:"is_active"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	ExpiryWarnedAt *time.Time `json:"-" db:"expiry_warned_at"`
+	ExtendedAt     *time.Time `json:"extended_at,omitempty" db:"extended_at"`
+	User1          *Profile   `json:"user1,omitempty"`
+	User2          *Profile   `json:"user2,omitempty"`
+}
+
+// MatchNote is a private note a user keeps on one of their matches. Only
+// its author can see it.
+type MatchNote struct {
 	ID        uuid.UUID `json:"id" db:"id"`
-	User1ID   uuid.UUID `json:"user1_id" db:"user1_id"`
-	User2ID   uuid.UUID `json:"user2_id" db:"user2_id"`
-	MatchedAt time.Time `json:"matched_at" db:"matched_at"`
-	IsActive  bool      `json:"is_active" db:"is_active"`
+	MatchID   uuid.UUID `json:"match_id" db:"match_id"`
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Body      string    `json:"body" db:"body"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	User1     *Profile  `json:"user1,omitempty"`
-	User2     *Profile  `json:"user2,omitempty"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// MatchSummary is a match as listed on the matches screen, seen by one of
+// its members: the other member's profile, the latest message and that
+// member's conversation state. LastActivityAt is the time of the latest
+// message, or MatchedAt. ExpiresAt is only set while the match is waiting
+// for its first message.
+type MatchSummary struct {
+	ID                  uuid.UUID  `json:"id" db:"id"`
+	MatchedAt           time.Time  `json:"matched_at" db:"matched_at"`
+	IsActive            bool       `json:"is_active" db:"is_active"`
+	OtherUser           Profile    `json:"other_user" db:"other_user"`
+	LastMessage         string     `json:"last_message" db:"last_message"`
+	LastMessageType     *string    `json:"last_message_type" db:"last_message_type"`
+	LastMessageSenderID *uuid.UUID `json:"last_message_sender_id" db:"last_message_sender_id"`
+	LastMessageAt       *time.Time `json:"last_message_at" db:"last_message_at"`
+	UnreadCount         int        `json:"unread_count" db:"unread_count"`
+	Muted               bool       `json:"muted" db:"muted"`
+	Archived            bool       `json:"archived" db:"archived"`
+	Pinned              bool       `json:"pinned" db:"pinned"`
+	LastActivityAt      time.Time  `json:"last_activity_at" db:"last_activity_at"`
+	ExpiresAt           *time.Time `json:"expires_at" db:"expires_at"`
+	Extended            bool       `json:"extended" db:"extended"`
 }
 
 type Message struct {
+	ID           uuid.UUID   `json:"id" db:"id"`
+	MatchID      uuid.UUID   `json:"match_id" db:"match_id"`
+	SenderID     uuid.UUID   `json:"sender_id" db:"sender_id"`
+	ClientID     *string     `json:"client_id,omitempty" db:"client_id"` // sender's temporary ID, for deduplication
+	Message      string      `json:"message" db:"message"`
+	MessageType  string      `json:"message_type" db:"message_type"`
+	AttachmentID *uuid.UUID  `json:"attachment_id,omitempty" db:"attachment_id"`
+	CallID       *uuid.UUID  `json:"call_id,omitempty" db:"call_id"` // set on call history entries
+	IcebreakerID *string     `json:"icebreaker_id,omitempty" db:"icebreaker_id"`
+	DatePlanID   *uuid.UUID  `json:"date_plan_id,omitempty" db:"date_plan_id"` // set on date proposals and replies
+	Status       string      `json:"status" db:"status"`                       // sent, delivered or read
+	IsRead       bool        `json:"is_read" db:"is_read"`
+	DeliveredAt  *time.Time  `json:"delivered_at" db:"delivered_at"`
+	ReadAt       *time.Time  `json:"read_at" db:"read_at"`
+	RecipientSeq *int64      `json:"-" db:"recipient_seq"` // recipient's realtime sequence number, for resume
+	EditedAt     *time.Time  `json:"edited_at" db:"edited_at"`
+	DeletedAt    *time.Time  `json:"deleted_at" db:"deleted_at"` // set on unsent messages, whose content is cleared
+	CreatedAt    time.Time   `json:"created_at" db:"created_at"`
+	Attachment   *Attachment `json:"attachment,omitempty" db:"-"`
+	Reactions    []Reaction  `json:"reactions,omitempty" db:"-"`
+}
+
+// DatePlan is a date proposed inside a conversation. Status is "proposed"
+// until the other member accepts, declines or counters it; a counter is a
+// new plan whose CounterOf is the plan it answers.
+type DatePlan struct {
+	ID          uuid.UUID  `json:"id" db:"id"`
+	MatchID     uuid.UUID  `json:"match_id" db:"match_id"`
+	ProposerID  uuid.UUID  `json:"proposer_id" db:"proposer_id"`
+	ScheduledAt time.Time  `json:"scheduled_at" db:"scheduled_at"`
+	PlaceName   string     `json:"place_name" db:"place_name"`
+	Latitude    *float64   `json:"latitude,omitempty" db:"latitude"`
+	Longitude   *float64   `json:"longitude,omitempty" db:"longitude"`
+	Status      string     `json:"status" db:"status"`
+	CounterOf   *uuid.UUID `json:"counter_of,omitempty" db:"counter_of"`
+	RespondedAt *time.Time `json:"responded_at,omitempty" db:"responded_at"`
+	RemindedAt  *time.Time `json:"-" db:"reminded_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// SafetyCheckIn is a check-in a user scheduled for a date. If they have
+// not confirmed they are OK shortly after CheckInAt, their trusted contact
+// is alerted. Status is "scheduled", "confirmed", "alerted" or
+// "cancelled".
+type SafetyCheckIn struct {
+	ID           uuid.UUID  `json:"id" db:"id"`
+	DatePlanID   uuid.UUID  `json:"date_plan_id" db:"date_plan_id"`
+	UserID       uuid.UUID  `json:"user_id" db:"user_id"`
+	ContactName  string     `json:"contact_name" db:"contact_name"`
+	ContactEmail *string    `json:"contact_email,omitempty" db:"contact_email"`
+	ContactPhone *string    `json:"contact_phone,omitempty" db:"contact_phone"`
+	ShareDetails bool       `json:"share_details" db:"share_details"`
+	CheckInAt    time.Time  `json:"check_in_at" db:"check_in_at"`
+	Status       string     `json:"status" db:"status"`
+	PromptedAt   *time.Time `json:"prompted_at,omitempty" db:"prompted_at"`
+	ConfirmedAt  *time.Time `json:"confirmed_at,omitempty" db:"confirmed_at"`
+	AlertedAt    *time.Time `json:"alerted_at,omitempty" db:"alerted_at"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Report is a user reporting another to the moderators. Reports made
+// from a conversation keep the match and, if the reporter chose to attach
+// it, a signed transcript of the conversation at the time.
+type Report struct {
+	ID          uuid.UUID        `json:"id" db:"id"`
+	ReporterID  uuid.UUID        `json:"reporter_id" db:"reporter_id"`
+	ReportedID  uuid.UUID        `json:"reported_id" db:"reported_id"`
+	MatchID     *uuid.UUID       `json:"match_id,omitempty" db:"match_id"`
+	Reason      string           `json:"reason" db:"reason"`
+	Description *string          `json:"description,omitempty" db:"description"`
+	Transcript  *json.RawMessage `json:"transcript,omitempty" db:"transcript"`
+	Status      string           `json:"status" db:"status"`
+	CreatedAt   time.Time        `json:"created_at" db:"created_at"`
+}
+
+// UpcomingDate is an accepted date plan as listed for one of its members,
+// with the other member's name and avatar.
+type UpcomingDate struct {
+	DatePlan
+	OtherUserID        uuid.UUID `json:"other_user_id" db:"other_user_id"`
+	OtherUserName      string    `json:"other_user_name" db:"other_user_name"`
+	OtherUserAvatarURL *string   `json:"other_user_avatar_url" db:"other_user_avatar_url"`
+}
+
+// Call is an audio or video call between the members of a match. Media
+// flows peer to peer; the server only relays signaling and tracks state.
+type Call struct {
+	ID       uuid.UUID `json:"id" db:"id"`
+	MatchID  uuid.UUID `json:"match_id" db:"match_id"`
+	CallerID uuid.UUID `json:"caller_id" db:"caller_id"`
+	CalleeID uuid.UUID `json:"callee_id" db:"callee_id"`
+	Video    bool      `json:"video" db:"video"`
+	// The websocket connections that placed and answered the call.
+	CallerConnection *uuid.UUID `json:"-" db:"caller_connection"`
+	CalleeConnection *uuid.UUID `json:"-" db:"callee_connection"`
+	Status           string     `json:"status" db:"status"` // ringing, active, ended, missed, cancelled, declined or busy
+	StartedAt        time.Time  `json:"started_at" db:"started_at"`
+	AnsweredAt       *time.Time `json:"answered_at" db:"answered_at"`
+	EndedAt          *time.Time `json:"ended_at" db:"ended_at"`
+}
+
+// MessageSearchResult is a message matching a search. Snippet is HTML
+// escaped, with the matched terms wrapped in <mark> tags.
+type MessageSearchResult struct {
+	MessageID uuid.UUID `json:"message_id" db:"message_id"`
+	MatchID   uuid.UUID `json:"match_id" db:"match_id"`
+	SenderID  uuid.UUID `json:"sender_id" db:"sender_id"`
+	Snippet   string    `json:"snippet" db:"snippet"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Reaction aggregates every user's use of one emoji on a message.
+type Reaction struct {
+	MessageID uuid.UUID      `json:"-" db:"message_id"`
+	Emoji     string         `json:"emoji" db:"emoji"`
+	Count     int            `json:"count" db:"count"`
+	UserIDs   pq.StringArray `json:"user_ids" db:"user_ids"`
+}
+
+// MessageEdit is a previous version of an edited or unsent message. Edit
+// history is kept for moderation and is never shown to the recipient.
+type MessageEdit struct {
+	ID              uuid.UUID  `json:"id" db:"id"`
+	MessageID       uuid.UUID  `json:"message_id" db:"message_id"`
+	Action          string     `json:"action" db:"action"` // edit or delete
+	PreviousMessage string     `json:"previous_message" db:"previous_message"`
+	AttachmentID    *uuid.UUID `json:"attachment_id,omitempty" db:"attachment_id"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+}
+
+// MessageFlag queues a message for moderation because a content screening
+// rule matched it. OriginalMessage is the text before any masking.
+type MessageFlag struct {
+	ID              uuid.UUID      `json:"id" db:"id"`
+	MessageID       uuid.UUID      `json:"message_id" db:"message_id"`
+	SenderID        uuid.UUID      `json:"sender_id" db:"sender_id"`
+	Rules           pq.StringArray `json:"rules" db:"rules"`
+	OriginalMessage string         `json:"original_message" db:"original_message"`
+	Status          string         `json:"status" db:"status"`
+	CreatedAt       time.Time      `json:"created_at" db:"created_at"`
+}
+
+// Attachment is a file uploaded into a conversation. It is only served to
+// the two members of its match, through a signed URL.
+type Attachment struct {
 	ID          uuid.UUID `json:"id" db:"id"`
 	MatchID     uuid.UUID `json:"match_id" db:"match_id"`
-	SenderID    uuid.UUID `json:"sender_id" db:"sender_id"`
-	Message     string    `json:"message" db:"message"`
-	MessageType string    `json:"message_type" db:"message_type"`
-	IsRead      bool      `json:"is_read" db:"is_read"`
+	UploaderID  uuid.UUID `json:"uploader_id" db:"uploader_id"`
+	StorageKey  string    `json:"-" db:"storage_key"`
+	ContentType string    `json:"content_type" db:"content_type"`
+	Width       int       `json:"width" db:"width"`
+	Height      int       `json:"height" db:"height"`
+	DurationMs  *int      `json:"duration_ms,omitempty" db:"duration_ms"` // audio only
+	SizeBytes   int64     `json:"size_bytes" db:"size_bytes"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	URL         string    `json:"url,omitempty" db:"-"`
 }
 
 type Subscription struct {
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Email sends messages through an SMTP server, by default the one set by
+// SMTP_HOST, SMTP_PORT, SMTP_USER and SMTP_PASS.
+type Email struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (e *Email) Notify(to Contact, msg Message) error {
+	if to.Email == "" {
+		return ErrUnreachable
+	}
+
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, e.Password, e.Host)
+	}
+
+	// Header values come from user input, so line breaks are removed to
+	// keep them from adding headers.
+	clean := strings.NewReplacer("\r", "", "\n", " ")
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		e.From, clean.Replace(to.Email), clean.Replace(msg.Subject), msg.Body)
+
+	return smtp.SendMail(net.JoinHostPort(e.Host, e.Port), auth, e.From, []string{to.Email}, []byte(body))
+}
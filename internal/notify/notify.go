@@ -0,0 +1,58 @@
+// Package notify delivers messages to people outside the app, such as a
+// user's trusted contact, by email or SMS.
+package notify
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnreachable is returned by a Notifier that has no way to reach a
+// contact, for example an email notifier given a contact without an email
+// address.
+var ErrUnreachable = errors.New("contact cannot be reached by this notifier")
+
+// Contact is a person outside the app. Either address may be empty.
+type Contact struct {
+	Name  string
+	Email string
+	Phone string // E.164, e.g. +447700900123
+}
+
+// Message is a notification. Subject is only used by channels that have
+// one, such as email.
+type Message struct {
+	Subject string
+	Body    string
+}
+
+// Notifier delivers a message to a contact.
+type Notifier interface {
+	Notify(to Contact, msg Message) error
+}
+
+// Multi sends through every notifier that can reach the contact. It only
+// fails if none of them delivered the message.
+type Multi []Notifier
+
+func (m Multi) Notify(to Contact, msg Message) error {
+	var errs []error
+	delivered := false
+	for _, n := range m {
+		err := n.Notify(to, msg)
+		switch {
+		case err == nil:
+			delivered = true
+		case !errors.Is(err, ErrUnreachable):
+			errs = append(errs, err)
+		}
+	}
+
+	if delivered {
+		return nil
+	}
+	if len(errs) == 0 {
+		return ErrUnreachable
+	}
+	return fmt.Errorf("notify: %w", errors.Join(errs...))
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"errors"
+	"testing"
+)
+
+type failing struct{ err error }
+
+func (f failing) Notify(Contact, Message) error {
+	return f.err
+}
+
+func TestMulti(t *testing.T) {
+	refused := errors.New("connection refused")
+	gateway := errors.New("sms gateway returned 502 Bad Gateway")
+	email := Contact{Name: "Sam", Email: "sam@example.com"}
+
+	tests := []struct {
+		name      string
+		notifiers func(stub *Stub) Multi
+		contact   Contact
+		delivered int
+		wantErrs  []error
+	}{
+		{
+			name:      "one failure is not fatal",
+			notifiers: func(stub *Stub) Multi { return Multi{failing{refused}, stub} },
+			contact:   email,
+			delivered: 1,
+		},
+		{
+			name:      "no notifier reaches the contact",
+			notifiers: func(stub *Stub) Multi { return Multi{failing{ErrUnreachable}, stub} },
+			contact:   Contact{Name: "Sam"},
+			wantErrs:  []error{ErrUnreachable},
+		},
+		{
+			name:      "every failure is reported",
+			notifiers: func(*Stub) Multi { return Multi{failing{refused}, failing{ErrUnreachable}, failing{gateway}} },
+			contact:   email,
+			wantErrs:  []error{refused, gateway},
+		},
+		{
+			name:      "empty",
+			notifiers: func(*Stub) Multi { return nil },
+			contact:   email,
+			wantErrs:  []error{ErrUnreachable},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := NewStub()
+			err := tt.notifiers(stub).Notify(tt.contact, Message{Body: "hello"})
+
+			if n := len(stub.Messages()); n != tt.delivered {
+				t.Errorf("stub delivered %d messages, want %d", n, tt.delivered)
+			}
+			if len(tt.wantErrs) == 0 && err != nil {
+				t.Fatalf("got %v, want delivered", err)
+			}
+			if len(tt.wantErrs) > 0 && err == nil {
+				t.Fatal("got nil, want an error")
+			}
+			for _, want := range tt.wantErrs {
+				if !errors.Is(err, want) {
+					t.Errorf("%v does not wrap %v", err, want)
+				}
+			}
+			if len(tt.wantErrs) > 1 && errors.Is(err, ErrUnreachable) {
+				t.Errorf("%v wraps ErrUnreachable although a notifier was reachable", err)
+			}
+		})
+	}
+}
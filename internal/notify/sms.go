@@ -0,0 +1,53 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SMS sends text messages through an HTTP gateway. Each message is POSTed
+// to URL as {"to": "+44...", "body": "..."} with Token as a bearer token,
+// which most SMS providers accept directly or through a small adapter.
+type SMS struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func NewSMS(url, token string) *SMS {
+	return &SMS{URL: url, Token: token, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *SMS) Notify(to Contact, msg Message) error {
+	if to.Phone == "" {
+		return ErrUnreachable
+	}
+
+	payload, err := json.Marshal(map[string]string{"to": to.Phone, "body": msg.Body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+// Log logs messages, with the contact's address redacted, instead of
+// sending them. Use it in development.
+type Log struct{}
+
+func (Log) Notify(to Contact, msg Message) error {
+	if to.Email == "" && to.Phone == "" {
+		return ErrUnreachable
+	}
+
+	log.Printf("notify: to %s <%s%s>: %s", to.Name, redactEmail(to.Email), redactPhone(to.Phone), msg.Body)
+	return nil
+}
+
+// Stub is a Log that also keeps every message for inspection. Use it in
+// tests; it never forgets a message.
+type Stub struct {
+	mu   sync.Mutex
+	sent []Sent
+}
+
+// Sent is a message the stub was asked to deliver.
+type Sent struct {
+	To      Contact
+	Message Message
+}
+
+func NewStub() *Stub {
+	return &Stub{}
+}
+
+func (s *Stub) Notify(to Contact, msg Message) error {
+	if err := (Log{}).Notify(to, msg); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.sent = append(s.sent, Sent{To: to, Message: msg})
+	s.mu.Unlock()
+	return nil
+}
+
+// redactEmail keeps the first letter and domain of an address for the
+// logs, e.g. "s***@example.com".
+func redactEmail(email string) string {
+	at := strings.LastIndexByte(email, '@')
+	if at < 1 {
+		return redactPhone(email)
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// redactPhone keeps the last two digits of a number for the logs, e.g.
+// "***23".
+func redactPhone(phone string) string {
+	if len(phone) <= 2 {
+		return phone
+	}
+	return "***" + phone[len(phone)-2:]
+}
+
+// Messages returns every message the stub has been asked to deliver.
+func (s *Stub) Messages() []Sent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Sent(nil), s.sent...)
+}
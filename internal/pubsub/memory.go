@@ -0,0 +1,35 @@
+package pubsub
+
+import "sync"
+
+// MemoryBroker delivers events within a single process. Use it when only
+// one app replica is running.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(event Event) error {
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler Handler) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
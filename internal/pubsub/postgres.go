@@ -0,0 +1,163 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"dating-svelte/internal/database"
+)
+
+const (
+	notifyChannel = "realtime_events"
+
+	// Postgres rejects NOTIFY payloads of 8000 bytes or more. Larger events
+	// are spilled into the realtime_events table and sent by reference.
+	maxNotifyPayload = 7900
+
+	spilledEventTTL = 5 * time.Minute
+	pingInterval    = 90 * time.Second
+)
+
+// notification is the wire format of a NOTIFY payload.
+type notification struct {
+	UserID    uuid.UUID       `json:"user_id"`
+	Seq       int64           `json:"seq,omitempty"`
+	Persisted bool            `json:"persisted,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Ref       int64           `json:"ref,omitempty"`
+}
+
+// PostgresBroker relays events between replicas with LISTEN/NOTIFY. Every
+// replica listens on the same channel, so an event published anywhere
+// reaches the replica holding the recipient's connection.
+type PostgresBroker struct {
+	db       *database.DB
+	listener *pq.Listener
+	mu       sync.RWMutex
+	handlers []Handler
+	done     chan struct{}
+}
+
+func NewPostgresBroker(db *database.DB, dsn string) (*PostgresBroker, error) {
+	b := &PostgresBroker{
+		db:   db,
+		done: make(chan struct{}),
+	}
+
+	b.listener = pq.NewListener(dsn, 10*time.Second, time.Minute, logListenerEvent)
+	if err := b.listener.Listen(notifyChannel); err != nil {
+		b.listener.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", notifyChannel, err)
+	}
+
+	go b.run()
+	return b, nil
+}
+
+func (b *PostgresBroker) Publish(event Event) error {
+	n := notification{
+		UserID:    event.UserID,
+		Seq:       event.Seq,
+		Persisted: event.Persisted,
+		Payload:   event.Payload,
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	if len(body) > maxNotifyPayload {
+		ref, err := b.db.CreateRealtimeEvent(event.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to spill realtime event: %w", err)
+		}
+		n.Payload = nil
+		n.Ref = ref
+		body, _ = json.Marshal(n)
+	}
+
+	return b.db.Notify(notifyChannel, string(body))
+}
+
+func (b *PostgresBroker) Subscribe(handler Handler) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+}
+
+func (b *PostgresBroker) Close() error {
+	close(b.done)
+	return b.listener.Close()
+}
+
+func (b *PostgresBroker) run() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// The listener reconnected; anything sent meanwhile is gone.
+				log.Printf("pubsub: listener reconnected, events may have been missed")
+				continue
+			}
+			b.dispatch(n.Extra)
+
+		case <-ticker.C:
+			go b.listener.Ping()
+			if err := b.db.DeleteRealtimeEventsBefore(time.Now().Add(-spilledEventTTL)); err != nil {
+				log.Printf("pubsub: failed to clean up spilled events: %v", err)
+			}
+
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *PostgresBroker) dispatch(raw string) {
+	var n notification
+	if err := json.Unmarshal([]byte(raw), &n); err != nil {
+		log.Printf("pubsub: dropping malformed notification: %v", err)
+		return
+	}
+
+	if n.Ref != 0 {
+		payload, err := b.db.GetRealtimeEvent(n.Ref)
+		if err != nil {
+			log.Printf("pubsub: failed to load spilled event %d: %v", n.Ref, err)
+			return
+		}
+		n.Payload = payload
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	event := Event{
+		UserID:    n.UserID,
+		Seq:       n.Seq,
+		Persisted: n.Persisted,
+		Payload:   n.Payload,
+	}
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+func logListenerEvent(ev pq.ListenerEventType, err error) {
+	if err != nil {
+		log.Printf("pubsub: listener event %d: %v", ev, err)
+	}
+}
@@ -0,0 +1,32 @@
+package pubsub
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// Event is a realtime frame addressed to a single user. Every replica that
+// holds a connection for UserID delivers Payload to it; uuid.Nil addresses
+// every connected user.
+//
+// Seq is the recipient's per-user sequence number, or 0 for broadcasts.
+// Persisted events can be rebuilt from the database, so replicas don't keep
+// them in their replay buffers.
+type Event struct {
+	UserID    uuid.UUID       `json:"user_id"`
+	Seq       int64           `json:"seq,omitempty"`
+	Persisted bool            `json:"persisted,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Handler receives every event published through a broker, including the
+// ones published by this process.
+type Handler func(Event)
+
+// Broker fans realtime events out to all app replicas.
+type Broker interface {
+	Publish(event Event) error
+	Subscribe(handler Handler)
+	Close() error
+}
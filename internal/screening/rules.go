@@ -0,0 +1,212 @@
+package screening
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	// phonePattern matches digit groups joined by one kind of separator,
+	// optionally after a +country code and an (area code). phoneFilter
+	// then keeps the matches that have 7 to 15 digits and are not dates.
+	phonePattern = `(?:\+\d{1,3}[ \-.]?)?(?:\(\d{1,4}\)[ \-]?)?\d{1,6}(?:(?: \d{1,6})+|(?:-\d{1,6})+|(?:\.\d{1,6})+)|\+?\d{7,15}`
+
+	emailPattern = `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`
+
+	// linkPattern matches URLs, www. hosts, and lowercase domains on TLDs
+	// that show up in off-platform scams when a path follows them. A bare
+	// "word.me" is too often just a missing space after a full stop.
+	linkPattern = `(?i:\bhttps?://|\bwww\.)\S+|\b[a-z0-9\-]+(?:\.[a-z0-9\-]+)*\.(?:com|net|org|io|me|co|ly|gg|app|link|xyz|info|biz|ru|tk|to|cc)/\S*`
+)
+
+// defaultRules is the screening.json shipped with the server.
+//
+//go:embed screening.json
+var defaultRules []byte
+
+// Rule is the config file form of a filter. Kind is one of "phone",
+// "email", "link", "keywords" (Words, matched as whole words ignoring case)
+// or "pattern" (Pattern, a Go regular expression). Reason is shown to the
+// sender when a blocking rule matches.
+type Rule struct {
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"`
+	Action  Action   `json:"action"`
+	Words   []string `json:"words,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+type ruleFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// regexpFilter is the Filter behind every built-in rule kind.
+type regexpFilter struct {
+	rule Rule
+	re   *regexp.Regexp
+}
+
+func (f *regexpFilter) Name() string   { return f.rule.Name }
+func (f *regexpFilter) Action() Action { return f.rule.Action }
+func (f *regexpFilter) Reason() string { return f.rule.Reason }
+
+func (f *regexpFilter) Find(text string) [][]int {
+	return f.re.FindAllStringIndex(text, -1)
+}
+
+// NewFilter compiles a rule.
+func NewFilter(rule Rule) (Filter, error) {
+	if rule.Name == "" {
+		return nil, fmt.Errorf("screening rule has no name")
+	}
+	switch rule.Action {
+	case Block, Mask, Flag:
+	default:
+		return nil, fmt.Errorf("screening rule %q: unknown action %q", rule.Name, rule.Action)
+	}
+
+	var pattern string
+	switch rule.Kind {
+	case "phone":
+		pattern = phonePattern
+	case "email":
+		pattern = emailPattern
+	case "link":
+		pattern = linkPattern
+	case "keywords":
+		// An empty alternative would match at every word boundary.
+		var words []string
+		for _, word := range rule.Words {
+			if word = strings.TrimSpace(word); word != "" {
+				words = append(words, regexp.QuoteMeta(word))
+			}
+		}
+		if len(words) == 0 {
+			return nil, fmt.Errorf("screening rule %q has no words", rule.Name)
+		}
+		pattern = `(?i)\b(?:` + strings.Join(words, "|") + `)\b`
+	case "pattern":
+		pattern = rule.Pattern
+	default:
+		return nil, fmt.Errorf("screening rule %q: unknown kind %q", rule.Name, rule.Kind)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("screening rule %q: %w", rule.Name, err)
+	}
+	if rule.Kind == "phone" {
+		return &phoneFilter{regexpFilter{rule: rule, re: re}}, nil
+	}
+	return &regexpFilter{rule: rule, re: re}, nil
+}
+
+// phoneFilter drops phone pattern matches that are too short or too long
+// to be a phone number, or that read as a date or a run of years.
+type phoneFilter struct {
+	regexpFilter
+}
+
+func (f *phoneFilter) Find(text string) [][]int {
+	var spans [][]int
+	for _, span := range f.re.FindAllStringIndex(text, -1) {
+		if isPhoneNumber(text[span[0]:span[1]]) {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func isPhoneNumber(match string) bool {
+	digits := 0
+	for _, r := range match {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	if digits < 7 || digits > 15 {
+		return false
+	}
+
+	// Numbers written with a country or area code are not dates.
+	if strings.ContainsAny(match, "+(") {
+		return true
+	}
+	groups := strings.FieldsFunc(match, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '.'
+	})
+	return !isDate(groups) && !isYears(groups)
+}
+
+// isDate reports whether groups read as day, month and year in either
+// order, like 12.05.2023 or 2023-05-12.
+func isDate(groups []string) bool {
+	if len(groups) != 3 {
+		return false
+	}
+	a, b, c := len(groups[0]), len(groups[1]), len(groups[2])
+	return (a <= 2 && b <= 2 && (c == 2 || c == 4)) || (a == 4 && b <= 2 && c <= 2)
+}
+
+// isYears reports whether every group is a year, like 2019 2020.
+func isYears(groups []string) bool {
+	if len(groups) < 2 {
+		return false
+	}
+	for _, g := range groups {
+		if len(g) != 4 || !(strings.HasPrefix(g, "19") || strings.HasPrefix(g, "20")) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewChainFromRules compiles rules into a chain, keeping their order.
+func NewChainFromRules(rules []Rule) (*Chain, error) {
+	filters := make([]Filter, 0, len(rules))
+	for _, rule := range rules {
+		f, err := NewFilter(rule)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return NewChain(filters...), nil
+}
+
+// LoadRules reads a JSON rules file of the form {"rules": [...]}.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := parseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func parseRules(data []byte) ([]Rule, error) {
+	var file ruleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.Rules, nil
+}
+
+// DefaultRules are used when no rules file is configured. They are the
+// screening.json in this package, embedded at build time.
+func DefaultRules() []Rule {
+	rules, err := parseRules(defaultRules)
+	if err != nil {
+		panic("screening: embedded screening.json is invalid: " + err.Error())
+	}
+	return rules
+}
@@ -0,0 +1,103 @@
+package screening
+
+import (
+	"errors"
+	"testing"
+)
+
+func defaultChain(t *testing.T) *Chain {
+	t.Helper()
+	chain, err := NewChainFromRules(DefaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func TestDefaultRulesLoad(t *testing.T) {
+	rules := DefaultRules()
+	if len(rules) == 0 {
+		t.Fatal("embedded screening.json has no rules")
+	}
+	if rules[0].Name != "crypto_address" {
+		t.Errorf("first rule %q, want crypto_address", rules[0].Name)
+	}
+}
+
+func TestScreenLeavesOrdinaryTextAlone(t *testing.T) {
+	chain := defaultChain(t)
+	for _, text := range []string{
+		"Sounds good.Me too",
+		"back soon.to be fair",
+		"I was there.Co-workers too",
+		"We met on 12.05.2023 at the park",
+		"Born 1990-04-21",
+		"I lived there 2019 2020 and 2021",
+		"I worked there 2019-2020",
+		"Call me at 5pm, I'm 28",
+	} {
+		result, err := chain.Screen(text)
+		if err != nil {
+			t.Errorf("%q blocked: %v", text, err)
+			continue
+		}
+		if result.Text != text {
+			t.Errorf("%q screened to %q", text, result.Text)
+		}
+	}
+}
+
+func TestScreenBlocksLinks(t *testing.T) {
+	chain := defaultChain(t)
+	for _, text := range []string{
+		"see https://example.org",
+		"go to WWW.EXAMPLE.ORG now",
+		"t.me/someone",
+		"find me at bit.ly/abc123",
+	} {
+		if _, err := chain.Screen(text); !errors.Is(err, ErrBlocked) {
+			t.Errorf("%q not blocked", text)
+		}
+	}
+}
+
+func TestScreenMasksPhoneNumbers(t *testing.T) {
+	chain := defaultChain(t)
+	tests := map[string]string{
+		"call 555-123-4567":            "call ************",
+		"call (555) 123-4567 tonight":  "call ************** tonight",
+		"+44 20 7946 0958":             "****************",
+		"text 5551234567":              "text **********",
+		"555.123.4567 or 555 123 4567": "************ or ************",
+		"on 12.05.2023 call 555 1234":  "on 12.05.2023 call ********",
+	}
+	for text, want := range tests {
+		result, err := chain.Screen(text)
+		if err != nil {
+			t.Errorf("%q blocked: %v", text, err)
+			continue
+		}
+		if result.Text != want {
+			t.Errorf("%q screened to %q, want %q", text, result.Text, want)
+		}
+	}
+}
+
+func TestKeywordsSkipBlankWords(t *testing.T) {
+	filter, err := NewFilter(Rule{Name: "scams", Kind: "keywords", Action: Block, Words: []string{" ", "scam", ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spans := filter.Find("hello there"); len(spans) != 0 {
+		t.Errorf("ordinary text matched at %v", spans)
+	}
+	if spans := filter.Find("not a Scam"); len(spans) != 1 {
+		t.Errorf("keyword matched %d times, want once", len(spans))
+	}
+
+	for _, words := range [][]string{nil, {""}, {" ", "\t"}} {
+		if _, err := NewFilter(Rule{Name: "empty", Kind: "keywords", Action: Block, Words: words}); err == nil {
+			t.Errorf("keywords %q accepted", words)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package screening
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Screener holds the active chain and reloads it when its rules file
+// changes, so rules can be tuned without restarting the server.
+type Screener struct {
+	path    string
+	mu      sync.RWMutex
+	chain   *Chain
+	modTime time.Time
+}
+
+// NewScreener loads rules from path, or uses DefaultRules when path is
+// empty.
+func NewScreener(path string) (*Screener, error) {
+	s := &Screener{path: path}
+
+	if path == "" {
+		chain, err := NewChainFromRules(DefaultRules())
+		if err != nil {
+			return nil, err
+		}
+		s.chain = chain
+		return s, nil
+	}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Screener) Screen(text string) (Result, error) {
+	s.mu.RLock()
+	chain := s.chain
+	s.mu.RUnlock()
+
+	return chain.Screen(text)
+}
+
+// Watch checks the rules file every interval and reloads it when it has
+// been modified. A file that fails to load is logged and the previous rules
+// stay active. It never returns.
+func (s *Screener) Watch(interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			log.Printf("screening: failed to stat %s: %v", s.path, err)
+			continue
+		}
+
+		s.mu.RLock()
+		changed := !info.ModTime().Equal(s.modTime)
+		s.mu.RUnlock()
+
+		if changed {
+			if err := s.reload(); err != nil {
+				log.Printf("screening: keeping previous rules: %v", err)
+				continue
+			}
+			log.Printf("screening: reloaded rules from %s", s.path)
+		}
+	}
+}
+
+func (s *Screener) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	rules, err := LoadRules(s.path)
+	if err != nil {
+		return err
+	}
+	chain, err := NewChainFromRules(rules)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.chain = chain
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package screening checks chat messages against trust & safety rules
+// before they are stored. Each rule finds spans of text and decides whether
+// the message is blocked, the spans are masked, or the message is delivered
+// as is and flagged for moderation.
+package screening
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type Action string
+
+const (
+	Block Action = "block"
+	Mask  Action = "mask"
+	Flag  Action = "flag"
+)
+
+const defaultBlockReason = "This message can't be sent because it goes against our community guidelines"
+
+// ErrBlocked matches every *BlockedError with errors.Is.
+var ErrBlocked = errors.New("message blocked by content screening")
+
+// BlockedError is returned for a message a blocking rule matched. Its text
+// is safe to show to the sender.
+type BlockedError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return e.Reason
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// Filter is a single screening rule. Find returns the byte ranges of text
+// the rule matched, as [start, end) pairs.
+type Filter interface {
+	Name() string
+	Action() Action
+	Find(text string) [][]int
+}
+
+// Result is the outcome of screening a message that was not blocked. Text
+// is the message with masked spans replaced; Flags lists the rules that
+// want the message reviewed.
+type Result struct {
+	Text  string
+	Flags []string
+}
+
+// Chain runs filters in order. The first blocking match stops the chain,
+// and each filter sees the text as masked by the filters before it.
+type Chain struct {
+	filters []Filter
+}
+
+func NewChain(filters ...Filter) *Chain {
+	return &Chain{filters: filters}
+}
+
+func (c *Chain) Screen(text string) (Result, error) {
+	var flags []string
+
+	for _, f := range c.filters {
+		spans := f.Find(text)
+		if len(spans) == 0 {
+			continue
+		}
+
+		switch f.Action() {
+		case Block:
+			reason := defaultBlockReason
+			if r, ok := f.(interface{ Reason() string }); ok && r.Reason() != "" {
+				reason = r.Reason()
+			}
+			return Result{}, &BlockedError{Rule: f.Name(), Reason: reason}
+		case Mask:
+			text = mask(text, spans)
+		case Flag:
+			flags = append(flags, f.Name())
+		}
+	}
+
+	return Result{Text: text, Flags: flags}, nil
+}
+
+// mask replaces every character covered by spans with an asterisk.
+func mask(text string, spans [][]int) string {
+	if len(spans) == 0 {
+		return text
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i][0] < spans[j][0]
+	})
+
+	var b strings.Builder
+	pos := 0
+	for _, span := range spans {
+		start, end := span[0], span[1]
+		if end <= pos {
+			continue
+		}
+		if start < pos {
+			start = pos
+		}
+		b.WriteString(text[pos:start])
+		b.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[start:end])))
+		pos = end
+	}
+	b.WriteString(text[pos:])
+	return b.String()
+}
@@ -0,0 +1,276 @@
+// Package transcript exports a conversation as a signed, timestamped
+// snapshot, in JSON or plain text. Reports attach one so moderators see
+// what was sent even if messages are later unsent.
+package transcript
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/auth"
+	"dating-svelte/internal/database"
+	"dating-svelte/internal/models"
+)
+
+// Version is the transcript format version.
+const Version = 1
+
+// The server signs other values, such as attachment URLs, with the same
+// key, so transcript signatures cover a SHA-256 digest behind a prefix no
+// other signed value starts with. JSON and text exports get their own.
+const (
+	jsonDomain = "transcript:v1:"
+	textDomain = "transcript-text:v1:"
+
+	textSignatureLine = "\nSignature (HMAC-SHA256 of the text above): "
+)
+
+var ErrInvalidSignature = errors.New("transcript signature does not match its contents")
+
+// Transcript is a snapshot of a conversation taken by one of its members.
+// Signature is an HMAC-SHA256, by the server's key, of the digest of the
+// transcript's JSON encoding with Signature left empty.
+type Transcript struct {
+	Version      int           `json:"version"`
+	MatchID      uuid.UUID     `json:"match_id"`
+	ExportedBy   uuid.UUID     `json:"exported_by"`
+	ExportedAt   time.Time     `json:"exported_at"`
+	Participants []Participant `json:"participants"`
+	Messages     []Entry       `json:"messages"`
+	Signature    string        `json:"signature,omitempty"`
+}
+
+type Participant struct {
+	UserID      uuid.UUID `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+}
+
+// Entry is one message as it stood when the transcript was taken. Unsent
+// messages keep their place with empty text and DeletedAt set. History
+// holds what the message said before each edit and when it was unsent,
+// oldest first, so the transcript shows everything that was sent.
+type Entry struct {
+	ID           uuid.UUID  `json:"id"`
+	SenderID     uuid.UUID  `json:"sender_id"`
+	Type         string     `json:"type"`
+	Text         string     `json:"text"`
+	AttachmentID *uuid.UUID `json:"attachment_id,omitempty"`
+	SentAt       time.Time  `json:"sent_at"`
+	EditedAt     *time.Time `json:"edited_at,omitempty"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	History      []Revision `json:"history,omitempty"`
+}
+
+// Revision is an earlier version of a message. Action is "edit" or
+// "delete", and ReplacedAt is when the message was edited or unsent.
+type Revision struct {
+	Action       string     `json:"action"`
+	Text         string     `json:"text"`
+	AttachmentID *uuid.UUID `json:"attachment_id,omitempty"`
+	ReplacedAt   time.Time  `json:"replaced_at"`
+}
+
+// Build takes a signed snapshot of every message in match for exportedBy,
+// who must be one of its members.
+func Build(db *database.DB, match *models.Match, exportedBy uuid.UUID) (*Transcript, error) {
+	messages, err := db.GetMatchMessages(match.ID)
+	if err != nil {
+		return nil, err
+	}
+	edits, err := db.GetMatchMessageEdits(match.ID)
+	if err != nil {
+		return nil, err
+	}
+	history := make(map[uuid.UUID][]Revision)
+	for _, edit := range edits {
+		history[edit.MessageID] = append(history[edit.MessageID], Revision{
+			Action:       edit.Action,
+			Text:         edit.PreviousMessage,
+			AttachmentID: edit.AttachmentID,
+			ReplacedAt:   edit.CreatedAt.UTC(),
+		})
+	}
+
+	t := &Transcript{
+		Version:    Version,
+		MatchID:    match.ID,
+		ExportedBy: exportedBy,
+		ExportedAt: time.Now().UTC(),
+		Messages:   make([]Entry, 0, len(messages)),
+	}
+
+	for _, userID := range []uuid.UUID{match.User1ID, match.User2ID} {
+		participant := Participant{UserID: userID}
+		if profile, err := db.GetProfile(userID); err == nil {
+			participant.DisplayName = profile.DisplayName
+		}
+		t.Participants = append(t.Participants, participant)
+	}
+
+	for _, message := range messages {
+		t.Messages = append(t.Messages, Entry{
+			ID:           message.ID,
+			SenderID:     message.SenderID,
+			Type:         message.MessageType,
+			Text:         message.Message,
+			AttachmentID: message.AttachmentID,
+			SentAt:       message.CreatedAt.UTC(),
+			EditedAt:     utc(message.EditedAt),
+			DeletedAt:    utc(message.DeletedAt),
+			History:      history[message.ID],
+		})
+	}
+
+	if err := t.sign(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Transcript) sign() error {
+	payload, err := t.unsigned()
+	if err != nil {
+		return err
+	}
+	t.Signature = signature(jsonDomain, payload)
+	return nil
+}
+
+// Verify reports whether t was signed by this server and is unchanged.
+func (t *Transcript) Verify() bool {
+	payload, err := t.unsigned()
+	if err != nil {
+		return false
+	}
+	return auth.VerifySignedValue(signedValue(jsonDomain, payload), t.Signature)
+}
+
+// Verify checks a transcript in either export format, as downloaded or as
+// attached to a report, and returns ErrInvalidSignature if it was not
+// signed by this server or has been changed since. A JSON transcript with
+// fields or data the signature does not cover is rejected rather than
+// having them dropped before checking.
+func Verify(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var t Transcript
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&t); err != nil {
+			return fmt.Errorf("transcript: %w", err)
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return fmt.Errorf("transcript: unexpected data after the transcript")
+		}
+		if !t.Verify() {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	text := strings.TrimSuffix(string(data), "\n")
+	at := strings.LastIndex(text, textSignatureLine)
+	if at < 0 {
+		return ErrInvalidSignature
+	}
+	body, sig := text[:at], text[at+len(textSignatureLine):]
+	if !auth.VerifySignedValue(signedValue(textDomain, []byte(body)), sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func signature(domain string, payload []byte) string {
+	return auth.SignValue(signedValue(domain, payload))
+}
+
+func signedValue(domain string, payload []byte) string {
+	digest := sha256.Sum256(payload)
+	return domain + hex.EncodeToString(digest[:])
+}
+
+func (t *Transcript) unsigned() ([]byte, error) {
+	unsigned := *t
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Text renders the transcript for reading, one message per line, followed
+// by a signature of everything above it.
+func (t *Transcript) Text() string {
+	names := make(map[uuid.UUID]string, len(t.Participants))
+	var members []string
+	for _, p := range t.Participants {
+		if p.DisplayName == "" {
+			names[p.UserID] = p.UserID.String()
+			members = append(members, p.UserID.String())
+			continue
+		}
+		names[p.UserID] = p.DisplayName
+		members = append(members, fmt.Sprintf("%s (%s)", p.DisplayName, p.UserID))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Conversation between %s\n", strings.Join(members, " and "))
+	fmt.Fprintf(&b, "Match: %s\n", t.MatchID)
+	fmt.Fprintf(&b, "Exported by %s at %s\n\n", names[t.ExportedBy], formatTime(t.ExportedAt))
+
+	for _, e := range t.Messages {
+		fmt.Fprintf(&b, "[%s] %s: %s\n", formatTime(e.SentAt), names[e.SenderID], entryText(e))
+		for _, r := range e.History {
+			action := "edited"
+			if r.Action == "delete" {
+				action = "unsent"
+			}
+			fmt.Fprintf(&b, "    %s at %s, previously: %s\n", action, formatTime(r.ReplacedAt),
+				strings.ReplaceAll(messageText(e.Type, r.Text), "\n", "\n        "))
+		}
+	}
+
+	body := b.String()
+	return body + textSignatureLine + signature(textDomain, []byte(body)) + "\n"
+}
+
+func entryText(e Entry) string {
+	if e.DeletedAt != nil {
+		return "(unsent at " + formatTime(*e.DeletedAt) + ")"
+	}
+
+	// Keep one message per line.
+	text := strings.ReplaceAll(messageText(e.Type, e.Text), "\n", "\n    ")
+
+	if e.EditedAt != nil {
+		text += " (edited at " + formatTime(*e.EditedAt) + ")"
+	}
+	return text
+}
+
+// messageText marks media and dates by type, followed by any caption.
+func messageText(messageType, text string) string {
+	switch messageType {
+	case "text", "call", "icebreaker":
+		return text
+	default:
+		return strings.TrimSpace("[" + messageType + "] " + text)
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
@@ -0,0 +1,135 @@
+package transcript
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/auth"
+)
+
+func signedTranscript(t *testing.T) *Transcript {
+	t.Helper()
+	alice, bob := uuid.New(), uuid.New()
+	edited := time.Date(2024, 6, 14, 19, 3, 0, 0, time.UTC)
+	tr := &Transcript{
+		Version:      Version,
+		MatchID:      uuid.New(),
+		ExportedBy:   alice,
+		ExportedAt:   time.Date(2024, 6, 14, 19, 30, 0, 0, time.UTC),
+		Participants: []Participant{{UserID: alice, DisplayName: "Alice"}, {UserID: bob, DisplayName: "Bob"}},
+		Messages: []Entry{
+			{ID: uuid.New(), SenderID: alice, Type: "text", Text: "Hi!", SentAt: time.Date(2024, 6, 14, 19, 0, 0, 0, time.UTC)},
+			{ID: uuid.New(), SenderID: bob, Type: "text", Text: "Hey\nthere", SentAt: time.Date(2024, 6, 14, 19, 1, 0, 0, time.UTC)},
+			{
+				ID: uuid.New(), SenderID: bob, Type: "text", Text: "See you there",
+				SentAt:   time.Date(2024, 6, 14, 19, 2, 0, 0, time.UTC),
+				EditedAt: &edited,
+				History: []Revision{
+					{Action: "edit", Text: "See you at mine", ReplacedAt: edited},
+				},
+			},
+		},
+	}
+	if err := tr.sign(); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestVerifyJSON(t *testing.T) {
+	tr := signedTranscript(t)
+	data, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(data); err != nil {
+		t.Fatalf("signed transcript rejected: %v", err)
+	}
+
+	tr.Messages[1].Text = "Hey"
+	tampered, _ := json.Marshal(tr)
+	if err := Verify(tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("edited transcript: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestVerifyJSONRejectsUncoveredData(t *testing.T) {
+	data, err := json.Marshal(signedTranscript(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fields the transcript does not have would be dropped before the
+	// signature is checked, so they must fail rather than pass unsigned.
+	injected := strings.Replace(string(data), `"text":"Hi!"`, `"text":"Hi!","note":"they threatened me"`, 1)
+	if injected == string(data) {
+		t.Fatal("test transcript has no message to inject into")
+	}
+	if err := Verify([]byte(injected)); err == nil {
+		t.Error("transcript with an unknown field accepted")
+	}
+
+	if err := Verify(append(data, ` {"version":1}`...)); err == nil {
+		t.Error("transcript with trailing data accepted")
+	}
+}
+
+func TestVerifyCoversHistory(t *testing.T) {
+	tr := signedTranscript(t)
+
+	text := tr.Text()
+	if !strings.Contains(text, "    edited at 2024-06-14 19:03:00 UTC, previously: See you at mine\n") {
+		t.Errorf("text export is missing the edit history:\n%s", text)
+	}
+	tampered := strings.Replace(text, "See you at mine", "See you there", 1)
+	if err := Verify([]byte(tampered)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("text with edited history: got %v, want ErrInvalidSignature", err)
+	}
+
+	tr.Messages[2].History = nil
+	stripped, _ := json.Marshal(tr)
+	if err := Verify(stripped); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("JSON with history removed: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestVerifyText(t *testing.T) {
+	text := signedTranscript(t).Text()
+	if err := Verify([]byte(text)); err != nil {
+		t.Fatalf("signed text rejected: %v", err)
+	}
+
+	tampered := strings.Replace(text, "Hi!", "Bye", 1)
+	if err := Verify([]byte(tampered)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("edited text: got %v, want ErrInvalidSignature", err)
+	}
+	if err := Verify([]byte("Conversation between nobody\n")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("unsigned text: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestSignatureIsDomainSeparated(t *testing.T) {
+	tr := signedTranscript(t)
+	payload, err := tr.unsigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain signature of the same bytes, as other signed values get,
+	// must not pass for a transcript signature.
+	tr.Signature = auth.SignValue(string(payload))
+	if tr.Verify() {
+		t.Error("undomained signature accepted")
+	}
+
+	// Nor may a text signature pass for a JSON one.
+	tr.Signature = signature(textDomain, payload)
+	if tr.Verify() {
+		t.Error("text signature accepted for JSON")
+	}
+}
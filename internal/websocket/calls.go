@@ -0,0 +1,238 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+)
+
+const (
+	// callRingTimeout is how long a call rings before it is missed.
+	callRingTimeout = 30 * time.Second
+
+	// maxCallDuration bounds how long an answered call that was never hung
+	// up, for example because its replica died, keeps its members busy. A
+	// ringing call stops counting after callRingTimeout.
+	maxCallDuration = 4 * time.Hour
+)
+
+var ErrCallNotFound = errors.New("call not found or already over")
+
+// StartCall places a call from client's user to the other member of the
+// match and relays the SDP offer to every device of the callee. If either
+// member is already on a call, the caller gets a "call_end" with status
+// "busy" straight away. Calls that are not answered within callRingTimeout
+// are missed.
+func (h *Hub) StartCall(client *Client, matchID uuid.UUID, video bool, offer SessionDescription) (*models.Call, error) {
+	calleeID, err := h.matchPartner(matchID, client.userID)
+	if err != nil {
+		return nil, err
+	}
+
+	call := &models.Call{
+		ID:               uuid.New(),
+		MatchID:          matchID,
+		CallerID:         client.userID,
+		CalleeID:         calleeID,
+		Video:            video,
+		CallerConnection: &client.id,
+	}
+	rang, err := h.db.StartCall(call, callRingTimeout, maxCallDuration)
+	if err != nil {
+		return nil, err
+	}
+	if !rang {
+		h.callEnded(call)
+		return call, nil
+	}
+
+	h.sendToClient(client, callFrame("call_state", call, call.CallerID, call))
+	h.SendToUser(calleeID, Message{
+		Type:      "call_offer",
+		MatchID:   &matchID,
+		CallID:    &call.ID,
+		UserID:    &call.CallerID,
+		Video:     &call.Video,
+		Timestamp: time.Now(),
+		Data:      offer,
+	})
+
+	time.AfterFunc(callRingTimeout, func() {
+		missed, err := h.db.MissCall(call.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return // answered or hung up in time
+		}
+		if err != nil {
+			log.Printf("Failed to time out call %s: %v", call.ID, err)
+			return
+		}
+		h.callEnded(missed)
+	})
+
+	return call, nil
+}
+
+// AnswerCall accepts a ringing call on client's connection and relays the
+// SDP answer to the caller. Calls in a match that has ended since they were
+// placed cannot be answered. Both members are sent the call's new state, so
+// the callee's other devices stop ringing.
+func (h *Hub) AnswerCall(client *Client, callID uuid.UUID, answer SessionDescription) error {
+	call, err := h.db.AnswerCall(callID, client.userID, client.id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCallNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	msg := callFrame("call_answer", call, call.CalleeID, answer)
+	h.SendToUser(call.CallerID, msg)
+
+	state := callFrame("call_state", call, call.CalleeID, call)
+	h.SendToUser(call.CallerID, state)
+	h.SendToUser(call.CalleeID, state)
+	return nil
+}
+
+// RelayICECandidate forwards an ICE candidate to the other member of a
+// live call in an active match.
+func (h *Hub) RelayICECandidate(userID, callID uuid.UUID, candidate ICECandidate) error {
+	call, err := h.db.GetCall(callID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCallNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if call.EndedAt != nil || (call.CallerID != userID && call.CalleeID != userID) {
+		return ErrCallNotFound
+	}
+
+	peerID, err := h.matchPartner(call.MatchID, userID)
+	if err != nil {
+		return err
+	}
+	h.SendToUser(peerID, callFrame("ice_candidate", call, userID, candidate))
+	return nil
+}
+
+// EndCall hangs up, cancels or declines a call for one of its members. A
+// call can always be hung up, even once its match has ended, so it stops
+// keeping its members busy; callEnded leaves such a match's history alone.
+func (h *Hub) EndCall(userID, callID uuid.UUID) error {
+	call, err := h.db.EndCall(callID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCallNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	h.callEnded(call)
+	return nil
+}
+
+// endConnectionCalls hangs up the calls a closed connection was part of.
+func (h *Hub) endConnectionCalls(client *Client) {
+	calls, err := h.db.EndConnectionCalls(client.id)
+	if err != nil {
+		log.Printf("Failed to end calls of connection %s: %v", client.id, err)
+		return
+	}
+	for i := range calls {
+		h.callEnded(&calls[i])
+	}
+}
+
+// callEnded tells both members that a call is over and, if the match is
+// still active, writes its entry into the conversation history.
+func (h *Hub) callEnded(call *models.Call) {
+	msg := callFrame("call_end", call, uuid.Nil, call)
+	h.SendToUser(call.CallerID, msg)
+	if call.Status != "busy" {
+		h.SendToUser(call.CalleeID, msg)
+	}
+
+	if _, err := h.matchPartner(call.MatchID, call.CallerID); err != nil {
+		if !errors.Is(err, ErrNotInMatch) {
+			log.Printf("Failed to check match of call %s: %v", call.ID, err)
+		}
+		return
+	}
+
+	if err := h.writeCallHistory(call); err != nil {
+		log.Printf("Failed to write history for call %s: %v", call.ID, err)
+	}
+}
+
+// writeCallHistory stores a "call" message from the caller summarising the
+// call and delivers it like any other message: a sequenced new_message for
+// the callee and an ack for the caller.
+func (h *Hub) writeCallHistory(call *models.Call) error {
+	message := &models.Message{
+		ID:          uuid.New(),
+		MatchID:     call.MatchID,
+		SenderID:    call.CallerID,
+		Message:     callSummary(call),
+		MessageType: "call",
+		CallID:      &call.ID,
+		Status:      "sent",
+		CreatedAt:   time.Now(),
+	}
+	if err := h.db.CreateMessage(message, call.CalleeID); err != nil {
+		return err
+	}
+
+	frame := newMessageFrame(message)
+	frame.Seq = *message.RecipientSeq
+	h.publish(call.CalleeID, frame, true)
+	h.sendAck(message)
+	return nil
+}
+
+// callSummary is the text of a call's history entry.
+func callSummary(call *models.Call) string {
+	kind := "voice call"
+	if call.Video {
+		kind = "video call"
+	}
+
+	switch call.Status {
+	case "ended":
+		var length time.Duration
+		if call.AnsweredAt != nil && call.EndedAt != nil {
+			length = call.EndedAt.Sub(*call.AnsweredAt).Round(time.Second)
+		}
+		minutes := int(length / time.Minute)
+		seconds := int(length % time.Minute / time.Second)
+		return fmt.Sprintf("Ended %s, %d:%02d", kind, minutes, seconds)
+	case "declined":
+		return "Declined " + kind
+	case "cancelled":
+		return "Cancelled " + kind
+	default:
+		// Missed, or the callee was busy on another call.
+		return "Missed " + kind
+	}
+}
+
+// callFrame builds a call event for the call's match, sent by fromID.
+func callFrame(eventType string, call *models.Call, fromID uuid.UUID, data interface{}) Message {
+	msg := Message{
+		Type:      eventType,
+		MatchID:   &call.MatchID,
+		CallID:    &call.ID,
+		Timestamp: time.Now(),
+		Data:      data,
+	}
+	if fromID != uuid.Nil {
+		msg.UserID = &fromID
+	}
+	return msg
+}
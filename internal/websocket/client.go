@@ -0,0 +1,330 @@
+package websocket
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/auth"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = 54 * time.Second
+	maxMessageSize = 64 * 1024
+	sendBufferSize = 512
+
+	// reauthWarning is how long before the connection's access token
+	// expires that the client is asked for a fresh one.
+	reauthWarning = time.Minute
+)
+
+// CloseTokenExpired is the close code sent when the access token behind a
+// connection expires without a "reauth" frame replacing it. The client
+// should refresh its token and reconnect.
+const CloseTokenExpired = 4001
+
+type Client struct {
+	id     uuid.UUID
+	userID uuid.UUID
+	conn   *websocket.Conn
+	send   chan []byte
+	hub    *Hub
+
+	limiter *frameLimiter
+
+	// version is the protocol version negotiated in the handshake.
+	version int
+
+	// reauth carries the expiry of each token accepted by readPump to
+	// writePump, which enforces it.
+	reauth chan time.Time
+
+	// closeCode is set by the owning shard before send is closed and is
+	// read by writePump only after it observes the closed channel.
+	closeCode int
+}
+
+// readPump handles inbound frames until the connection fails or the client
+// is cut off for flooding. It returns the close code to send the client.
+func (c *Client) readPump() int {
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, messageBytes, err := c.conn.ReadMessage()
+		if err != nil {
+			return websocket.CloseNormalClosure
+		}
+
+		// Invalid frames are still counted, malformed ones against the
+		// default limit.
+		msg, frameErr := parseFrame(messageBytes, c.version)
+
+		ok, retryAfter, abusive := c.limiter.allow(msg.Type)
+		if abusive {
+			log.Printf("Disconnecting client %s for user %s: too many rate limited frames", c.id, c.userID)
+			return websocket.ClosePolicyViolation
+		}
+		if !ok {
+			c.hub.sendRateLimited(c, msg.ClientID, msg.Type, retryAfter)
+			continue
+		}
+		if frameErr != nil {
+			c.hub.sendFrameError(c, msg.ClientID, msg.Type, frameErr)
+			continue
+		}
+
+		// parseFrame has checked that each type's required fields are set.
+		switch msg.Type {
+		case "send_message":
+			in := MessageInput{
+				MatchID:      *msg.MatchID,
+				SenderID:     c.userID,
+				AttachmentID: msg.AttachmentID,
+			}
+			if msg.Message != nil {
+				in.Message = *msg.Message
+			}
+			if msg.MessageType != nil {
+				in.MessageType = *msg.MessageType
+			}
+			if msg.IcebreakerID != nil {
+				in.IcebreakerID = *msg.IcebreakerID
+			}
+			if msg.ClientID != nil {
+				in.ClientID = *msg.ClientID
+			}
+			if _, err := c.hub.SendMessageToMatch(in); err != nil {
+				log.Printf("Failed to send message from %s: %v", c.userID, err)
+				c.hub.sendError(c, msg.ClientID, "send_failed", clientErrorMessage(err, "Failed to send message"))
+			}
+		case "edit_message":
+			if _, err := c.hub.EditMessage(*msg.MatchID, *msg.MessageID, c.userID, *msg.Message); err != nil {
+				c.hub.sendError(c, msg.ClientID, "edit_failed", clientErrorMessage(err, "Failed to edit message"))
+			}
+		case "delete_message":
+			if _, err := c.hub.DeleteMessage(*msg.MatchID, *msg.MessageID, c.userID); err != nil {
+				c.hub.sendError(c, msg.ClientID, "delete_failed", clientErrorMessage(err, "Failed to delete message"))
+			}
+		case "add_reaction", "remove_reaction":
+			var err error
+			if msg.Type == "add_reaction" {
+				_, err = c.hub.AddReaction(*msg.MatchID, *msg.MessageID, c.userID, *msg.Emoji)
+			} else {
+				_, err = c.hub.RemoveReaction(*msg.MatchID, *msg.MessageID, c.userID, *msg.Emoji)
+			}
+			if err != nil {
+				c.hub.sendError(c, msg.ClientID, "reaction_failed", clientErrorMessage(err, "Failed to update reaction"))
+			}
+		case "delivered", "read":
+			// MessageID is the newest message the client has received or
+			// displayed; everything before it in the match is covered too.
+			var err error
+			if msg.Type == "read" {
+				err = c.hub.MarkRead(*msg.MatchID, c.userID, *msg.MessageID)
+			} else {
+				err = c.hub.MarkDelivered(*msg.MatchID, c.userID, *msg.MessageID)
+			}
+			if err != nil {
+				log.Printf("Failed to mark messages %s for %s: %v", msg.Type, c.userID, err)
+			}
+		case "typing":
+			c.hub.SendTyping(*msg.MatchID, c.userID)
+		case "call_offer":
+			video := msg.Video != nil && *msg.Video
+			if _, err := c.hub.StartCall(c, *msg.MatchID, video, msg.Data.(SessionDescription)); err != nil {
+				c.hub.sendError(c, msg.ClientID, "call_failed", clientErrorMessage(err, "Failed to start call"))
+			}
+		case "call_answer", "ice_candidate", "call_end":
+			var err error
+			switch msg.Type {
+			case "call_answer":
+				err = c.hub.AnswerCall(c, *msg.CallID, msg.Data.(SessionDescription))
+			case "ice_candidate":
+				err = c.hub.RelayICECandidate(c.userID, *msg.CallID, msg.Data.(ICECandidate))
+			default:
+				err = c.hub.EndCall(c.userID, *msg.CallID)
+			}
+			if err != nil {
+				c.hub.sendError(c, msg.ClientID, "call_failed", clientErrorMessage(err, "Failed to update call"))
+			}
+		case "reauth":
+			c.reauthenticate(*msg.Token, msg.ClientID)
+		case "resume":
+			// Seq is the last sequence number the client applied before
+			// its previous connection dropped.
+			c.hub.resume(c, msg.Seq)
+		}
+	}
+}
+
+// reauthenticate replaces the access token behind the connection, which
+// must belong to the same user, and pushes back its expiry.
+func (c *Client) reauthenticate(token string, clientID *string) {
+	claims, err := auth.ValidateToken(token)
+	if err != nil || claims.UserID != c.userID || claims.ExpiresAt == nil {
+		c.hub.sendError(c, clientID, "reauth_failed", "Invalid or expired token")
+		return
+	}
+
+	// Only readPump sends, so after draining there is always room.
+	select {
+	case <-c.reauth:
+	default:
+	}
+	c.reauth <- claims.ExpiresAt.Time
+
+	c.hub.sendToClient(c, Message{
+		Type:      "reauthenticated",
+		ClientID:  clientID,
+		Timestamp: time.Now(),
+		Data:      map[string]time.Time{"expires_at": claims.ExpiresAt.Time},
+	})
+}
+
+// clientErrorMessage returns the client-facing text for a failed frame.
+// Only errors the client can act on are passed through; anything else is
+// replaced by fallback.
+func clientErrorMessage(err error, fallback string) string {
+	if IsValidationError(err) ||
+		errors.Is(err, ErrNotInMatch) ||
+		errors.Is(err, ErrMessageNotFound) ||
+		errors.Is(err, ErrNotSender) ||
+		errors.Is(err, ErrMessageDeleted) ||
+		errors.Is(err, ErrWindowExpired) ||
+		errors.Is(err, ErrNotEditable) ||
+		errors.Is(err, ErrDateNotPending) ||
+		errors.Is(err, ErrClientIDInUse) ||
+		errors.Is(err, ErrCallNotFound) {
+		return err.Error()
+	}
+	return fallback
+}
+
+// writePump writes queued frames and pings until the connection closes. It
+// also holds the connection to its access token's expiry: a minute before,
+// the client is sent "reauth_required", and if no "reauth" frame has
+// arrived by then the connection is closed with CloseTokenExpired. A zero
+// tokenExpiresAt disables the check.
+func (c *Client) writePump(done chan<- struct{}, tokenExpiresAt time.Time) {
+	ticker := time.NewTicker(pingPeriod)
+	expiry := time.NewTimer(time.Until(tokenExpiresAt) - reauthWarning)
+	warned := false
+	defer func() {
+		ticker.Stop()
+		expiry.Stop()
+		c.conn.Close()
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if !tokenExpiresAt.IsZero() {
+		expired = expiry.C
+	}
+
+	for {
+		select {
+		case tokenExpiresAt = <-c.reauth:
+			if !expiry.Stop() {
+				select {
+				case <-expiry.C:
+				default:
+				}
+			}
+			expiry.Reset(time.Until(tokenExpiresAt) - reauthWarning)
+			expired = expiry.C
+			warned = false
+
+		case <-expired:
+			if !warned {
+				c.hub.sendToClient(c, Message{
+					Type:      "reauth_required",
+					Timestamp: time.Now(),
+					Data:      TokenExpiryData{ExpiresAt: tokenExpiresAt},
+				})
+				expiry.Reset(time.Until(tokenExpiresAt))
+				warned = true
+				continue
+			}
+
+			log.Printf("Closing client %s for user %s: access token expired", c.id, c.userID)
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(CloseTokenExpired, "token expired"))
+			return
+
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, ""))
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HandleWebSocket serves a single connection. It blocks until both pumps
+// have finished, since the underlying conn is recycled once it returns.
+// tokenExpiresAt is when the access token that opened it expires, and
+// version is the protocol version from NegotiateVersion.
+func HandleWebSocket(hub *Hub, userID uuid.UUID, tokenExpiresAt time.Time, version int) func(*websocket.Conn) {
+	return func(c *websocket.Conn) {
+		client := &Client{
+			id:      uuid.New(),
+			userID:  userID,
+			conn:    c,
+			send:    make(chan []byte, sendBufferSize),
+			hub:     hub,
+			limiter: newFrameLimiter(hub.limits),
+			version: version,
+			reauth:  make(chan time.Time, 1),
+		}
+
+		connections := hub.register(client)
+		if connections == 0 {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			c.Close()
+			return
+		}
+
+		log.Printf("User %s connected", userID)
+		if connections == 1 {
+			hub.userConnected(userID)
+		}
+		hub.sendToClient(client, Message{
+			Type:      "hello",
+			Timestamp: time.Now(),
+			Data:      HelloData{Version: version, Supported: SupportedVersions},
+		})
+		hub.sendPresenceSnapshot(client)
+
+		writeDone := make(chan struct{})
+		go client.writePump(writeDone, tokenExpiresAt)
+		closeCode := client.readPump()
+
+		if hub.unregister(client, closeCode) == 0 {
+			log.Printf("User %s disconnected", userID)
+			hub.userDisconnected(userID)
+		}
+		hub.endConnectionCalls(client)
+		<-writeDone
+	}
+}
@@ -0,0 +1,181 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+
+	"dating-svelte/internal/database"
+	"dating-svelte/internal/models"
+)
+
+const (
+	// maxDateLead is how far ahead a date can be planned.
+	maxDateLead = 365 * 24 * time.Hour
+
+	maxPlaceNameLength = 200
+)
+
+var (
+	ErrDateNotPending     = errors.New("date plan not found or already answered")
+	ErrInvalidDateTime    = errors.New("scheduled_at must be in the future and within a year")
+	ErrInvalidPlace       = fmt.Errorf("place_name must be 1 to %d characters", maxPlaceNameLength)
+	ErrInvalidCoordinates = errors.New("latitude and longitude must be given together and be valid coordinates")
+)
+
+// DateInput is the time and place of a proposed date. The coordinates are
+// optional but come as a pair.
+type DateInput struct {
+	ScheduledAt time.Time
+	PlaceName   string
+	Latitude    *float64
+	Longitude   *float64
+}
+
+// validate checks d and normalises it for storage. scheduled_at is a
+// TIMESTAMP holding UTC, so the client's offset is applied here; stored
+// as is, 19:30+02:00 would become 19:30 UTC.
+func (d *DateInput) validate() error {
+	d.ScheduledAt = d.ScheduledAt.UTC()
+	d.PlaceName = strings.TrimSpace(d.PlaceName)
+	if d.PlaceName == "" || utf8.RuneCountInString(d.PlaceName) > maxPlaceNameLength {
+		return ErrInvalidPlace
+	}
+
+	until := time.Until(d.ScheduledAt)
+	if until <= 0 || until > maxDateLead {
+		return ErrInvalidDateTime
+	}
+
+	if (d.Latitude == nil) != (d.Longitude == nil) {
+		return ErrInvalidCoordinates
+	}
+	if d.Latitude != nil && (*d.Latitude < -90 || *d.Latitude > 90 || *d.Longitude < -180 || *d.Longitude > 180) {
+		return ErrInvalidCoordinates
+	}
+	return nil
+}
+
+// ProposeDate proposes a date to the other member of the match. The
+// proposal appears in the conversation as a "date_proposal" message
+// carrying the plan's ID; the plan and the message are stored together.
+func (h *Hub) ProposeDate(matchID, userID uuid.UUID, date DateInput) (*models.DatePlan, *models.Message, error) {
+	plan, err := h.newDatePlan(matchID, userID, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message, err := h.sendDateMessage(plan, userID, "date_proposal", "Proposed a date at "+plan.PlaceName, func(tx *sqlx.Tx) error {
+		return h.db.CreateDatePlan(tx, plan)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, message, nil
+}
+
+// RespondToDate accepts or declines a date the other member proposed,
+// with a "date_accepted" or "date_declined" message. It returns
+// ErrDateNotPending if the plan has already been answered.
+func (h *Hub) RespondToDate(matchID, planID, userID uuid.UUID, accept bool) (*models.DatePlan, *models.Message, error) {
+	if _, err := h.matchPartner(matchID, userID); err != nil {
+		return nil, nil, err
+	}
+
+	status, messageType, verb := "declined", "date_declined", "Declined"
+	if accept {
+		status, messageType, verb = "accepted", "date_accepted", "Accepted"
+	}
+
+	plan, err := h.db.GetDatePlan(planID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrDateNotPending
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	message, err := h.sendDateMessage(plan, userID, messageType, verb+" the date at "+plan.PlaceName, func(tx *sqlx.Tx) error {
+		answered, err := h.db.RespondToDatePlan(tx, planID, matchID, userID, status)
+		if err != nil {
+			return err
+		}
+		*plan = *answered
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrDateNotPending
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, message, nil
+}
+
+// CounterDate answers a date the other member proposed with another time
+// or place. The original plan becomes "countered" and the counter is a new
+// proposal, sent as a "date_counter" message.
+func (h *Hub) CounterDate(matchID, planID, userID uuid.UUID, date DateInput) (*models.DatePlan, *models.Message, error) {
+	plan, err := h.newDatePlan(matchID, userID, date)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan.CounterOf = &planID
+
+	message, err := h.sendDateMessage(plan, userID, "date_counter", "Suggested meeting at "+plan.PlaceName+" instead", func(tx *sqlx.Tx) error {
+		return h.db.CounterDatePlan(tx, plan)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrDateNotPending
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, message, nil
+}
+
+// newDatePlan checks a proposal and returns the plan to store for it. The
+// place name is screened like message text.
+func (h *Hub) newDatePlan(matchID, userID uuid.UUID, date DateInput) (*models.DatePlan, error) {
+	if err := date.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := h.matchPartner(matchID, userID); err != nil {
+		return nil, err
+	}
+
+	place, _, err := h.screen(date.PlaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.DatePlan{
+		ID:          uuid.New(),
+		MatchID:     matchID,
+		ProposerID:  userID,
+		ScheduledAt: date.ScheduledAt,
+		PlaceName:   place,
+		Latitude:    date.Latitude,
+		Longitude:   date.Longitude,
+	}, nil
+}
+
+// sendDateMessage records a step of a date plan in the conversation.
+// persist makes the plan change, in the transaction that stores the
+// message, so the plan never changes without its message.
+func (h *Hub) sendDateMessage(plan *models.DatePlan, senderID uuid.UUID, messageType, text string, persist database.TxStep) (*models.Message, error) {
+	return h.SendMessageToMatch(MessageInput{
+		MatchID:     plan.MatchID,
+		SenderID:    senderID,
+		Message:     text,
+		MessageType: messageType,
+		DatePlanID:  &plan.ID,
+		persist:     persist,
+	})
+}
@@ -0,0 +1,34 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDateInputStoredInUTC(t *testing.T) {
+	berlin := time.FixedZone("CEST", 2*60*60)
+	local := time.Now().Add(48 * time.Hour).In(berlin).Truncate(time.Second)
+
+	date := DateInput{ScheduledAt: local, PlaceName: " Café Luna "}
+	if err := date.validate(); err != nil {
+		t.Fatalf("valid date rejected: %v", err)
+	}
+	if date.ScheduledAt.Location() != time.UTC {
+		t.Errorf("scheduled_at kept zone %s, want UTC", date.ScheduledAt.Location())
+	}
+	if !date.ScheduledAt.Equal(local) {
+		t.Errorf("scheduled_at moved from %s to %s", local, date.ScheduledAt)
+	}
+	if date.PlaceName != "Café Luna" {
+		t.Errorf("place_name %q not trimmed", date.PlaceName)
+	}
+}
+
+func TestDateInputRejectsPastTimeInAnyZone(t *testing.T) {
+	// An hour ago in a zone ahead of UTC reads as a future wall-clock time.
+	tokyo := time.FixedZone("JST", 9*60*60)
+	date := DateInput{ScheduledAt: time.Now().Add(-time.Hour).In(tokyo), PlaceName: "Café Luna"}
+	if err := date.validate(); err != ErrInvalidDateTime {
+		t.Errorf("got %v, want ErrInvalidDateTime", err)
+	}
+}
@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+)
+
+const (
+	// editWindow is how long after sending a message its sender may edit it.
+	editWindow = 15 * time.Minute
+
+	// unsendWindow is how long after sending a message its sender may
+	// delete it for both participants.
+	unsendWindow = time.Hour
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotSender       = errors.New("only the sender can change this message")
+	ErrWindowExpired   = errors.New("this message can no longer be changed")
+	ErrMessageDeleted  = errors.New("this message has been deleted")
+	ErrNotEditable     = errors.New("only text messages and captions can be edited")
+)
+
+// EditMessage replaces the text of a message the user sent within the last
+// editWindow. The previous text is kept in the edit history and both
+// participants receive a "message_updated" event.
+func (h *Hub) EditMessage(matchID, messageID, userID uuid.UUID, text string) (*models.Message, error) {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > maxMessageLength {
+		return nil, ErrMessageTooLong
+	}
+
+	message, recipientID, err := h.ownMessage(matchID, messageID, userID, editWindow)
+	if err != nil {
+		return nil, err
+	}
+	// Call, icebreaker and date messages are written by the server.
+	switch message.MessageType {
+	case "text", "image", "gif", "audio":
+	default:
+		return nil, ErrNotEditable
+	}
+	if text == "" && message.MessageType == "text" {
+		return nil, ErrEmptyMessage
+	}
+
+	original := text
+	text, flags, err := h.screen(text)
+	if err != nil {
+		return nil, err
+	}
+	if text == message.Message {
+		return message, nil
+	}
+
+	if err := h.db.EditMessage(message, text); err != nil {
+		return nil, err
+	}
+	h.flagMessage(message, flags, original)
+
+	messages := []models.Message{*message}
+	if err := h.loadAttachments(messages); err != nil {
+		return nil, err
+	}
+	message = &messages[0]
+
+	h.sendMessageChange("message_updated", message, recipientID)
+	return message, nil
+}
+
+// DeleteMessage unsends a message the user sent within the last
+// unsendWindow. The row stays as a tombstone with its content cleared; the
+// content itself moves to the edit history. Both participants receive a
+// "message_deleted" event.
+func (h *Hub) DeleteMessage(matchID, messageID, userID uuid.UUID) (*models.Message, error) {
+	message, recipientID, err := h.ownMessage(matchID, messageID, userID, unsendWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.db.DeleteMessage(message); err != nil {
+		return nil, err
+	}
+
+	h.sendMessageChange("message_deleted", message, recipientID)
+	return message, nil
+}
+
+// ownMessage loads a live message from the match that userID sent less
+// than window ago, and returns it with the other participant's ID.
+func (h *Hub) ownMessage(matchID, messageID, userID uuid.UUID, window time.Duration) (*models.Message, uuid.UUID, error) {
+	recipientID, err := h.matchPartner(matchID, userID)
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+
+	message, err := h.db.GetMessage(messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && message.MatchID != matchID) {
+		return nil, uuid.Nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, uuid.Nil, err
+	}
+
+	if message.SenderID != userID {
+		return nil, uuid.Nil, ErrNotSender
+	}
+	if message.DeletedAt != nil {
+		return nil, uuid.Nil, ErrMessageDeleted
+	}
+	if time.Since(message.CreatedAt) > window {
+		return nil, uuid.Nil, ErrWindowExpired
+	}
+
+	return message, recipientID, nil
+}
+
+// sendMessageChange tells both participants, on every connection, that a
+// message changed.
+func (h *Hub) sendMessageChange(eventType string, message *models.Message, recipientID uuid.UUID) {
+	msg := Message{
+		Type:      eventType,
+		MatchID:   &message.MatchID,
+		MessageID: &message.ID,
+		UserID:    &message.SenderID,
+		Timestamp: time.Now(),
+		Data:      message,
+	}
+
+	h.SendToUser(recipientID, msg)
+	h.SendToUser(message.SenderID, msg)
+}
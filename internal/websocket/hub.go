@@ -1,279 +1,322 @@
 package websocket
 
 import (
-    "encoding/json"
-    "log"
-    "sync"
-    "time"
-    
-    "github.com/gofiber/websocket/v2"
-    "github.com/google/uuid"
-    
-    "dating-svelte/internal/database"
-    "dating-svelte/internal/models"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/database"
+	"dating-svelte/internal/pubsub"
+	"dating-svelte/internal/screening"
 )
 
-type Hub struct {
-    clients    map[uuid.UUID]*Client
-    register   chan *Client
-    unregister chan *Client
-    broadcast  chan []byte
-    db         *database.DB
-    mu         sync.RWMutex
-}
+// defaultShardCount is the number of shards client bookkeeping is split
+// across. Each shard is owned by its own goroutine.
+const defaultShardCount = 16
+
+// maxReplayMessages caps how many messages a single resume replays. Clients
+// that fall further behind are told to refetch over REST. Together with
+// backlogSize it must stay well below sendBufferSize.
+const maxReplayMessages = 200
+
+var ErrNotInMatch = errors.New("user is not part of this match")
 
-type Client struct {
-    id     uuid.UUID
-    userID uuid.UUID
-    conn   *websocket.Conn
-    send   chan []byte
-    hub    *Hub
+// Hub routes realtime events to connected clients. Clients are sharded by
+// user ID and every shard's client map is only ever touched by that shard's
+// goroutine, so the hub itself holds no locks.
+//
+// Outbound events go through a pubsub.Broker rather than straight to the
+// shards, so a replica can reach users connected to any other replica.
+type Hub struct {
+	shards    []*shard
+	replicaID uuid.UUID // identifies this process in user_connections
+	db        *database.DB
+	nextSeq   func(userID uuid.UUID) (int64, error) // db.NextEventSeq outside tests
+	broker    pubsub.Broker
+	limits    RateLimits
+	screener  *screening.Screener
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// Message is the envelope of every websocket frame. V is the protocol
+// version, Type selects the frame and Data holds its typed payload; see
+// clientFrames and serverFrames for which fields each type uses. Seq is the
+// recipient's per-user sequence number on outbound events and the last
+// sequence number seen on an inbound "resume" frame. ClientID echoes the
+// sender's temporary message ID on "ack" and "error" frames. Muted is set on
+// a "new_message" frame when the recipient muted the match, so the client
+// skips the notification, and DurationMs is set on voice notes.
 type Message struct {
-    Type      string      `json:"type"`
-    MatchID   *uuid.UUID  `json:"match_id,omitempty"`
-    Message   *string     `json:"message,omitempty"`
-    UserID    *uuid.UUID  `json:"user_id,omitempty"`
-    Timestamp time.Time   `json:"timestamp"`
-    Data      interface{} `json:"data,omitempty"`
+	Type         string      `json:"type"`
+	V            int         `json:"v,omitempty"`
+	Seq          int64       `json:"seq,omitempty"`
+	MatchID      *uuid.UUID  `json:"match_id,omitempty"`
+	MessageID    *uuid.UUID  `json:"message_id,omitempty"`
+	ClientID     *string     `json:"client_id,omitempty"`
+	Message      *string     `json:"message,omitempty"`
+	MessageType  *string     `json:"message_type,omitempty"`
+	AttachmentID *uuid.UUID  `json:"attachment_id,omitempty"`
+	IcebreakerID *string     `json:"icebreaker_id,omitempty"`
+	Emoji        *string     `json:"emoji,omitempty"`
+	DurationMs   *int        `json:"duration_ms,omitempty"`
+	CallID       *uuid.UUID  `json:"call_id,omitempty"`
+	Video        *bool       `json:"video,omitempty"`
+	Token        *string     `json:"token,omitempty"` // access token in "reauth" frames
+	Muted        bool        `json:"muted,omitempty"`
+	UserID       *uuid.UUID  `json:"user_id,omitempty"`
+	Timestamp    time.Time   `json:"timestamp"`
+	Data         interface{} `json:"data,omitempty"`
 }
 
-func NewHub(db *database.DB) *Hub {
-    return &Hub{
-        clients:    make(map[uuid.UUID]*Client),
-        register:   make(chan *Client),
-        unregister: make(chan *Client),
-        broadcast:  make(chan []byte),
-        db:         db,
-    }
+// NewHub creates a hub. Messages are checked against screener's rules
+// before they are stored; a nil screener disables content screening.
+func NewHub(db *database.DB, broker pubsub.Broker, limits RateLimits, screener *screening.Screener) *Hub {
+	h := &Hub{
+		shards:    make([]*shard, defaultShardCount),
+		replicaID: uuid.New(),
+		db:        db,
+		nextSeq:   db.NextEventSeq,
+		broker:    broker,
+		limits:    limits,
+		screener:  screener,
+		done:      make(chan struct{}),
+	}
+	for i := range h.shards {
+		h.shards[i] = newShard()
+	}
+	broker.Subscribe(h.deliverLocal)
+	return h
 }
 
+// Run starts every shard and blocks until Close is called.
 func (h *Hub) Run() {
-    for {
-        select {
-        case client := <-h.register:
-            h.mu.Lock()
-            h.clients[client.userID] = client
-            h.mu.Unlock()
-            
-            log.Printf("User %s connected", client.userID)
-            
-            // Send online status to matches
-            h.broadcastUserStatus(client.userID, "online")
-            
-        case client := <-h.unregister:
-            h.mu.Lock()
-            if _, ok := h.clients[client.userID]; ok {
-                delete(h.clients, client.userID)
-                close(client.send)
-            }
-            h.mu.Unlock()
-            
-            log.Printf("User %s disconnected", client.userID)
-            
-            // Send offline status to matches
-            h.broadcastUserStatus(client.userID, "offline")
-            
-        case message := <-h.broadcast:
-            h.mu.RLock()
-            for userID, client := range h.clients {
-                select {
-                case client.send <- message:
-                default:
-                    delete(h.clients, userID)
-                    close(client.send)
-                }
-            }
-            h.mu.RUnlock()
-        }
-    }
+	var wg sync.WaitGroup
+	for _, s := range h.shards {
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			s.run(h.done)
+		}(s)
+	}
+	go h.heartbeat()
+	wg.Wait()
+}
+
+// Close stops the hub and disconnects every client.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+func (h *Hub) shardFor(userID uuid.UUID) *shard {
+	f := fnv.New32a()
+	f.Write(userID[:])
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
 }
 
-func (h *Hub) broadcastUserStatus(userID uuid.UUID, status string) {
-    // Get user's matches
-    matches, err := h.db.GetUserMatches(userID)
-    if err != nil {
-        return
-    }
-    
-    statusMsg := Message{
-        Type:      "user_status",
-        UserID:    &userID,
-        Timestamp: time.Now(),
-        Data:      map[string]string{"status": status},
-    }
-    
-    statusBytes, _ := json.Marshal(statusMsg)
-    
-    h.mu.RLock()
-    defer h.mu.RUnlock()
-    
-    for _, match := range matches {
-        var targetUserID uuid.UUID
-        if match.User1ID == userID {
-            targetUserID = match.User2ID
-        } else {
-            targetUserID = match.User1ID
-        }
-        
-        if client, ok := h.clients[targetUserID]; ok {
-            select {
-            case client.send <- statusBytes:
-            default:
-                delete(h.clients, targetUserID)
-                close(client.send)
-            }
-        }
-    }
+// register adds the client to its shard and returns how many connections
+// the user now has. It returns 0 if the hub has been closed.
+func (h *Hub) register(client *Client) int {
+	return h.shardFor(client.userID).submitMembership(membership{client: client, add: true}, h.done)
 }
 
-func (h *Hub) SendMessageToMatch(matchID uuid.UUID, senderID uuid.UUID, message string) error {
-    // Save message to database
-    dbMessage := &models.Message{
-        ID:          uuid.New(),
-        MatchID:     matchID,
-        SenderID:    senderID,
-        Message:     message,
-        MessageType: "text",
-        CreatedAt:   time.Now(),
-    }
-    
-    if err := h.db.CreateMessage(dbMessage); err != nil {
-        return err
-    }
-    
-    // Get match details to find recipient
-    matches, err := h.db.GetUserMatches(senderID)
-    if err != nil {
-        return err
-    }
-    
-    var recipientID uuid.UUID
-    for _, match := range matches {
-        if match.ID == matchID {
-            if match.User1ID == senderID {
-                recipientID = match.User2ID
-            } else {
-                recipientID = match.User1ID
-            }
-            break
-        }
-    }
-    
-    // Send to recipient if online
-    h.mu.RLock()
-    defer h.mu.RUnlock()
-    
-    if client, ok := h.clients[recipientID]; ok {
-        wsMessage := Message{
-            Type:      "new_message",
-            MatchID:   &matchID,
-            Message:   &message,
-            UserID:    &senderID,
-            Timestamp: dbMessage.CreatedAt,
-            Data:      dbMessage,
-        }
-        
-        messageBytes, _ := json.Marshal(wsMessage)
-        
-        select {
-        case client.send <- messageBytes:
-        default:
-            delete(h.clients, recipientID)
-            close(client.send)
-        }
-    }
-    
-    return nil
+// unregister removes the client from its shard, if it is still present, and
+// returns how many connections the user has left. closeCode is sent to the
+// client if its connection is still open.
+func (h *Hub) unregister(client *Client, closeCode int) int {
+	return h.shardFor(client.userID).submitMembership(membership{client: client, closeCode: closeCode}, h.done)
 }
 
-func (c *Client) readPump() {
-    defer func() {
-        c.hub.unregister <- c
-        c.conn.Close()
-    }()
-    
-    c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-    c.conn.SetPongHandler(func(string) error {
-        c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-        return nil
-    })
-    
-    for {
-        _, messageBytes, err := c.conn.ReadMessage()
-        if err != nil {
-            break
-        }
-        
-        var msg Message
-        if err := json.Unmarshal(messageBytes, &msg); err != nil {
-            continue
-        }
-        
-        switch msg.Type {
-        case "send_message":
-            if msg.MatchID != nil && msg.Message != nil {
-                c.hub.SendMessageToMatch(*msg.MatchID, c.userID, *msg.Message)
-            }
-        case "typing":
-            if msg.MatchID != nil {
-                // Handle typing indicators
-                typingMsg := Message{
-                    Type:      "typing",
-                    MatchID:   msg.MatchID,
-                    UserID:    &c.userID,
-                    Timestamp: time.Now(),
-                }
-                typingBytes, _ := json.Marshal(typingMsg)
-                c.hub.broadcast <- typingBytes
-            }
-        }
-    }
+// SendToUser stamps msg with the user's next sequence number and publishes
+// it for every connection of that user, whichever replica it is on. Every
+// replica keeps it in the user's backlog, so a session that resumes after
+// missing it has it replayed.
+func (h *Hub) SendToUser(userID uuid.UUID, msg Message) {
+	seq, err := h.nextSeq(userID)
+	if err != nil {
+		log.Printf("Failed to assign event sequence for user %s: %v", userID, err)
+		return
+	}
+
+	msg.Seq = seq
+	h.publish(userID, msg, false)
+}
+
+// Broadcast publishes msg for every connected client. Broadcasts carry no
+// sequence number and are not replayed on resume.
+func (h *Hub) Broadcast(msg Message) {
+	h.publish(uuid.Nil, msg, false)
+}
+
+// publish hands msg to the broker. Persisted events can be rebuilt from the
+// database on resume, so replicas do not buffer them.
+func (h *Hub) publish(userID uuid.UUID, msg Message, persisted bool) {
+	h.publishEvent(pubsub.Event{
+		UserID:    userID,
+		Seq:       msg.Seq,
+		Persisted: persisted,
+		Payload:   encodeFrame(msg),
+	})
+}
+
+func (h *Hub) publishEvent(event pubsub.Event) {
+	if err := h.broker.Publish(event); err != nil {
+		log.Printf("Failed to publish event for user %s: %v", event.UserID, err)
+	}
+}
+
+// deliverLocal hands an event from the broker to the clients connected to
+// this process. Every replica sees every event, so each shard also buffers
+// events for users that are not connected here in case they resume later.
+func (h *Hub) deliverLocal(event pubsub.Event) {
+	if event.UserID == uuid.Nil {
+		for _, s := range h.shards {
+			select {
+			case s.broadcast <- event.Payload:
+			case <-h.done:
+				return
+			}
+		}
+		return
+	}
+
+	h.deliverTo(delivery{
+		userID:    event.UserID,
+		seq:       event.Seq,
+		persisted: event.Persisted,
+		payload:   event.Payload,
+	})
 }
 
-func (c *Client) writePump() {
-    ticker := time.NewTicker(54 * time.Second)
-    defer func() {
-        ticker.Stop()
-        c.conn.Close()
-    }()
-    
-    for {
-        select {
-        case message, ok := <-c.send:
-            c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-            if !ok {
-                c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-                return
-            }
-            
-            if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-                return
-            }
-            
-        case <-ticker.C:
-            c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-            if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-                return
-            }
-        }
-    }
+// deliverTo queues d on its user's shard. It reports false if the hub was
+// closed first.
+func (h *Hub) deliverTo(d delivery) bool {
+	select {
+	case h.shardFor(d.userID).deliver <- d:
+		return true
+	case <-h.done:
+		return false
+	}
 }
 
-func HandleWebSocket(hub *Hub, userID uuid.UUID) func(*websocket.Conn) {
-    return func(c *websocket.Conn) {
-        client := &Client{
-            id:     uuid.New(),
-            userID: userID,
-            conn:   c,
-            send:   make(chan []byte, 256),
-            hub:    hub,
-        }
-        
-        client.hub.register <- client
-        
-        go client.writePump()
-        go client.readPump()
-    }
-}
\ No newline at end of file
+// sendToClient queues msg for a single connection only. It is used for
+// replies that concern that connection, such as errors, and is neither
+// sequenced nor replayed.
+func (h *Hub) sendToClient(client *Client, msg Message) {
+	h.deliverTo(delivery{userID: client.userID, client: client, payload: encodeFrame(msg)})
+}
+
+// sendError tells a single connection that one of its frames failed.
+func (h *Hub) sendError(client *Client, clientID *string, code string, message string) {
+	h.sendToClient(client, Message{
+		Type:      "error",
+		ClientID:  clientID,
+		Timestamp: time.Now(),
+		Data:      ErrorData{Code: code, Error: message},
+	})
+}
+
+// sendFrameError tells a single connection that a frame was rejected by
+// parseFrame.
+func (h *Hub) sendFrameError(client *Client, clientID *string, frameType string, err *frameError) {
+	h.sendToClient(client, Message{
+		Type:      "error",
+		ClientID:  clientID,
+		Timestamp: time.Now(),
+		Data:      ErrorData{Code: err.code, Error: err.message, Frame: frameType, Fields: err.fields},
+	})
+}
+
+// sendRateLimited tells a single connection that a frame was dropped for
+// exceeding its rate limit and how long to wait before retrying.
+func (h *Hub) sendRateLimited(client *Client, clientID *string, frameType string, retryAfter time.Duration) {
+	h.sendToClient(client, Message{
+		Type:      "error",
+		ClientID:  clientID,
+		Timestamp: time.Now(),
+		Data: ErrorData{
+			Code:         "rate_limited",
+			Error:        "Too many requests, slow down",
+			Frame:        frameType,
+			RetryAfterMs: retryAfter.Milliseconds(),
+		},
+	})
+}
+
+// resume replays every event for client's user with a sequence number
+// greater than after: messages are reloaded from the database, everything
+// else comes from the shard's backlog. A final "resumed" frame tells the
+// client whether the replay was complete or it should refetch over REST.
+func (h *Hub) resume(client *Client, after int64) {
+	messages, err := h.db.GetMessagesForRecipientSince(client.userID, after, maxReplayMessages+1)
+	if err != nil {
+		log.Printf("Failed to load messages to replay for user %s: %v", client.userID, err)
+		return
+	}
+
+	truncated := len(messages) > maxReplayMessages
+	if truncated {
+		messages = messages[:maxReplayMessages]
+	}
+	if err := h.loadAttachments(messages); err != nil {
+		log.Printf("Failed to load attachments to replay for user %s: %v", client.userID, err)
+		return
+	}
+
+	frames := make([]replayFrame, 0, len(messages))
+	for i := range messages {
+		msg := newMessageFrame(&messages[i])
+		msg.Seq = *messages[i].RecipientSeq
+		frames = append(frames, replayFrame{seq: msg.Seq, payload: encodeFrame(msg)})
+	}
+
+	h.shardFor(client.userID).submitReplay(replayRequest{
+		client:    client,
+		after:     after,
+		persisted: frames,
+		truncated: truncated,
+	}, h.done)
+}
+
+// matchPartner returns the other member of the match, or ErrNotInMatch if
+// userID does not belong to an active match with that ID.
+func (h *Hub) matchPartner(matchID, userID uuid.UUID) (uuid.UUID, error) {
+	match, err := h.db.GetUserMatch(matchID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, ErrNotInMatch
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if match.User1ID == userID {
+		return match.User2ID, nil
+	}
+	return match.User1ID, nil
+}
+
+// SendTyping relays a typing indicator to the other member of the match.
+func (h *Hub) SendTyping(matchID uuid.UUID, senderID uuid.UUID) error {
+	recipientID, err := h.matchPartner(matchID, senderID)
+	if err != nil {
+		return err
+	}
+
+	typingMsg := Message{
+		Type:      "typing",
+		MatchID:   &matchID,
+		UserID:    &senderID,
+		Timestamp: time.Now(),
+	}
+
+	h.SendToUser(recipientID, typingMsg)
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/pubsub"
+)
+
+// newTestHub returns a hub on broker with its shards running. It has no
+// database; sequence numbers come from a counter per user instead.
+func newTestHub(t *testing.T, broker pubsub.Broker) *Hub {
+	t.Helper()
+	h := NewHub(nil, broker, RateLimits{}, nil)
+	var mu sync.Mutex
+	seqs := make(map[uuid.UUID]int64)
+	h.nextSeq = func(userID uuid.UUID) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		seqs[userID]++
+		return seqs[userID], nil
+	}
+	for _, s := range h.shards {
+		go s.run(h.done)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+func newTestClient(h *Hub, userID uuid.UUID, buffer int) *Client {
+	return &Client{id: uuid.New(), userID: userID, send: make(chan []byte, buffer), hub: h}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// registerUsers connects conns clients for each of n users, concurrently.
+func registerUsers(t *testing.T, h *Hub, n, conns, buffer int) map[uuid.UUID][]*Client {
+	t.Helper()
+	clients := make(map[uuid.UUID][]*Client, n)
+	for i := 0; i < n; i++ {
+		userID := uuid.New()
+		for j := 0; j < conns; j++ {
+			clients[userID] = append(clients[userID], newTestClient(h, userID, buffer))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, userClients := range clients {
+		for _, client := range userClients {
+			wg.Add(1)
+			go func(client *Client) {
+				defer wg.Done()
+				if h.register(client) == 0 {
+					t.Error("register returned 0 connections")
+				}
+			}(client)
+		}
+	}
+	wg.Wait()
+	return clients
+}
+
+func frameType(t *testing.T, payload []byte) string {
+	t.Helper()
+	return decodeFrame(t, payload).Type
+}
+
+func TestSendToUserFanOut(t *testing.T) {
+	const (
+		users   = 2000
+		conns   = 2
+		perUser = 5
+		senders = 64
+	)
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	clients := registerUsers(t, h, users, conns, sendBufferSize)
+
+	userIDs := make(chan uuid.UUID, users)
+	for userID := range clients {
+		userIDs <- userID
+	}
+	close(userIDs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for userID := range userIDs {
+				for k := 0; k < perUser; k++ {
+					h.SendToUser(userID, Message{Type: "typing", Timestamp: time.Now()})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, userClients := range clients {
+		for _, client := range userClients {
+			waitFor(t, "every connection to receive its frames", func() bool {
+				return len(client.send) == perUser
+			})
+			for k := 0; k < perUser; k++ {
+				if got := frameType(t, <-client.send); got != "typing" {
+					t.Fatalf("got %q frame, want typing", got)
+				}
+			}
+		}
+	}
+}
+
+func TestBroadcastReachesEveryShard(t *testing.T) {
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	clients := registerUsers(t, h, 1000, 1, 4)
+
+	h.Broadcast(Message{Type: "announcement", Timestamp: time.Now()})
+
+	for _, userClients := range clients {
+		client := userClients[0]
+		waitFor(t, "the broadcast to reach every connection", func() bool {
+			return len(client.send) == 1
+		})
+		if got := frameType(t, <-client.send); got != "announcement" {
+			t.Fatalf("got %q frame, want announcement", got)
+		}
+	}
+}
+
+func decodeFrame(t *testing.T, payload []byte) Message {
+	t.Helper()
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatalf("invalid frame %s: %v", payload, err)
+	}
+	return msg
+}
+
+func TestSendToUserSequencesAndReplays(t *testing.T) {
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	userID := uuid.New()
+	first := newTestClient(h, userID, 16)
+	h.register(first)
+
+	types := []string{"typing", "user_status", "call_offer", "match_updated", "checkin_due"}
+	for _, eventType := range types {
+		h.SendToUser(userID, Message{Type: eventType, Timestamp: time.Now()})
+	}
+	waitFor(t, "the live connection to receive every event", func() bool {
+		return len(first.send) == len(types)
+	})
+	for i := range types {
+		if msg := decodeFrame(t, <-first.send); msg.Seq != int64(i+1) {
+			t.Fatalf("%s has seq %d, want %d", msg.Type, msg.Seq, i+1)
+		}
+	}
+
+	// A session that saw up to seq 2 resumes on a new connection.
+	resumed := newTestClient(h, userID, 16)
+	h.register(resumed)
+	h.shardFor(userID).submitReplay(replayRequest{client: resumed, after: 2}, h.done)
+
+	for _, want := range types[2:] {
+		if msg := decodeFrame(t, <-resumed.send); msg.Type != want {
+			t.Fatalf("replayed %q, want %q", msg.Type, want)
+		}
+	}
+	end := decodeFrame(t, <-resumed.send)
+	data, _ := json.Marshal(end.Data)
+	var result ResumedData
+	if err := json.Unmarshal(data, &result); err != nil || end.Type != "resumed" || !result.Complete {
+		t.Fatalf("got %s %s after the replay, want a complete resumed frame", end.Type, data)
+	}
+}
+
+func TestBroadcastIsNotSequenced(t *testing.T) {
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	userID := uuid.New()
+	client := newTestClient(h, userID, 4)
+	h.register(client)
+
+	h.Broadcast(Message{Type: "announcement", Timestamp: time.Now()})
+	waitFor(t, "the broadcast", func() bool { return len(client.send) == 1 })
+	if msg := decodeFrame(t, <-client.send); msg.Seq != 0 {
+		t.Errorf("broadcast has seq %d, want none", msg.Seq)
+	}
+
+	h.shardFor(userID).submitReplay(replayRequest{client: client, after: 0}, h.done)
+	if msg := decodeFrame(t, <-client.send); msg.Type != "resumed" {
+		t.Errorf("replayed %q, want only the resumed frame", msg.Type)
+	}
+}
@@ -0,0 +1,335 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/database"
+	"dating-svelte/internal/icebreakers"
+	"dating-svelte/internal/media"
+	"dating-svelte/internal/models"
+	"dating-svelte/internal/screening"
+)
+
+// maxMessageLength is the longest text message or caption, in characters.
+const maxMessageLength = 2000
+
+var (
+	ErrEmptyMessage       = errors.New("message cannot be empty")
+	ErrMessageTooLong     = fmt.Errorf("message cannot be longer than %d characters", maxMessageLength)
+	ErrInvalidClientID    = errors.New("client_id cannot be longer than 64 characters")
+	ErrClientIDInUse      = errors.New("client_id was already used for a message in another conversation")
+	ErrInvalidMessageType = errors.New("message_type must be text, image, gif, audio or icebreaker")
+	ErrAttachmentRequired = errors.New("image, gif and audio messages need an attachment_id")
+	ErrInvalidAttachment  = errors.New("attachment cannot be sent with this message")
+	ErrInvalidIcebreaker  = errors.New("icebreaker_id must be one of the match's icebreakers")
+)
+
+// IsValidationError reports whether err was caused by the caller's input
+// rather than a server failure, so its text can be shown to the user.
+// Messages blocked by content screening count as invalid input.
+func IsValidationError(err error) bool {
+	return errors.Is(err, ErrEmptyMessage) ||
+		errors.Is(err, screening.ErrBlocked) ||
+		errors.Is(err, ErrMessageTooLong) ||
+		errors.Is(err, ErrInvalidClientID) ||
+		errors.Is(err, ErrInvalidMessageType) ||
+		errors.Is(err, ErrAttachmentRequired) ||
+		errors.Is(err, ErrInvalidAttachment) ||
+		errors.Is(err, ErrInvalidIcebreaker) ||
+		errors.Is(err, ErrInvalidDateTime) ||
+		errors.Is(err, ErrInvalidPlace) ||
+		errors.Is(err, ErrInvalidCoordinates) ||
+		errors.Is(err, ErrInvalidEmoji)
+}
+
+// MessageInput is a message a user wants to send. MessageType defaults to
+// "text". Image, gif and audio messages reference an uploaded attachment
+// and treat Message as an optional caption. Icebreaker messages send one of
+// the match's suggested prompts, named by IcebreakerID, as their text.
+// Date messages are only sent by the hub's date planning methods, which
+// set DatePlanID and store the plan change in persist.
+type MessageInput struct {
+	MatchID      uuid.UUID
+	SenderID     uuid.UUID
+	Message      string
+	MessageType  string
+	AttachmentID *uuid.UUID
+	IcebreakerID string
+	DatePlanID   *uuid.UUID
+	ClientID     string
+
+	// persist is stored in the same transaction as the message.
+	persist database.TxStep
+}
+
+// attachmentTypes lists the content types each media message type accepts.
+var attachmentTypes = map[string][]string{
+	"image": {"image/jpeg", "image/png"},
+	"gif":   {"image/gif"},
+	"audio": {"audio/ogg", "audio/webm", "audio/mp4"},
+}
+
+// validate normalises the input and checks everything that does not need
+// the database. Every send path goes through SendMessageToMatch, so this is
+// the only validation.
+func (in *MessageInput) validate() error {
+	in.Message = strings.TrimSpace(in.Message)
+	if in.MessageType == "" {
+		in.MessageType = "text"
+	}
+
+	switch in.MessageType {
+	case "text":
+		if in.Message == "" {
+			return ErrEmptyMessage
+		}
+		if in.AttachmentID != nil {
+			return ErrInvalidAttachment
+		}
+	case "image", "gif", "audio":
+		if in.AttachmentID == nil {
+			return ErrAttachmentRequired
+		}
+	case "icebreaker":
+		prompt, ok := icebreakers.Get(in.IcebreakerID)
+		if !ok {
+			return ErrInvalidIcebreaker
+		}
+		if in.AttachmentID != nil {
+			return ErrInvalidAttachment
+		}
+		in.Message = prompt.Text
+	case "date_proposal", "date_accepted", "date_declined", "date_counter":
+		if in.DatePlanID == nil {
+			return ErrInvalidMessageType
+		}
+		if in.AttachmentID != nil {
+			return ErrInvalidAttachment
+		}
+	default:
+		return ErrInvalidMessageType
+	}
+	if in.IcebreakerID != "" && in.MessageType != "icebreaker" {
+		return ErrInvalidIcebreaker
+	}
+
+	if utf8.RuneCountInString(in.Message) > maxMessageLength {
+		return ErrMessageTooLong
+	}
+	if len(in.ClientID) > 64 {
+		return ErrInvalidClientID
+	}
+	return nil
+}
+
+// loadAttachment returns the attachment referenced by in after checking the
+// sender uploaded it into this match, it suits the message type and it has
+// not been sent before.
+func (h *Hub) loadAttachment(in MessageInput) (*models.Attachment, error) {
+	attachment, err := h.db.GetAttachment(*in.AttachmentID)
+	if err != nil {
+		return nil, ErrInvalidAttachment
+	}
+	if attachment.MatchID != in.MatchID || attachment.UploaderID != in.SenderID {
+		return nil, ErrInvalidAttachment
+	}
+
+	allowed := false
+	for _, contentType := range attachmentTypes[in.MessageType] {
+		if attachment.ContentType == contentType {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, ErrInvalidAttachment
+	}
+
+	sent, err := h.db.IsAttachmentSent(attachment.ID)
+	if err != nil {
+		return nil, err
+	}
+	if sent {
+		return nil, ErrInvalidAttachment
+	}
+
+	attachment.URL = media.AttachmentURL(attachment.ID)
+	return attachment, nil
+}
+
+// SendMessageToMatch validates and stores a message and delivers it to the
+// other member of the match. It is shared by the websocket and REST routes
+// so both produce identical events.
+//
+// The text is screened first and may be masked or rejected; see screen.
+//
+// ClientID is the sender's temporary ID; a retry with the same ClientID
+// returns the stored message instead of creating a duplicate. Every
+// connection of the sender receives an "ack" frame with the stored message.
+func (h *Hub) SendMessageToMatch(in MessageInput) (*models.Message, error) {
+	if err := in.validate(); err != nil {
+		return nil, err
+	}
+
+	recipientID, err := h.matchPartner(in.MatchID, in.SenderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.ClientID != "" {
+		existing, err := h.loadByClientID(in)
+		if err == nil {
+			h.sendAck(existing)
+			return existing, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	original := in.Message
+	text, flags, err := h.screen(in.Message)
+	if err != nil {
+		return nil, err
+	}
+	in.Message = text
+
+	var attachment *models.Attachment
+	if in.AttachmentID != nil {
+		if attachment, err = h.loadAttachment(in); err != nil {
+			return nil, err
+		}
+	}
+	if in.IcebreakerID != "" {
+		if err := h.checkIcebreaker(in); err != nil {
+			return nil, err
+		}
+	}
+
+	// Save message to database
+	dbMessage := &models.Message{
+		ID:           uuid.New(),
+		MatchID:      in.MatchID,
+		SenderID:     in.SenderID,
+		Message:      in.Message,
+		MessageType:  in.MessageType,
+		AttachmentID: in.AttachmentID,
+		DatePlanID:   in.DatePlanID,
+		Status:       "sent",
+		CreatedAt:    time.Now(),
+		Attachment:   attachment,
+	}
+	if in.ClientID != "" {
+		dbMessage.ClientID = &in.ClientID
+	}
+	if in.IcebreakerID != "" {
+		dbMessage.IcebreakerID = &in.IcebreakerID
+	}
+
+	// The recipient's sequence number is stored with the message so a
+	// resumed session can replay it from the database.
+	var steps []database.TxStep
+	if in.persist != nil {
+		steps = append(steps, in.persist)
+	}
+	if err := h.db.CreateMessage(dbMessage, recipientID, steps...); err != nil {
+		if errors.Is(err, database.ErrDuplicateMessage) {
+			// A concurrent retry won the race; ack with its row. With no
+			// row in this match, the ID was used in another one.
+			existing, err := h.loadByClientID(in)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, ErrClientIDInUse
+			}
+			if err != nil {
+				return nil, err
+			}
+			h.sendAck(existing)
+			return existing, nil
+		}
+		return nil, err
+	}
+
+	h.flagMessage(dbMessage, flags, original)
+
+	wsMessage := newMessageFrame(dbMessage)
+	wsMessage.Seq = *dbMessage.RecipientSeq
+	if wsMessage.Muted, err = h.db.IsMatchMuted(in.MatchID, recipientID); err != nil {
+		log.Printf("Failed to check whether match %s is muted: %v", in.MatchID, err)
+	}
+	h.publish(recipientID, wsMessage, true)
+	h.sendAck(dbMessage)
+
+	return dbMessage, nil
+}
+
+// checkIcebreaker verifies that the icebreaker in was suggested for its
+// match.
+func (h *Hub) checkIcebreaker(in MessageInput) error {
+	suggested, err := h.db.GetMatchIcebreakers(in.MatchID)
+	if err != nil {
+		return err
+	}
+	for _, id := range suggested {
+		if id == in.IcebreakerID {
+			return nil
+		}
+	}
+	return ErrInvalidIcebreaker
+}
+
+// loadByClientID returns the message already stored for in's client ID in
+// its match, or sql.ErrNoRows.
+func (h *Hub) loadByClientID(in MessageInput) (*models.Message, error) {
+	message, err := h.db.GetMessageByClientID(in.MatchID, in.SenderID, in.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.Message{*message}
+	if err := h.loadAttachments(messages); err != nil {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// loadAttachments sets Attachment, with a signed URL, on every message that
+// has one.
+func (h *Hub) loadAttachments(messages []models.Message) error {
+	if err := h.db.LoadMessageAttachments(messages); err != nil {
+		return err
+	}
+	media.SignAttachments(messages)
+	return nil
+}
+
+func (h *Hub) sendAck(message *models.Message) {
+	h.SendToUser(message.SenderID, Message{
+		Type:      "ack",
+		MatchID:   &message.MatchID,
+		ClientID:  message.ClientID,
+		Timestamp: time.Now(),
+		Data:      message,
+	})
+}
+
+func newMessageFrame(message *models.Message) Message {
+	msg := Message{
+		Type:      "new_message",
+		MatchID:   &message.MatchID,
+		Message:   &message.Message,
+		UserID:    &message.SenderID,
+		Timestamp: message.CreatedAt,
+		Data:      message,
+	}
+	if message.Attachment != nil {
+		msg.DurationMs = message.Attachment.DurationMs
+	}
+	return msg
+}
@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+)
+
+const (
+	// presenceHeartbeat is how often each replica refreshes last_active for
+	// its connected users.
+	presenceHeartbeat = time.Minute
+
+	// presenceTimeout is how long a user stays online without a heartbeat,
+	// so users of a replica that died without cleaning up drop off.
+	presenceTimeout = 3 * presenceHeartbeat
+)
+
+// Presence returns the online status and last-seen time of viewerID's
+// matches among userIDs. Users who are not a match are left out.
+func (h *Hub) Presence(viewerID uuid.UUID, userIDs []uuid.UUID) ([]models.Presence, error) {
+	if userIDs == nil {
+		userIDs = []uuid.UUID{}
+	}
+	return h.db.GetMatchPresence(viewerID, userIDs, presenceTimeout)
+}
+
+// SetPresenceHidden turns the user's "hide my online status" setting on or
+// off. Their matches are told straight away, as if the user had gone
+// offline or come back.
+func (h *Hub) SetPresenceHidden(userID uuid.UUID, hidden bool) error {
+	if err := h.db.SetHideOnlineStatus(userID, hidden); err != nil {
+		return err
+	}
+
+	user, err := h.db.GetUser(userID)
+	if err != nil {
+		return err
+	}
+
+	online := !hidden && user.IsOnline && time.Since(user.LastActive) < presenceTimeout
+	h.sendUserStatus(userID, online, nil)
+	return nil
+}
+
+// userConnected records a user's first connection to this replica and,
+// unless they were already online through another replica, tells their
+// matches.
+func (h *Hub) userConnected(userID uuid.UUID) {
+	cameOnline, err := h.db.ConnectUser(userID, h.replicaID, presenceTimeout)
+	if err != nil {
+		log.Printf("Failed to record presence for user %s: %v", userID, err)
+		return
+	}
+	if cameOnline {
+		h.announcePresence(userID, true)
+	}
+}
+
+// userDisconnected records a user's last connection to this replica
+// closing. Their matches are told when they were last seen only if no
+// other replica still holds a connection for them.
+func (h *Hub) userDisconnected(userID uuid.UUID) {
+	wentOffline, err := h.db.DisconnectUser(userID, h.replicaID, presenceTimeout)
+	if err != nil {
+		log.Printf("Failed to record presence for user %s: %v", userID, err)
+		return
+	}
+	if wentOffline {
+		h.announcePresence(userID, false)
+	}
+}
+
+// announcePresence tells the user's matches they came online or went
+// offline, unless the user hides their online status.
+func (h *Hub) announcePresence(userID uuid.UUID, online bool) {
+	user, err := h.db.GetUser(userID)
+	if err != nil {
+		log.Printf("Failed to load user %s for presence: %v", userID, err)
+		return
+	}
+	if user.HideOnline {
+		return
+	}
+
+	var lastSeen *time.Time
+	if !online {
+		lastSeen = &user.LastActive
+	}
+	h.sendUserStatus(userID, online, lastSeen)
+}
+
+// sendUserStatus sends a "user_status" event to every match of userID.
+func (h *Hub) sendUserStatus(userID uuid.UUID, online bool, lastSeen *time.Time) {
+	partners, err := h.db.GetMatchPartnerIDs(userID)
+	if err != nil {
+		log.Printf("Failed to load matches of user %s for presence: %v", userID, err)
+		return
+	}
+
+	status := "offline"
+	if online {
+		status = "online"
+	}
+	statusMsg := Message{
+		Type:      "user_status",
+		UserID:    &userID,
+		Timestamp: time.Now(),
+		Data:      UserStatusData{Status: status, LastSeen: lastSeen},
+	}
+
+	for _, partnerID := range partners {
+		h.SendToUser(partnerID, statusMsg)
+	}
+}
+
+// sendPresenceSnapshot tells a new connection the current presence of all
+// of its user's matches, so it does not have to wait for status changes.
+func (h *Hub) sendPresenceSnapshot(client *Client) {
+	presence, err := h.db.GetMatchPresence(client.userID, nil, presenceTimeout)
+	if err != nil {
+		log.Printf("Failed to load presence snapshot for user %s: %v", client.userID, err)
+		return
+	}
+	if presence == nil {
+		presence = []models.Presence{}
+	}
+
+	h.sendToClient(client, Message{
+		Type:      "presence",
+		Timestamp: time.Now(),
+		Data:      presence,
+	})
+}
+
+// heartbeat keeps last_active and this replica's connection rows fresh for
+// every user connected here until the hub is closed.
+func (h *Hub) heartbeat() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var users []uuid.UUID
+			for _, s := range h.shards {
+				users = append(users, s.connectedUsers(h.done)...)
+			}
+			if len(users) == 0 {
+				continue
+			}
+			cameOnline, err := h.db.TouchConnectedUsers(h.replicaID, users, presenceTimeout)
+			if err != nil {
+				log.Printf("Failed to refresh presence: %v", err)
+				continue
+			}
+			// Users another replica announced offline while they were
+			// still connected here come back online.
+			for _, userID := range cameOnline {
+				h.announcePresence(userID, true)
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+)
+
+//go:generate sh -c "go run ../../cmd/wsschema > ../../realtime.schema.json"
+
+// ProtocolVersion is the version of the realtime protocol this server
+// speaks. Every frame it sends carries it in "v".
+const ProtocolVersion = 1
+
+// SupportedVersions lists the protocol versions a client may negotiate.
+var SupportedVersions = []int{ProtocolVersion}
+
+var ErrUnsupportedVersion = errors.New("unsupported realtime protocol version")
+
+// NegotiateVersion picks the newest supported version from offer, the
+// comma separated versions a client passes as the "v" query parameter of
+// the handshake. Clients that predate negotiation send nothing and get
+// version 1.
+func NegotiateVersion(offer string) (int, error) {
+	if strings.TrimSpace(offer) == "" {
+		return 1, nil
+	}
+
+	best := 0
+	for _, v := range strings.Split(offer, ",") {
+		version, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, ErrUnsupportedVersion
+		}
+		for _, supported := range SupportedVersions {
+			if version == supported && version > best {
+				best = version
+			}
+		}
+	}
+	if best == 0 {
+		return 0, ErrUnsupportedVersion
+	}
+	return best, nil
+}
+
+// Typed payloads carried in the "data" field of frames.
+
+// HelloData opens every connection with the negotiated protocol version.
+type HelloData struct {
+	Version   int   `json:"version"`
+	Supported []int `json:"supported"`
+}
+
+// ErrorData describes a frame the server could not handle. Fields names
+// the missing or invalid fields of a rejected frame.
+type ErrorData struct {
+	Code         string   `json:"code"`
+	Error        string   `json:"error"`
+	Frame        string   `json:"frame,omitempty"`
+	Fields       []string `json:"fields,omitempty"`
+	RetryAfterMs int64    `json:"retry_after_ms,omitempty"`
+}
+
+// MessageStatusData lists the messages a receipt moved to Status.
+type MessageStatusData struct {
+	Status     string      `json:"status"`
+	MessageIDs []uuid.UUID `json:"message_ids"`
+}
+
+// ReactionData is a message's reactions after Action ("added" or
+// "removed").
+type ReactionData struct {
+	Action    string            `json:"action"`
+	Reactions []models.Reaction `json:"reactions"`
+}
+
+// UserStatusData is a match's presence change. LastSeen is only set when
+// the user went offline.
+type UserStatusData struct {
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen"`
+}
+
+// ResumedData ends a replay; when Complete is false the client should
+// refetch over REST.
+type ResumedData struct {
+	After    int64 `json:"after"`
+	Complete bool  `json:"complete"`
+}
+
+// TokenExpiryData carries when the connection's access token expires.
+type TokenExpiryData struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MatchUpdatedData holds the conversation settings that changed, keyed by
+// "muted", "archived" or "pinned".
+type MatchUpdatedData map[string]bool
+
+// MatchExpiryData is when a match with no messages expires, and whether its
+// one-time extension has been used.
+type MatchExpiryData struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Extended  bool      `json:"extended"`
+}
+
+// SessionDescription is a WebRTC offer or answer, as produced by
+// RTCSessionDescription.toJSON.
+type SessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// ICECandidate is a WebRTC ICE candidate, as produced by
+// RTCIceCandidate.toJSON.
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *int    `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// frameSpec describes one frame type: the envelope fields it must and may
+// carry, and the type of its data payload, if it has one.
+type frameSpec struct {
+	Doc      string
+	Fields   []string
+	Optional []string
+	Data     interface{}
+}
+
+// clientFrames are the frames clients may send. Every one may also carry
+// "v" and a "client_id" that is echoed on the resulting error or ack.
+var clientFrames = map[string]frameSpec{
+	"send_message": {
+		Doc:      "Send a message. Image, gif and audio messages reference an uploaded attachment; icebreaker messages send a suggested prompt.",
+		Fields:   []string{"match_id"},
+		Optional: []string{"message", "message_type", "attachment_id", "icebreaker_id"},
+	},
+	"edit_message": {
+		Doc:    "Edit one of your messages within 15 minutes of sending it.",
+		Fields: []string{"match_id", "message_id", "message"},
+	},
+	"delete_message": {
+		Doc:    "Unsend one of your messages within an hour of sending it.",
+		Fields: []string{"match_id", "message_id"},
+	},
+	"add_reaction": {
+		Doc:    "React to a message with an emoji.",
+		Fields: []string{"match_id", "message_id", "emoji"},
+	},
+	"remove_reaction": {
+		Doc:    "Withdraw an emoji reaction.",
+		Fields: []string{"match_id", "message_id", "emoji"},
+	},
+	"delivered": {
+		Doc:    "Every message in the match up to message_id reached this device.",
+		Fields: []string{"match_id", "message_id"},
+	},
+	"read": {
+		Doc:    "Every message in the match up to message_id was displayed.",
+		Fields: []string{"match_id", "message_id"},
+	},
+	"typing": {
+		Doc:    "The user is typing in the match.",
+		Fields: []string{"match_id"},
+	},
+	"resume": {
+		Doc:    "Replay every event after seq, the last one applied before reconnecting.",
+		Fields: []string{"seq"},
+	},
+	"reauth": {
+		Doc:    "Replace the connection's access token before it expires.",
+		Fields: []string{"token"},
+	},
+	"call_offer": {
+		Doc:      "Call the other member of the match.",
+		Fields:   []string{"match_id"},
+		Optional: []string{"video"},
+		Data:     SessionDescription{},
+	},
+	"call_answer": {
+		Doc:    "Answer a ringing call.",
+		Fields: []string{"call_id"},
+		Data:   SessionDescription{},
+	},
+	"ice_candidate": {
+		Doc:    "Relay an ICE candidate to the other member of a live call.",
+		Fields: []string{"call_id"},
+		Data:   ICECandidate{},
+	},
+	"call_end": {
+		Doc:    "Hang up, cancel or decline a call.",
+		Fields: []string{"call_id"},
+	},
+}
+
+// serverFrames are the frames the server sends. Every one carries "v" and
+// "timestamp". Frames sent to a user also carry "seq" and are replayed on
+// resume; broadcasts and replies to a single connection, such as "hello"
+// and "error", are not.
+var serverFrames = map[string]frameSpec{
+	"hello": {
+		Doc:  "First frame of every connection.",
+		Data: HelloData{},
+	},
+	"error": {
+		Doc:      "A frame from this connection failed.",
+		Optional: []string{"client_id"},
+		Data:     ErrorData{},
+	},
+	"new_message": {
+		Doc:      "A message was received.",
+		Fields:   []string{"match_id", "message", "user_id"},
+		Optional: []string{"duration_ms", "muted"},
+		Data:     models.Message{},
+	},
+	"ack": {
+		Doc:      "A message you sent was stored.",
+		Fields:   []string{"match_id"},
+		Optional: []string{"client_id"},
+		Data:     models.Message{},
+	},
+	"message_updated": {
+		Doc:    "A message was edited.",
+		Fields: []string{"match_id", "message_id", "user_id"},
+		Data:   models.Message{},
+	},
+	"message_deleted": {
+		Doc:    "A message was unsent; its content is cleared.",
+		Fields: []string{"match_id", "message_id", "user_id"},
+		Data:   models.Message{},
+	},
+	"message_status": {
+		Doc:    "Messages you sent were delivered or read.",
+		Fields: []string{"match_id", "message_id"},
+		Data:   MessageStatusData{},
+	},
+	"reaction": {
+		Doc:    "A reaction was added to or removed from a message.",
+		Fields: []string{"match_id", "message_id", "user_id", "emoji"},
+		Data:   ReactionData{},
+	},
+	"typing": {
+		Doc:    "The other member of the match is typing.",
+		Fields: []string{"match_id", "user_id"},
+	},
+	"user_status": {
+		Doc:    "A match came online or went offline.",
+		Fields: []string{"user_id"},
+		Data:   UserStatusData{},
+	},
+	"presence": {
+		Doc:  "Presence of every match, sent on connect.",
+		Data: []models.Presence{},
+	},
+	"match_updated": {
+		Doc:    "Your settings for a conversation changed on another device.",
+		Fields: []string{"match_id"},
+		Data:   MatchUpdatedData{},
+	},
+	"match_expiring": {
+		Doc:    "A match expires soon unless someone sends a message or a premium member extends it.",
+		Fields: []string{"match_id"},
+		Data:   MatchExpiryData{},
+	},
+	"match_extended": {
+		Doc:    "A member extended a match's expiry.",
+		Fields: []string{"match_id", "user_id"},
+		Data:   MatchExpiryData{},
+	},
+	"match_expired": {
+		Doc:    "A match expired without a message and is no longer active.",
+		Fields: []string{"match_id"},
+	},
+	"date_reminder": {
+		Doc:    "An accepted date starts soon.",
+		Fields: []string{"match_id"},
+		Data:   models.DatePlan{},
+	},
+	"checkin_due": {
+		Doc:  "It is time to confirm you are OK after a date, before your trusted contact is alerted.",
+		Data: models.SafetyCheckIn{},
+	},
+	"checkin_alerted": {
+		Doc:  "You did not check in after a date and your trusted contact was alerted.",
+		Data: models.SafetyCheckIn{},
+	},
+	"call_offer": {
+		Doc:    "An incoming call.",
+		Fields: []string{"match_id", "call_id", "user_id", "video"},
+		Data:   SessionDescription{},
+	},
+	"call_answer": {
+		Doc:    "Your call was answered.",
+		Fields: []string{"match_id", "call_id", "user_id"},
+		Data:   SessionDescription{},
+	},
+	"ice_candidate": {
+		Doc:    "An ICE candidate from the other member of a call.",
+		Fields: []string{"match_id", "call_id", "user_id"},
+		Data:   ICECandidate{},
+	},
+	"call_state": {
+		Doc:      "A call started ringing or was answered.",
+		Fields:   []string{"match_id", "call_id"},
+		Optional: []string{"user_id"},
+		Data:     models.Call{},
+	},
+	"call_end": {
+		Doc:    "A call is over; its status says how it ended.",
+		Fields: []string{"match_id", "call_id"},
+		Data:   models.Call{},
+	},
+	"resumed": {
+		Doc:  "A resume replay finished.",
+		Data: ResumedData{},
+	},
+	"reauth_required": {
+		Doc:  "The access token expires soon; send a reauth frame before expires_at.",
+		Data: TokenExpiryData{},
+	},
+	"reauthenticated": {
+		Doc:      "A reauth frame was accepted.",
+		Optional: []string{"client_id"},
+		Data:     TokenExpiryData{},
+	},
+}
+
+// encodeFrame stamps msg with the protocol version and encodes it.
+func encodeFrame(msg Message) []byte {
+	msg.V = ProtocolVersion
+	payload, _ := json.Marshal(msg)
+	return payload
+}
+
+// frameError is an inbound frame rejected by parseFrame.
+type frameError struct {
+	code    string
+	message string
+	fields  []string
+}
+
+// parseFrame decodes an inbound frame and checks it against clientFrames.
+// On success the frame's data, if it has any, is decoded into its typed
+// payload. A frame that fails to decode is returned with whatever fields
+// could be read, so it can still be rate limited by type.
+func parseFrame(raw []byte, version int) (Message, *frameError) {
+	var frame struct {
+		Message
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+	if err := json.Unmarshal(raw, &frame); err != nil {
+		return Message{}, &frameError{code: "malformed_frame", message: "Frame is not valid JSON or has a field of the wrong type"}
+	}
+	msg := frame.Message
+
+	if msg.V != 0 && msg.V != version {
+		return msg, &frameError{
+			code:    "unsupported_version",
+			message: fmt.Sprintf("This connection speaks protocol version %d", version),
+			fields:  []string{"v"},
+		}
+	}
+
+	spec, ok := clientFrames[msg.Type]
+	if !ok {
+		return msg, &frameError{code: "unknown_frame", message: fmt.Sprintf("Unknown frame type %q", msg.Type), fields: []string{"type"}}
+	}
+
+	var missing []string
+	envelope := reflect.ValueOf(msg)
+	for _, name := range spec.Fields {
+		if envelope.FieldByIndex(envelopeFields[name].Index).IsZero() {
+			missing = append(missing, name)
+		}
+	}
+
+	if spec.Data != nil {
+		payload, fields := decodeData(frame.Data, reflect.TypeOf(spec.Data))
+		missing = append(missing, fields...)
+		msg.Data = payload
+	}
+
+	if len(missing) > 0 {
+		return msg, &frameError{code: "invalid_frame", message: "Frame is missing or has invalid fields", fields: missing}
+	}
+	return msg, nil
+}
+
+// decodeData decodes a frame's data into t, which must be a struct type,
+// and returns it with the "data.*" fields that are missing or invalid.
+// Fields without omitempty are required.
+func decodeData(raw json.RawMessage, t reflect.Type) (interface{}, []string) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, []string{"data"}
+	}
+
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return nil, []string{"data"}
+	}
+
+	value := reflect.New(t)
+	if err := json.Unmarshal(raw, value.Interface()); err != nil {
+		return nil, []string{"data"}
+	}
+
+	var missing []string
+	for _, field := range jsonFields(t) {
+		if _, ok := present[field.name]; !ok && !field.omitempty {
+			missing = append(missing, "data."+field.name)
+		}
+	}
+	return value.Elem().Interface(), missing
+}
+
+// jsonField is a struct field as encoding/json sees it.
+type jsonField struct {
+	name      string
+	omitempty bool
+	field     reflect.StructField
+}
+
+// jsonFields lists the exported, encoded fields of struct type t.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{
+			name:      name,
+			omitempty: strings.Contains(","+opts+",", ",omitempty,"),
+			field:     f,
+		})
+	}
+	return fields
+}
+
+// envelopeFields maps the JSON names of Message's fields to the fields.
+var envelopeFields = func() map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for _, f := range jsonFields(reflect.TypeOf(Message{})) {
+		fields[f.name] = f.field
+	}
+	return fields
+}()
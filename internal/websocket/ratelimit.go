@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is a token bucket: Burst frames may arrive at once, refilled at
+// Rate frames per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits configures the per-connection limits on inbound frames. Frames
+// whose type has no entry in Frames, including malformed ones, share the
+// Default bucket. Every rejected frame also draws from Abuse; a client that
+// empties it is disconnected.
+type RateLimits struct {
+	Frames  map[string]RateLimit
+	Default RateLimit
+	Abuse   RateLimit
+}
+
+// DefaultRateLimits returns limits that comfortably fit a person chatting on
+// a couple of devices. Anything touching the database is kept tight.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Frames: map[string]RateLimit{
+			"send_message":    {Rate: 1, Burst: 10},
+			"edit_message":    {Rate: 0.5, Burst: 5},
+			"delete_message":  {Rate: 0.5, Burst: 5},
+			"add_reaction":    {Rate: 2, Burst: 10},
+			"remove_reaction": {Rate: 2, Burst: 10},
+			"delivered":       {Rate: 5, Burst: 20},
+			"read":            {Rate: 5, Burst: 20},
+			"typing":          {Rate: 0.5, Burst: 3},
+			"resume":          {Rate: 0.1, Burst: 2},
+			"reauth":          {Rate: 0.1, Burst: 3},
+			"call_offer":      {Rate: 0.2, Burst: 3},
+			"call_answer":     {Rate: 0.5, Burst: 3},
+			"ice_candidate":   {Rate: 10, Burst: 50},
+			"call_end":        {Rate: 0.5, Burst: 5},
+		},
+		Default: RateLimit{Rate: 1, Burst: 5},
+		Abuse:   RateLimit{Rate: 0.5, Burst: 20},
+	}
+}
+
+// ParseRateLimits overrides DefaultRateLimits with a comma separated list of
+// type=rate/burst entries, e.g. "send_message=2/20,typing=1/5". The special
+// types "default" and "abuse" set the Default and Abuse buckets.
+func ParseRateLimits(spec string) (RateLimits, error) {
+	limits := DefaultRateLimits()
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		frameType, value, ok := strings.Cut(entry, "=")
+		rate, burst, ok2 := strings.Cut(value, "/")
+		if !ok || !ok2 || frameType == "" {
+			return limits, fmt.Errorf("invalid rate limit %q, want type=rate/burst", entry)
+		}
+
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 {
+			return limits, fmt.Errorf("invalid rate in %q", entry)
+		}
+		b, err := strconv.Atoi(burst)
+		if err != nil || b < 1 {
+			return limits, fmt.Errorf("invalid burst in %q", entry)
+		}
+
+		limit := RateLimit{Rate: r, Burst: b}
+		switch frameType {
+		case "default":
+			limits.Default = limit
+		case "abuse":
+			limits.Abuse = limit
+		default:
+			limits.Frames[frameType] = limit
+		}
+	}
+
+	return limits, nil
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// take spends a token if one is available. Otherwise it reports how long
+// until the next one is.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// frameLimiter holds one connection's buckets. It is only used from that
+// connection's readPump, so it needs no locking.
+type frameLimiter struct {
+	limits  RateLimits
+	buckets map[string]*tokenBucket
+	abuse   *tokenBucket
+}
+
+func newFrameLimiter(limits RateLimits) *frameLimiter {
+	return &frameLimiter{
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+		abuse:   newTokenBucket(limits.Abuse, time.Now()),
+	}
+}
+
+// allow reports whether a frame of frameType may be handled now. When it
+// may not, retryAfter says when it could be, and abusive is set once the
+// client has had too many frames rejected.
+func (l *frameLimiter) allow(frameType string) (ok bool, retryAfter time.Duration, abusive bool) {
+	now := time.Now()
+
+	key := frameType
+	limit, known := l.limits.Frames[frameType]
+	if !known {
+		key, limit = "", l.limits.Default
+	}
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = newTokenBucket(limit, now)
+		l.buckets[key] = bucket
+	}
+
+	ok, retryAfter = bucket.take(now)
+	if ok {
+		return true, 0, false
+	}
+
+	tolerated, _ := l.abuse.take(now)
+	return false, retryAfter, !tolerated
+}
@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name       string
+		limit      RateLimit
+		takes      []time.Duration // offsets from start
+		wantOK     []bool
+		retryAfter time.Duration // of the last take
+	}{
+		{
+			name:       "burst then empty",
+			limit:      RateLimit{Rate: 1, Burst: 3},
+			takes:      []time.Duration{0, 0, 0, 0},
+			wantOK:     []bool{true, true, true, false},
+			retryAfter: time.Second,
+		},
+		{
+			name:   "refills at rate",
+			limit:  RateLimit{Rate: 2, Burst: 1},
+			takes:  []time.Duration{0, 0, 500 * time.Millisecond},
+			wantOK: []bool{true, false, true},
+		},
+		{
+			name:       "partial refill shortens the wait",
+			limit:      RateLimit{Rate: 1, Burst: 1},
+			takes:      []time.Duration{0, 250 * time.Millisecond},
+			wantOK:     []bool{true, false},
+			retryAfter: 750 * time.Millisecond,
+		},
+		{
+			name:   "refill is capped at burst",
+			limit:  RateLimit{Rate: 10, Burst: 2},
+			takes:  []time.Duration{time.Minute, time.Minute, time.Minute},
+			wantOK: []bool{true, true, false},
+			// One token refills in 1/10s.
+			retryAfter: 100 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newTokenBucket(tt.limit, start)
+			var retryAfter time.Duration
+			for i, offset := range tt.takes {
+				var ok bool
+				ok, retryAfter = bucket.take(start.Add(offset))
+				if ok != tt.wantOK[i] {
+					t.Fatalf("take %d: got ok=%v, want %v", i, ok, tt.wantOK[i])
+				}
+				if ok && retryAfter != 0 {
+					t.Errorf("take %d: allowed with retryAfter %s", i, retryAfter)
+				}
+			}
+			if diff := retryAfter - tt.retryAfter; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("retryAfter = %s, want %s", retryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestFrameLimiterDisconnectsAbuse(t *testing.T) {
+	limiter := newFrameLimiter(RateLimits{
+		Frames:  map[string]RateLimit{"typing": {Rate: 0.001, Burst: 1}},
+		Default: RateLimit{Rate: 0.001, Burst: 1},
+		Abuse:   RateLimit{Rate: 0.001, Burst: 2},
+	})
+
+	steps := []struct {
+		frameType   string
+		wantOK      bool
+		wantAbusive bool
+	}{
+		{"typing", true, false},
+		// Unknown types share the default bucket.
+		{"bogus", true, false},
+		{"typing", false, false},
+		{"other", false, false},
+		{"typing", false, true},
+	}
+	for i, step := range steps {
+		ok, retryAfter, abusive := limiter.allow(step.frameType)
+		if ok != step.wantOK || abusive != step.wantAbusive {
+			t.Fatalf("frame %d (%s): got ok=%v abusive=%v, want ok=%v abusive=%v",
+				i, step.frameType, ok, abusive, step.wantOK, step.wantAbusive)
+		}
+		if !ok && retryAfter <= 0 {
+			t.Errorf("frame %d (%s): rejected without a retryAfter", i, step.frameType)
+		}
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits(" send_message=2/20, default=3/4 ,abuse=0.5/7,")
+	if err != nil {
+		t.Fatalf("valid spec rejected: %v", err)
+	}
+	if got := limits.Frames["send_message"]; got != (RateLimit{Rate: 2, Burst: 20}) {
+		t.Errorf("send_message = %+v", got)
+	}
+	if limits.Default != (RateLimit{Rate: 3, Burst: 4}) {
+		t.Errorf("default = %+v", limits.Default)
+	}
+	if limits.Abuse != (RateLimit{Rate: 0.5, Burst: 7}) {
+		t.Errorf("abuse = %+v", limits.Abuse)
+	}
+	if got, want := limits.Frames["typing"], DefaultRateLimits().Frames["typing"]; got != want {
+		t.Errorf("unlisted typing = %+v, want default %+v", got, want)
+	}
+}
+
+func TestParseRateLimitsRejectsMalformed(t *testing.T) {
+	for _, spec := range []string{
+		"x=0/1",
+		"x=-1/1",
+		"x=1",
+		"=1/1",
+		"x",
+		"x=1/0",
+		"x=a/1",
+		"x=1/1.5",
+		"send_message=2/20,x=1",
+	} {
+		if _, err := ParseRateLimits(spec); err == nil {
+			t.Errorf("ParseRateLimits(%q) accepted", spec)
+		}
+	}
+}
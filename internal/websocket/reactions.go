@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/models"
+)
+
+// maxEmojiBytes fits the longest emoji ZWJ sequences.
+const maxEmojiBytes = 32
+
+var ErrInvalidEmoji = errors.New("reaction must be a single emoji")
+
+// validateEmoji rejects empty, oversized or plainly textual reactions. It
+// does not try to check the input against the Unicode emoji list.
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiBytes {
+		return ErrInvalidEmoji
+	}
+	if strings.IndexFunc(emoji, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r)
+	}) >= 0 {
+		return ErrInvalidEmoji
+	}
+	return nil
+}
+
+// AddReaction reacts to a message in the match with emoji and returns the
+// message's updated reactions.
+func (h *Hub) AddReaction(matchID, messageID, userID uuid.UUID, emoji string) ([]models.Reaction, error) {
+	return h.changeReaction(matchID, messageID, userID, emoji, true)
+}
+
+// RemoveReaction withdraws the user's emoji reaction from a message and
+// returns the message's updated reactions.
+func (h *Hub) RemoveReaction(matchID, messageID, userID uuid.UUID, emoji string) ([]models.Reaction, error) {
+	return h.changeReaction(matchID, messageID, userID, emoji, false)
+}
+
+func (h *Hub) changeReaction(matchID, messageID, userID uuid.UUID, emoji string, add bool) ([]models.Reaction, error) {
+	if err := validateEmoji(emoji); err != nil {
+		return nil, err
+	}
+
+	partnerID, err := h.matchPartner(matchID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := h.db.GetMessage(messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && message.MatchID != matchID) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if message.DeletedAt != nil {
+		return nil, ErrMessageDeleted
+	}
+
+	action := "added"
+	if add {
+		err = h.db.AddReaction(messageID, userID, emoji)
+	} else {
+		action = "removed"
+		err = h.db.RemoveReaction(messageID, userID, emoji)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reactions, err := h.db.GetReactions([]uuid.UUID{messageID})
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Type:      "reaction",
+		MatchID:   &matchID,
+		MessageID: &messageID,
+		UserID:    &userID,
+		Emoji:     &emoji,
+		Timestamp: time.Now(),
+		Data:      ReactionData{Action: action, Reactions: reactions},
+	}
+	h.SendToUser(partnerID, msg)
+	h.SendToUser(userID, msg)
+
+	return reactions, nil
+}
@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MarkDelivered records that recipientID's client received every message
+// in the match up to and including messageID, and tells the sender.
+func (h *Hub) MarkDelivered(matchID, recipientID, messageID uuid.UUID) error {
+	return h.updateReceipts(matchID, recipientID, messageID, "delivered")
+}
+
+// MarkRead records that recipientID has read every message in the match up
+// to and including messageID, and tells the sender.
+func (h *Hub) MarkRead(matchID, recipientID, messageID uuid.UUID) error {
+	return h.updateReceipts(matchID, recipientID, messageID, "read")
+}
+
+func (h *Hub) updateReceipts(matchID, recipientID, messageID uuid.UUID, status string) error {
+	senderID, err := h.matchPartner(matchID, recipientID)
+	if err != nil {
+		return err
+	}
+
+	var ids []uuid.UUID
+	if status == "read" {
+		ids, err = h.db.MarkMessagesRead(matchID, recipientID, messageID)
+	} else {
+		ids, err = h.db.MarkMessagesDelivered(matchID, recipientID, messageID)
+	}
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	h.SendToUser(senderID, Message{
+		Type:      "message_status",
+		MatchID:   &matchID,
+		MessageID: &messageID,
+		Timestamp: time.Now(),
+		Data:      MessageStatusData{Status: status, MessageIDs: ids},
+	})
+	return nil
+}
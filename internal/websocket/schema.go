@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Schema returns a JSON Schema (draft 2020-12) of the realtime protocol,
+// generated from clientFrames, serverFrames and the payload types. Its
+// $defs hold ClientFrame and ServerFrame, a oneOf of every frame in each
+// direction discriminated by "type", plus one definition per payload
+// struct. cmd/wsschema writes it to realtime.schema.json.
+func Schema() map[string]interface{} {
+	b := &schemaBuilder{defs: make(map[string]interface{})}
+
+	b.defs["ClientFrame"] = map[string]interface{}{
+		"description": "A frame sent by the client.",
+		"oneOf":       b.frames(clientFrames, false),
+	}
+	b.defs["ServerFrame"] = map[string]interface{}{
+		"description": "A frame sent by the server.",
+		"oneOf":       b.frames(serverFrames, true),
+	}
+
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "realtime.schema.json",
+		"title":   "Realtime protocol",
+		"description": "Frames exchanged over /ws. Negotiate the version with the \"v\" " +
+			"query parameter of the handshake; the server confirms it in a hello frame.",
+		"oneOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/ClientFrame"},
+			map[string]interface{}{"$ref": "#/$defs/ServerFrame"},
+		},
+		"$defs": b.defs,
+	}
+}
+
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	uuidType    = reflect.TypeOf(uuid.UUID{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// frames returns the schemas of specs, sorted by frame type.
+func (b *schemaBuilder) frames(specs map[string]frameSpec, server bool) []interface{} {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	frames := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		frames = append(frames, b.frame(name, specs[name], server))
+	}
+	return frames
+}
+
+func (b *schemaBuilder) frame(name string, spec frameSpec, server bool) map[string]interface{} {
+	properties := map[string]interface{}{
+		"type": map[string]interface{}{"const": name},
+	}
+	required := []string{"type"}
+
+	if server {
+		properties["v"] = map[string]interface{}{"const": ProtocolVersion}
+		properties["seq"] = b.envelope("seq")
+		properties["timestamp"] = b.envelope("timestamp")
+		required = append(required, "v", "timestamp")
+	} else {
+		properties["v"] = map[string]interface{}{"enum": SupportedVersions}
+		properties["client_id"] = b.envelope("client_id")
+	}
+
+	for _, field := range spec.Fields {
+		properties[field] = b.envelope(field)
+		required = append(required, field)
+	}
+	for _, field := range spec.Optional {
+		properties[field] = b.envelope(field)
+	}
+	if spec.Data != nil {
+		properties["data"] = b.typeSchema(reflect.TypeOf(spec.Data))
+		required = append(required, "data")
+	}
+
+	schema := map[string]interface{}{
+		"type":        "object",
+		"description": spec.Doc,
+		"properties":  properties,
+		"required":    required,
+	}
+	// Clients may send fields the server ignores; the server sends only
+	// what is listed.
+	if server {
+		schema["additionalProperties"] = false
+	}
+	return schema
+}
+
+// envelope returns the schema of a Message field. Envelope fields are
+// omitted rather than null when unset, so pointers are not nullable.
+func (b *schemaBuilder) envelope(name string) map[string]interface{} {
+	t := envelopeFields[name].Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return b.typeSchema(t)
+}
+
+// typeSchema returns the schema of values of t as encoding/json writes
+// them. Named structs become $defs entries.
+func (b *schemaBuilder) typeSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case uuidType:
+		return map[string]interface{}{"type": "string", "format": "uuid"}
+	case rawJSONType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(b.typeSchema(t.Elem()))
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		return b.structSchema(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	if _, ok := b.defs[t.Name()]; ok {
+		return ref
+	}
+	// Reserve the name first so recursive types terminate.
+	b.defs[t.Name()] = nil
+
+	properties := make(map[string]interface{})
+	required := []string{}
+	for _, f := range jsonFields(t) {
+		schema := b.typeSchema(f.field.Type)
+		// Nil slices and maps are written as null unless omitted.
+		if kind := f.field.Type.Kind(); !f.omitempty && (kind == reflect.Slice || kind == reflect.Map) {
+			schema = nullable(schema)
+		}
+		properties[f.name] = schema
+		if !f.omitempty {
+			required = append(required, f.name)
+		}
+	}
+
+	b.defs[t.Name()] = map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+	return ref
+}
+
+// nullable allows null in addition to schema.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	if len(schema) == 0 {
+		return schema
+	}
+	return map[string]interface{}{"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+}
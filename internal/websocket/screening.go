@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"dating-svelte/internal/models"
+)
+
+// screen runs text through the content screening rules. It returns the
+// text to store, which may be masked, and the rules that flagged it, or a
+// *screening.BlockedError if it may not be sent at all.
+func (h *Hub) screen(text string) (string, []string, error) {
+	if h.screener == nil || text == "" {
+		return text, nil, nil
+	}
+
+	result, err := h.screener.Screen(text)
+	if err != nil {
+		return "", nil, err
+	}
+	return result.Text, result.Flags, nil
+}
+
+// flagMessage queues a stored message for moderation. It runs before the
+// message is delivered, but flagging does not hold delivery back: the
+// message is already stored, so a failure is only logged.
+func (h *Hub) flagMessage(message *models.Message, rules []string, original string) {
+	if len(rules) == 0 {
+		return
+	}
+
+	flag := &models.MessageFlag{
+		ID:              uuid.New(),
+		MessageID:       message.ID,
+		SenderID:        message.SenderID,
+		Rules:           pq.StringArray(rules),
+		OriginalMessage: original,
+	}
+	if err := h.db.CreateMessageFlag(flag); err != nil {
+		log.Printf("Failed to flag message %s for moderation: %v", message.ID, err)
+	}
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// backlogSize is how many non-persisted events are kept per user for
+	// replay on resume.
+	backlogSize = 50
+
+	// backlogTTL is how long a user's backlog survives without new events.
+	backlogTTL = 10 * time.Minute
+)
+
+// shard owns the connections and event backlogs for a subset of users. Its
+// maps are only read or written from run, so commands arrive over channels.
+type shard struct {
+	clients    map[uuid.UUID]map[*Client]struct{}
+	backlogs   map[uuid.UUID]*backlog
+	membership chan membership
+	deliver    chan delivery
+	broadcast  chan []byte
+	replay     chan replayRequest
+	users      chan chan []uuid.UUID
+}
+
+type membership struct {
+	client    *Client
+	add       bool
+	closeCode int
+	reply     chan int
+}
+
+// delivery is an event for every connection of userID, or only for client
+// when it is set.
+type delivery struct {
+	userID    uuid.UUID
+	client    *Client
+	seq       int64
+	persisted bool
+	payload   []byte
+}
+
+type replayFrame struct {
+	seq     int64
+	payload []byte
+}
+
+type replayRequest struct {
+	client    *Client
+	after     int64
+	persisted []replayFrame
+	truncated bool
+	reply     chan struct{}
+}
+
+// backlog holds the most recent non-persisted events for a user. It has a
+// complete record of such events with a sequence number greater than since.
+type backlog struct {
+	events  []replayFrame
+	since   int64
+	updated time.Time
+}
+
+func newShard() *shard {
+	return &shard{
+		clients:    make(map[uuid.UUID]map[*Client]struct{}),
+		backlogs:   make(map[uuid.UUID]*backlog),
+		membership: make(chan membership),
+		deliver:    make(chan delivery, 256),
+		broadcast:  make(chan []byte),
+		replay:     make(chan replayRequest),
+		users:      make(chan chan []uuid.UUID),
+	}
+}
+
+// submitMembership registers or unregisters a client and returns the number
+// of connections its user has afterwards.
+func (s *shard) submitMembership(m membership, done <-chan struct{}) int {
+	m.reply = make(chan int, 1)
+
+	select {
+	case s.membership <- m:
+	case <-done:
+		return 0
+	}
+
+	select {
+	case n := <-m.reply:
+		return n
+	case <-done:
+		return 0
+	}
+}
+
+// submitReplay queues a replay and waits until the shard has sent it.
+func (s *shard) submitReplay(req replayRequest, done <-chan struct{}) {
+	req.reply = make(chan struct{}, 1)
+
+	select {
+	case s.replay <- req:
+	case <-done:
+		return
+	}
+
+	select {
+	case <-req.reply:
+	case <-done:
+	}
+}
+
+// connectedUsers returns the users with at least one connection on s.
+func (s *shard) connectedUsers(done <-chan struct{}) []uuid.UUID {
+	reply := make(chan []uuid.UUID, 1)
+
+	select {
+	case s.users <- reply:
+	case <-done:
+		return nil
+	}
+
+	select {
+	case users := <-reply:
+		return users
+	case <-done:
+		return nil
+	}
+}
+
+func (s *shard) run(done <-chan struct{}) {
+	sweep := time.NewTicker(time.Minute)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case m := <-s.membership:
+			if m.add {
+				s.add(m.client)
+			} else {
+				s.remove(m.client, m.closeCode)
+			}
+			m.reply <- len(s.clients[m.client.userID])
+
+		case d := <-s.deliver:
+			if d.client != nil {
+				if _, ok := s.clients[d.userID][d.client]; ok {
+					s.send(d.client, d.payload)
+				}
+				break
+			}
+			if d.seq != 0 && !d.persisted {
+				s.record(d)
+			}
+			for client := range s.clients[d.userID] {
+				s.send(client, d.payload)
+			}
+
+		case payload := <-s.broadcast:
+			for _, conns := range s.clients {
+				for client := range conns {
+					s.send(client, payload)
+				}
+			}
+
+		case req := <-s.replay:
+			s.replayTo(req)
+			req.reply <- struct{}{}
+
+		case reply := <-s.users:
+			users := make([]uuid.UUID, 0, len(s.clients))
+			for userID := range s.clients {
+				users = append(users, userID)
+			}
+			reply <- users
+
+		case now := <-sweep.C:
+			for userID, b := range s.backlogs {
+				if now.Sub(b.updated) > backlogTTL {
+					delete(s.backlogs, userID)
+				}
+			}
+
+		case <-done:
+			for _, conns := range s.clients {
+				for client := range conns {
+					s.remove(client, websocket.CloseGoingAway)
+				}
+			}
+			return
+		}
+	}
+}
+
+func (s *shard) add(client *Client) {
+	conns, ok := s.clients[client.userID]
+	if !ok {
+		conns = make(map[*Client]struct{})
+		s.clients[client.userID] = conns
+	}
+	conns[client] = struct{}{}
+}
+
+// record appends an event to its user's backlog, evicting the oldest one
+// once the backlog is full.
+func (s *shard) record(d delivery) {
+	b, ok := s.backlogs[d.userID]
+	if !ok {
+		b = &backlog{since: d.seq - 1}
+		s.backlogs[d.userID] = b
+	}
+
+	if len(b.events) == backlogSize {
+		b.since = b.events[0].seq
+		b.events = append(b.events[:0], b.events[1:]...)
+	}
+	b.events = append(b.events, replayFrame{seq: d.seq, payload: d.payload})
+	b.updated = time.Now()
+}
+
+// replayTo sends the persisted frames merged with the buffered events after
+// req.after, followed by a "resumed" frame. Only client receives them; the
+// user's other connections are unaffected.
+func (s *shard) replayTo(req replayRequest) {
+	if _, ok := s.clients[req.client.userID][req.client]; !ok {
+		return
+	}
+
+	frames := req.persisted
+	complete := !req.truncated
+
+	b, ok := s.backlogs[req.client.userID]
+	if ok && req.after >= b.since {
+		for _, event := range b.events {
+			if event.seq > req.after {
+				frames = append(frames, event)
+			}
+		}
+	} else {
+		complete = false
+	}
+
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].seq < frames[j].seq
+	})
+
+	for _, frame := range frames {
+		if !s.send(req.client, frame.payload) {
+			return
+		}
+	}
+
+	resumed := encodeFrame(Message{
+		Type:      "resumed",
+		Timestamp: time.Now(),
+		Data:      ResumedData{After: req.after, Complete: complete},
+	})
+	s.send(req.client, resumed)
+}
+
+// send queues payload without blocking and reports whether it was queued.
+// A client whose buffer is full is too slow to keep up and gets
+// disconnected.
+func (s *shard) send(client *Client, payload []byte) bool {
+	select {
+	case client.send <- payload:
+		return true
+	default:
+		log.Printf("Disconnecting slow client %s for user %s", client.id, client.userID)
+		s.remove(client, websocket.CloseTryAgainLater)
+		return false
+	}
+}
+
+// remove drops the client and closes its send channel. Removing a client
+// that is already gone is a no-op, so send is closed exactly once.
+func (s *shard) remove(client *Client, closeCode int) {
+	conns, ok := s.clients[client.userID]
+	if !ok {
+		return
+	}
+	if _, ok := conns[client]; !ok {
+		return
+	}
+
+	delete(conns, client)
+	if len(conns) == 0 {
+		delete(s.clients, client.userID)
+	}
+
+	client.closeCode = closeCode
+	close(client.send)
+}
@@ -0,0 +1,176 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+
+	"dating-svelte/internal/pubsub"
+)
+
+// closed reports whether client's send channel has been closed. The
+// channel must not hold any frames.
+func closed(client *Client) bool {
+	select {
+	case _, ok := <-client.send:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func connectedCount(h *Hub) int {
+	n := 0
+	for _, s := range h.shards {
+		n += len(s.connectedUsers(h.done))
+	}
+	return n
+}
+
+func TestRegisterUnregisterAcrossShards(t *testing.T) {
+	const users, conns = 1000, 3
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	clients := registerUsers(t, h, users, conns, 1)
+
+	if got := connectedCount(h); got != users {
+		t.Fatalf("%d users connected, want %d", got, users)
+	}
+	for i, s := range h.shards {
+		if len(s.connectedUsers(h.done)) == 0 {
+			t.Errorf("shard %d has no users", i)
+		}
+	}
+
+	// Every user's remaining-connection counts must come back as some
+	// order of conns-1 down to 0.
+	var mu sync.Mutex
+	remaining := make(map[uuid.UUID][]int, users)
+	var wg sync.WaitGroup
+	for userID, userClients := range clients {
+		for _, client := range userClients {
+			wg.Add(1)
+			go func(userID uuid.UUID, client *Client) {
+				defer wg.Done()
+				n := h.unregister(client, websocket.CloseNormalClosure)
+				mu.Lock()
+				remaining[userID] = append(remaining[userID], n)
+				mu.Unlock()
+			}(userID, client)
+		}
+	}
+	wg.Wait()
+
+	for userID, counts := range remaining {
+		seen := make(map[int]bool)
+		for _, n := range counts {
+			seen[n] = true
+		}
+		for n := 0; n < conns; n++ {
+			if !seen[n] {
+				t.Fatalf("user %s: unregister counts %v, want each of 0..%d once", userID, counts, conns-1)
+			}
+		}
+	}
+	if got := connectedCount(h); got != 0 {
+		t.Fatalf("%d users still connected", got)
+	}
+
+	for _, userClients := range clients {
+		for _, client := range userClients {
+			if !closed(client) {
+				t.Fatal("unregistered client's send channel is open")
+			}
+			if client.closeCode != websocket.CloseNormalClosure {
+				t.Fatalf("close code %d, want %d", client.closeCode, websocket.CloseNormalClosure)
+			}
+		}
+	}
+}
+
+func TestDoubleUnregister(t *testing.T) {
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	userID := uuid.New()
+	first, second := newTestClient(h, userID, 1), newTestClient(h, userID, 1)
+	h.register(first)
+	h.register(second)
+
+	if n := h.unregister(first, websocket.CloseNormalClosure); n != 1 {
+		t.Fatalf("first unregister left %d connections, want 1", n)
+	}
+	// A second unregister must neither close send again nor touch the
+	// user's other connection.
+	if n := h.unregister(first, websocket.CloseGoingAway); n != 1 {
+		t.Fatalf("second unregister left %d connections, want 1", n)
+	}
+	if first.closeCode != websocket.CloseNormalClosure {
+		t.Errorf("close code changed to %d by the second unregister", first.closeCode)
+	}
+	if closed(second) {
+		t.Error("the user's other connection was closed")
+	}
+}
+
+func TestSlowClientDisconnected(t *testing.T) {
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	userID := uuid.New()
+	slow := newTestClient(h, userID, 1)
+	fast := newTestClient(h, userID, 16)
+	h.register(slow)
+	h.register(fast)
+
+	const frames = 3
+	for i := 0; i < frames; i++ {
+		h.SendToUser(userID, Message{Type: "typing", Timestamp: time.Now()})
+	}
+	waitFor(t, "the fast client to receive every frame", func() bool {
+		return len(fast.send) == frames
+	})
+
+	// The slow client keeps the frame that fit and is then cut off.
+	if _, ok := <-slow.send; !ok {
+		t.Fatal("slow client got no frames")
+	}
+	waitFor(t, "the slow client to be disconnected", func() bool {
+		return closed(slow)
+	})
+	if slow.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("close code %d, want %d", slow.closeCode, websocket.CloseTryAgainLater)
+	}
+
+	// The read pump unregisters the dropped client too; that must be a
+	// no-op that leaves only the fast connection.
+	if n := h.unregister(slow, websocket.CloseNormalClosure); n != 1 {
+		t.Errorf("%d connections after the slow client left, want 1", n)
+	}
+}
+
+func TestSlowClientsUnderLoad(t *testing.T) {
+	const users = 2000
+	h := newTestHub(t, pubsub.NewMemoryBroker())
+	clients := registerUsers(t, h, users, 1, 2)
+
+	var wg sync.WaitGroup
+	for userID := range clients {
+		wg.Add(1)
+		go func(userID uuid.UUID) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				h.SendToUser(userID, Message{Type: "typing", Timestamp: time.Now()})
+			}
+		}(userID)
+	}
+	wg.Wait()
+
+	waitFor(t, "every slow client to be disconnected", func() bool {
+		return connectedCount(h) == 0
+	})
+	for _, userClients := range clients {
+		client := userClients[0]
+		if client.closeCode != websocket.CloseTryAgainLater {
+			t.Fatalf("close code %d, want %d", client.closeCode, websocket.CloseTryAgainLater)
+		}
+	}
+}
@@ -13,6 +13,8 @@ CREATE TABLE users (
     gdpr_consent BOOLEAN DEFAULT FALSE,
     gdpr_consent_at TIMESTAMP,
     last_active TIMESTAMP DEFAULT NOW(),
+    is_online BOOLEAN DEFAULT FALSE, -- only trusted while last_active is recent
+    hide_online_status BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
@@ -64,18 +66,171 @@ CREATE TABLE matches (
     matched_at TIMESTAMP DEFAULT NOW(),
     is_active BOOLEAN DEFAULT TRUE,
     created_at TIMESTAMP DEFAULT NOW(),
+    expires_at TIMESTAMP, -- deactivated then unless someone has sent a message; NULL never expires
+    expiry_warned_at TIMESTAMP,
+    extended_at TIMESTAMP, -- set by the one-time premium extension
     UNIQUE(user1_id, user2_id),
     CHECK (user1_id < user2_id) -- Ensure consistent ordering
 );
 
+-- Per-user conversation state for a match
+CREATE TABLE match_settings (
+    match_id UUID REFERENCES matches(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    muted BOOLEAN DEFAULT FALSE,
+    archived_at TIMESTAMP, -- hidden from the match list until a newer message arrives
+    pinned_at TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (match_id, user_id)
+);
+
+-- Private notes a user keeps on a match, never shown to the other member
+CREATE TABLE match_notes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    match_id UUID REFERENCES matches(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Dates planned inside a conversation. A counter-proposal is a new plan
+-- that marks the one it answers as countered.
+CREATE TABLE date_plans (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    match_id UUID REFERENCES matches(id) ON DELETE CASCADE,
+    proposer_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    scheduled_at TIMESTAMP NOT NULL, -- UTC, like every timestamp here
+    place_name VARCHAR(200) NOT NULL,
+    latitude DECIMAL(10, 8),
+    longitude DECIMAL(11, 8),
+    status VARCHAR(20) DEFAULT 'proposed' CHECK (status IN ('proposed', 'accepted', 'declined', 'countered')),
+    counter_of UUID REFERENCES date_plans(id) ON DELETE SET NULL,
+    responded_at TIMESTAMP,
+    reminded_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Safety check-ins for dates. If the user has not confirmed they are OK
+-- shortly after check_in_at, their trusted contact is alerted.
+CREATE TABLE safety_checkins (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    date_plan_id UUID REFERENCES date_plans(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    contact_name VARCHAR(100) NOT NULL,
+    contact_email VARCHAR(255),
+    contact_phone VARCHAR(20),
+    share_details BOOLEAN DEFAULT FALSE, -- send the contact the date details up front
+    check_in_at TIMESTAMP NOT NULL, -- UTC
+    status VARCHAR(20) DEFAULT 'scheduled' CHECK (status IN ('scheduled', 'confirmed', 'alerted', 'cancelled')),
+    prompted_at TIMESTAMP, -- when the user was asked to check in
+    confirmed_at TIMESTAMP,
+    alerted_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (date_plan_id, user_id),
+    CHECK (contact_email IS NOT NULL OR contact_phone IS NOT NULL)
+);
+
+-- Date details users have shared with their trusted contacts, so each
+-- contact is sent them once per date and users can only message so many
+-- people this way.
+CREATE TABLE checkin_shares (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    date_plan_id UUID REFERENCES date_plans(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    contact_email VARCHAR(255),
+    contact_phone VARCHAR(20),
+    shared_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Audio/video calls between match members, signaled over the websocket
+CREATE TABLE calls (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    match_id UUID REFERENCES matches(id) ON DELETE CASCADE,
+    caller_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    callee_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    video BOOLEAN DEFAULT TRUE,
+    caller_connection UUID, -- websocket connections that placed and answered
+    callee_connection UUID, -- the call, which end it if they drop
+    status VARCHAR(20) DEFAULT 'ringing' CHECK (status IN ('ringing', 'active', 'ended', 'missed', 'cancelled', 'declined', 'busy')),
+    started_at TIMESTAMP DEFAULT NOW(),
+    answered_at TIMESTAMP,
+    ended_at TIMESTAMP
+);
+
+-- Files uploaded into a conversation, served only to the match members
+CREATE TABLE attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    match_id UUID REFERENCES matches(id) ON DELETE CASCADE,
+    uploader_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    storage_key TEXT NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    width INTEGER DEFAULT 0,
+    height INTEGER DEFAULT 0,
+    duration_ms INTEGER, -- voice notes only
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
 -- Messages table
 CREATE TABLE messages (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     match_id UUID REFERENCES matches(id) ON DELETE CASCADE,
     sender_id UUID REFERENCES users(id) ON DELETE CASCADE,
     message TEXT NOT NULL,
-    message_type VARCHAR(20) DEFAULT 'text' CHECK (message_type IN ('text', 'image', 'gif')),
+    message_type VARCHAR(20) DEFAULT 'text' CHECK (message_type IN ('text', 'image', 'gif', 'audio', 'call', 'icebreaker',
+                                                                    'date_proposal', 'date_accepted', 'date_declined', 'date_counter')),
+    attachment_id UUID REFERENCES attachments(id) ON DELETE SET NULL,
+    call_id UUID REFERENCES calls(id) ON DELETE SET NULL, -- call history entries
+    icebreaker_id VARCHAR(64), -- prompt sent as an icebreaker message
+    date_plan_id UUID REFERENCES date_plans(id) ON DELETE SET NULL, -- date proposals and replies
     is_read BOOLEAN DEFAULT FALSE,
+    recipient_seq BIGINT, -- recipient's realtime sequence number, for resume
+    client_id VARCHAR(64), -- sender-generated temporary ID, for deduplication
+    status VARCHAR(20) DEFAULT 'sent' CHECK (status IN ('sent', 'delivered', 'read')),
+    delivered_at TIMESTAMP,
+    read_at TIMESTAMP,
+    edited_at TIMESTAMP,
+    deleted_at TIMESTAMP, -- tombstone for unsent messages; content is moved to message_edits
+    search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', message)) STORED,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Icebreaker prompts suggested for a match when it was created
+CREATE TABLE match_icebreakers (
+    match_id UUID REFERENCES matches(id) ON DELETE CASCADE,
+    prompt_id VARCHAR(64) NOT NULL,
+    position INTEGER NOT NULL,
+    PRIMARY KEY (match_id, prompt_id)
+);
+
+-- Emoji reactions on messages, one row per user per emoji
+CREATE TABLE message_reactions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+
+-- Previous versions of edited or unsent messages, kept for moderation
+CREATE TABLE message_edits (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    action VARCHAR(10) NOT NULL CHECK (action IN ('edit', 'delete')),
+    previous_message TEXT NOT NULL,
+    attachment_id UUID REFERENCES attachments(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Messages held for review by content screening rules
+CREATE TABLE message_flags (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    sender_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    rules TEXT[] NOT NULL,
+    original_message TEXT NOT NULL,
+    status VARCHAR(20) DEFAULT 'pending' CHECK (status IN ('pending', 'reviewed', 'resolved')),
     created_at TIMESTAMP DEFAULT NOW()
 );
 
@@ -97,12 +252,48 @@ CREATE TABLE reports (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     reporter_id UUID REFERENCES users(id) ON DELETE CASCADE,
     reported_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    match_id UUID REFERENCES matches(id) ON DELETE SET NULL,
     reason VARCHAR(100) NOT NULL,
     description TEXT,
+    -- Signed conversation snapshot taken when the report was made, stored
+    -- byte for byte so its signature still verifies
+    transcript JSON,
     status VARCHAR(20) DEFAULT 'pending' CHECK (status IN ('pending', 'reviewed', 'resolved')),
     created_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Realtime events too large for a NOTIFY payload, relayed between replicas by ID
+CREATE TABLE realtime_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Which app replicas each user has a websocket on. Each replica refreshes
+-- its rows with its presence heartbeat; a user is only announced offline
+-- once no replica has a live row for them.
+CREATE TABLE user_connections (
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    replica_id UUID NOT NULL,
+    last_seen TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (user_id, replica_id)
+);
+
+-- Per-user realtime event sequence numbers
+CREATE TABLE user_event_seqs (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL DEFAULT 0
+);
+
+-- Single-use tickets that authenticate a websocket handshake, since
+-- browsers cannot send an Authorization header on one
+CREATE TABLE ws_tickets (
+    ticket_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    token_expires_at TIMESTAMP NOT NULL, -- expiry of the access token that requested it
+    expires_at TIMESTAMP NOT NULL
+);
+
 -- Indexes for performance
 CREATE INDEX idx_users_email ON users(email);
 CREATE INDEX idx_users_status ON users(status);
@@ -121,14 +312,41 @@ CREATE INDEX idx_swipes_created ON swipes(created_at);
 CREATE INDEX idx_matches_user1 ON matches(user1_id);
 CREATE INDEX idx_matches_user2 ON matches(user2_id);
 CREATE INDEX idx_matches_active ON matches(is_active);
+CREATE INDEX idx_matches_expiring ON matches(expires_at) WHERE is_active AND expires_at IS NOT NULL;
+CREATE INDEX idx_match_notes_match_user ON match_notes(match_id, user_id, created_at);
+CREATE INDEX idx_match_notes_user ON match_notes(user_id);
+CREATE INDEX idx_date_plans_match ON date_plans(match_id, created_at);
+CREATE INDEX idx_date_plans_upcoming ON date_plans(scheduled_at) WHERE status = 'accepted';
+CREATE INDEX idx_safety_checkins_due ON safety_checkins(check_in_at) WHERE status = 'scheduled';
+CREATE INDEX idx_safety_checkins_user ON safety_checkins(user_id);
+CREATE INDEX idx_checkin_shares_plan_user ON checkin_shares(date_plan_id, user_id);
+CREATE INDEX idx_checkin_shares_user ON checkin_shares(user_id, shared_at);
+CREATE INDEX idx_reports_status ON reports(status, created_at);
 
 CREATE INDEX idx_messages_match_created ON messages(match_id, created_at);
 CREATE INDEX idx_messages_sender ON messages(sender_id);
 CREATE INDEX idx_messages_unread ON messages(is_read, created_at) WHERE is_read = FALSE;
+CREATE INDEX idx_messages_match_unread ON messages(match_id, sender_id) WHERE is_read = FALSE;
+CREATE INDEX idx_messages_match_recipient_seq ON messages(match_id, recipient_seq);
+CREATE INDEX idx_messages_search ON messages USING GIN(search_vector);
+CREATE INDEX idx_message_edits_message ON message_edits(message_id, created_at);
+CREATE UNIQUE INDEX idx_messages_attachment ON messages(attachment_id) WHERE attachment_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_messages_sender_client_id ON messages(sender_id, client_id) WHERE client_id IS NOT NULL;
+CREATE INDEX idx_messages_icebreaker ON messages(icebreaker_id) WHERE icebreaker_id IS NOT NULL;
+CREATE INDEX idx_message_flags_pending ON message_flags(created_at) WHERE status = 'pending';
+
+CREATE INDEX idx_attachments_match ON attachments(match_id);
+CREATE INDEX idx_calls_caller_live ON calls(caller_id) WHERE status IN ('ringing', 'active');
+CREATE INDEX idx_calls_callee_live ON calls(callee_id) WHERE status IN ('ringing', 'active');
+CREATE INDEX idx_calls_caller_connection ON calls(caller_connection) WHERE status IN ('ringing', 'active');
+CREATE INDEX idx_calls_callee_connection ON calls(callee_connection) WHERE status = 'active';
 
 CREATE INDEX idx_subscriptions_user ON subscriptions(user_id);
 CREATE INDEX idx_subscriptions_status ON subscriptions(status);
 
+CREATE INDEX idx_realtime_events_created ON realtime_events(created_at);
+CREATE INDEX idx_ws_tickets_expires ON ws_tickets(expires_at);
+
 -- Triggers for updated_at columns
 CREATE OR REPLACE FUNCTION update_updated_at_column()
 RETURNS TRIGGER AS $$
@@ -142,4 +360,19 @@ CREATE TRIGGER update_users_updated_at BEFORE UPDATE ON users
     FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
 
 CREATE TRIGGER update_profiles_updated_at BEFORE UPDATE ON profiles
-    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
\ No newline at end of file
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TRIGGER update_match_notes_updated_at BEFORE UPDATE ON match_notes
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- How often each icebreaker is sent and how often the other member replies
+CREATE VIEW icebreaker_stats AS
+SELECT i.icebreaker_id,
+       COUNT(*) AS sent,
+       COUNT(*) FILTER (WHERE EXISTS (
+           SELECT 1 FROM messages r
+           WHERE r.match_id = i.match_id AND r.sender_id != i.sender_id AND r.created_at > i.created_at
+       )) AS replied
+FROM messages i
+WHERE i.message_type = 'icebreaker'
+GROUP BY i.icebreaker_id;
@@ -1,42 +1,80 @@
 import { writable } from 'svelte/store';
 
+// Realtime protocol version this client speaks; see realtime.schema.json
+const PROTOCOL_VERSION = 1;
+
 // Create WebSocket store
 function createWebSocketStore() {
   const { subscribe, set, update } = writable({
     connected: false,
     messages: {},
     onlineUsers: new Set(),
+    lastSeen: {},
     typing: {}
   });
 
   let ws = null;
+  // Highest realtime sequence number applied, and the recent ones seen, so
+  // a reconnect can resume and replayed frames are not applied twice.
+  let lastSeq = 0;
+  let seenSeqs = new Set();
 
   return {
     subscribe,
     
-    connect(token) {
+    async connect(token) {
       if (ws) {
         ws.close();
       }
+
+      // Browsers cannot send an Authorization header on the handshake, so
+      // trade the access token for a short-lived single-use ticket first.
+      let ticket;
+      try {
+        const response = await fetch('/api/v1/ws/ticket', {
+          method: 'POST',
+          headers: { Authorization: `Bearer ${token}` }
+        });
+        if (!response.ok) {
+          throw new Error(`ticket request failed with ${response.status}`);
+        }
+        ({ ticket } = await response.json());
+      } catch (error) {
+        console.error('WebSocket authentication failed:', error);
+        return;
+      }
       
       const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-      const wsUrl = `${protocol}//${window.location.host}/ws`;
+      const wsUrl = `${protocol}//${window.location.host}/ws?v=${PROTOCOL_VERSION}&ticket=${encodeURIComponent(ticket)}`;
       
       ws = new WebSocket(wsUrl);
       
       ws.onopen = () => {
         console.log('WebSocket connected');
         update(store => ({ ...store, connected: true }));
-        
-        // Send authentication
-        ws.send(JSON.stringify({
-          type: 'auth',
-          token: token
-        }));
+
+        // Replay anything missed while disconnected
+        if (lastSeq > 0) {
+          ws.send(JSON.stringify({
+            type: 'resume',
+            seq: lastSeq
+          }));
+        }
       };
       
       ws.onmessage = (event) => {
         const data = JSON.parse(event.data);
+
+        if (data.seq) {
+          if (seenSeqs.has(data.seq)) {
+            return;
+          }
+          seenSeqs.add(data.seq);
+          if (seenSeqs.size > 500) {
+            seenSeqs = new Set([...seenSeqs].slice(-250));
+          }
+          lastSeq = Math.max(lastSeq, data.seq);
+        }
         
         switch (data.type) {
           case 'new_message':
@@ -48,17 +86,52 @@ function createWebSocketStore() {
               messages[data.match_id].push(data.data);
               return { ...store, messages };
             });
+            ws.send(JSON.stringify({
+              type: 'delivered',
+              match_id: data.match_id,
+              message_id: data.data.id
+            }));
             break;
             
+          case 'error':
+            console.warn('WebSocket frame rejected:', data.data);
+            break;
+
+          case 'reauth_required':
+            // The access token behind this connection is about to expire
+            token = localStorage.getItem('access_token') || token;
+            ws.send(JSON.stringify({
+              type: 'reauth',
+              token: token
+            }));
+            break;
+
+          case 'presence':
+            // Snapshot of every match's status, sent on connect
+            update(store => {
+              const onlineUsers = new Set();
+              const lastSeen = { ...store.lastSeen };
+              for (const p of data.data) {
+                if (p.online) {
+                  onlineUsers.add(p.user_id);
+                }
+                lastSeen[p.user_id] = p.last_seen;
+              }
+              return { ...store, onlineUsers, lastSeen };
+            });
+            break;
+
           case 'user_status':
             update(store => {
               const onlineUsers = new Set(store.onlineUsers);
+              const lastSeen = { ...store.lastSeen };
               if (data.data.status === 'online') {
                 onlineUsers.add(data.user_id);
               } else {
                 onlineUsers.delete(data.user_id);
               }
-              return { ...store, onlineUsers };
+              lastSeen[data.user_id] = data.data.last_seen;
+              return { ...store, onlineUsers, lastSeen };
             });
             break;
             
@@ -82,9 +155,14 @@ function createWebSocketStore() {
         }
       };
       
-      ws.onclose = () => {
+      ws.onclose = (event) => {
         console.log('WebSocket disconnected');
         update(store => ({ ...store, connected: false }));
+
+        // 4001: the token expired without a reauth; pick up a newer one
+        if (event.code === 4001) {
+          token = localStorage.getItem('access_token');
+        }
         
         // Attempt to reconnect after 3 seconds
         setTimeout(() => {
@@ -104,22 +182,37 @@ function createWebSocketStore() {
         ws.close();
         ws = null;
       }
+      lastSeq = 0;
+      seenSeqs = new Set();
       set({
         connected: false,
         messages: {},
         onlineUsers: new Set(),
+        lastSeen: {},
         typing: {}
       });
     },
     
-    sendMessage(matchId, message) {
+    sendMessage(matchId, message, clientId = crypto.randomUUID()) {
       if (ws && ws.readyState === WebSocket.OPEN) {
         ws.send(JSON.stringify({
           type: 'send_message',
           match_id: matchId,
+          client_id: clientId,
           message: message
         }));
       }
+      return clientId;
+    },
+
+    markRead(matchId, messageId) {
+      if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({
+          type: 'read',
+          match_id: matchId,
+          message_id: messageId
+        }));
+      }
     },
     
     sendTyping(matchId) {